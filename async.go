@@ -0,0 +1,238 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"reflect"
+	"time"
+)
+
+const (
+	// CallbackURLHeader is the HTTP header carrying the URL the result of
+	// an async call is posted to.
+	CallbackURLHeader = "X-Callback-Url"
+	// JobIDHeader is the HTTP header carrying the job ID of an async call,
+	// both in the acknowledgment and in the callback.
+	JobIDHeader = "X-Job-Id"
+)
+
+// DefaultCallbackTimeout is the timeout of the client posting the results
+// of async calls, unless one is set with SetCallbackClient.
+const DefaultCallbackTimeout = 30 * time.Second
+
+var defaultCallbackClient = &http.Client{Timeout: DefaultCallbackTimeout}
+
+// SetAsync marks a method as async.
+//
+// Calls to an async method carrying a callback URL in the X-Callback-Url
+// header get an accepted fault right away, sent with a 202 Accepted status,
+// with the job ID in the jobId detail member and in the X-Job-Id header.
+// The method then runs in the background and its encoded response is
+// posted to the callback URL, along with the X-Job-Id header. Calls
+// without a callback URL are served as usual.
+//
+// Callback URLs are supplied by clients, so they are checked with
+// ValidateCallbackURL, or the function set with SetCallbackValidator, and
+// calls with a rejected URL get an invalid request fault.
+//
+// The outcome of the delivery is reported to the After Function, with the
+// status returned by the callback URL.
+//
+// The method uses a dotted notation as in "Service.Method".
+func (s *Server) SetAsync(method string, async bool) error {
+	_, methodSpec, err := s.services.get(method)
+	if err != nil {
+		return err
+	}
+	s.services.mutex.Lock()
+	defer s.services.mutex.Unlock()
+	methodSpec.async = async
+	return nil
+}
+
+// SetCallbackRetry sets how many times the result of an async call is
+// posted until the callback URL returns a 2xx status, and the delay between
+// attempts. The defaults are 3 attempts, 1 second apart.
+func (s *Server) SetCallbackRetry(attempts int, delay time.Duration) {
+	s.callbackAttempts = attempts
+	s.callbackDelay = delay
+}
+
+// SetCallbackClient sets the client posting the results of async calls.
+// The default client times out after DefaultCallbackTimeout.
+func (s *Server) SetCallbackClient(client *http.Client) {
+	s.callbackClient = client
+}
+
+// SetCallbackValidator sets the function checking the callback URLs of
+// async calls, replacing ValidateCallbackURL. A non-nil error rejects the
+// call, e.g. to accept only the hosts of an allow-list.
+func (s *Server) SetCallbackValidator(f func(u *url.URL) error) {
+	s.callbackValidator = f
+}
+
+// ValidateCallbackURL is the default check of the callback URLs of async
+// calls. It accepts absolute http and https URLs whose host doesn't resolve
+// to a loopback, private, link-local or unspecified address, so clients
+// can't have the server post to itself or to its internal network.
+//
+// The host is resolved when the call is checked, not when the result is
+// posted, so servers resolving names they don't control should also
+// restrict the dialer of the client set with SetCallbackClient.
+func ValidateCallbackURL(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("rpc: callback URL scheme must be http or https, not %q", u.Scheme)
+	}
+	host := u.Hostname()
+	if host == "" {
+		return fmt.Errorf("rpc: callback URL %q has no host", u.String())
+	}
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		var err error
+		if ips, err = net.LookupIP(host); err != nil {
+			return fmt.Errorf("rpc: can't resolve callback host %q: %v", host, err)
+		}
+	}
+	for _, ip := range ips {
+		if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+			ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+			return fmt.Errorf("rpc: callback host %q resolves to the non-public address %s", host, ip)
+		}
+	}
+	return nil
+}
+
+// checkCallback parses callbackURL and checks it with the callback
+// validator.
+func (s *Server) checkCallback(callbackURL string) error {
+	u, err := url.Parse(callbackURL)
+	if err != nil {
+		return err
+	}
+	validate := s.callbackValidator
+	if validate == nil {
+		validate = ValidateCallbackURL
+	}
+	return validate(u)
+}
+
+// callAsync acknowledges an async call with its job ID, then invokes the
+// service method in the background and posts its response to callbackURL.
+func (s *Server) callAsync(w http.ResponseWriter, r *http.Request, codecReq CodecRequest, serviceSpec *service, methodSpec *serviceMethod, method, callbackURL string, args, reply reflect.Value) {
+	jobID, err := newJobID()
+	if err != nil {
+		s.writeError(w, 500, err.Error())
+		return
+	}
+	w.Header().Set(JobIDHeader, jobID)
+	buf := &responseBuffer{w: w}
+	buf.WriteHeader(http.StatusAccepted)
+	ack := Fault{
+		Code:    FaultCodeAccepted,
+		Message: "Accepted",
+		Detail:  map[string]interface{}{"jobId": jobID},
+	}
+	if errWrite := codecReq.WriteResponse(buf, nil, ack); errWrite != nil {
+		s.writeError(w, 400, errWrite.Error())
+		return
+	}
+	buf.flush()
+
+	// The method outlives the HTTP request, so it gets a context that
+	// isn't canceled when the response is written.
+	r = r.WithContext(detachedContext{r.Context()})
+	go func() {
+		errResult := s.call(serviceSpec, methodSpec, r, args, reply)
+		res := &callbackWriter{header: make(http.Header)}
+		status, err := 0, codecReq.WriteResponse(res, reply.Interface(), errResult)
+		if err == nil {
+			status, err = s.deliver(callbackURL, jobID, res)
+		}
+		if err == nil {
+			err = errResult
+		}
+		s.after(&RequestInfo{
+			Request:    r,
+			Method:     method,
+			MethodInfo: &MethodInfo{serviceSpec, methodSpec},
+			Error:      err,
+			StatusCode: status,
+			JobID:      jobID,
+		})
+	}()
+}
+
+// deliver posts the encoded response of an async call to callbackURL,
+// retrying until it returns a 2xx status. It returns the last status.
+func (s *Server) deliver(callbackURL, jobID string, res *callbackWriter) (int, error) {
+	attempts, delay := s.callbackAttempts, s.callbackDelay
+	if attempts <= 0 {
+		attempts, delay = 3, time.Second
+	}
+	client := s.callbackClient
+	if client == nil {
+		client = defaultCallbackClient
+	}
+	var status int
+	for attempt := 1; ; attempt++ {
+		req, err := http.NewRequest("POST", callbackURL, bytes.NewReader(res.body.Bytes()))
+		if err != nil {
+			return 0, err
+		}
+		req.Header.Set("Content-Type", res.header.Get("Content-Type"))
+		req.Header.Set(JobIDHeader, jobID)
+		resp, err := client.Do(req)
+		if err == nil {
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+			status = resp.StatusCode
+			if status >= 200 && status < 300 {
+				return status, nil
+			}
+			err = fmt.Errorf("rpc: callback returned %s", resp.Status)
+		}
+		if attempt >= attempts {
+			return status, err
+		}
+		time.Sleep(delay)
+	}
+}
+
+// callbackWriter is an http.ResponseWriter holding the encoded response of
+// an async call.
+type callbackWriter struct {
+	header http.Header
+	body   bytes.Buffer
+}
+
+func (w *callbackWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *callbackWriter) Write(p []byte) (int, error) {
+	return w.body.Write(p)
+}
+
+func (w *callbackWriter) WriteHeader(status int) {}
+
+// newJobID returns a random job ID.
+func newJobID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
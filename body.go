@@ -0,0 +1,100 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// DefaultMaxRequestBytes is the default cap on the size of request bodies.
+const DefaultMaxRequestBytes = 10 << 20
+
+// errRequestTooLarge is returned by limitedBody reads beyond the limit.
+var errRequestTooLarge = errors.New("rpc: request body too large")
+
+// SetMaxRequestBytes caps the size of request bodies, DefaultMaxRequestBytes
+// by default. Larger requests are rejected with a 413 Request Entity Too
+// Large status as soon as the limit is reached, before the codec buffers
+// the rest of the body. Zero or less means no limit.
+func (s *Server) SetMaxRequestBytes(n int64) {
+	s.maxRequest = n
+}
+
+// SetMaxRequestBytesFor caps the size of the bodies of requests with the
+// given content type, overriding SetMaxRequestBytes, so payloads of
+// different codecs can get different caps. Zero or less removes the
+// override.
+func (s *Server) SetMaxRequestBytesFor(contentType string, n int64) {
+	contentType = strings.ToLower(contentType)
+	if n <= 0 {
+		delete(s.maxRequestFor, contentType)
+		return
+	}
+	if s.maxRequestFor == nil {
+		s.maxRequestFor = make(map[string]int64)
+	}
+	s.maxRequestFor[contentType] = n
+}
+
+// maxRequestBytes returns the cap on the size of the bodies of requests
+// with the given content type, zero if there is none.
+func (s *Server) maxRequestBytes(contentType string) int64 {
+	if n, ok := s.maxRequestFor[strings.ToLower(contentType)]; ok {
+		return n
+	}
+	if s.maxRequest < 0 {
+		return 0
+	}
+	return s.maxRequest
+}
+
+// rejectTooLarge answers a request whose body exceeds the cap. The
+// connection is closed, as with http.MaxBytesReader, so the rest of the
+// body isn't read.
+func (s *Server) rejectTooLarge(w http.ResponseWriter) {
+	w.Header().Set("Connection", "close")
+	s.writeError(w, http.StatusRequestEntityTooLarge, errRequestTooLarge.Error())
+}
+
+// limitedBody is a request body failing reads beyond a limit, and marked
+// as exceeded once they do.
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+	exceeded  bool
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	// Read one byte more than allowed to tell bodies of exactly the limit
+	// from larger ones.
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if int64(n) <= b.remaining {
+		b.remaining -= int64(n)
+		return n, err
+	}
+	n = int(b.remaining)
+	b.remaining = 0
+	b.exceeded = true
+	return n, errRequestTooLarge
+}
+
+// countingBody is a request body counting the bytes read from it.
+type countingBody struct {
+	io.ReadCloser
+	n int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,131 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sync"
+)
+
+// SetCoalescing enables coalescing concurrent calls to safe methods: while
+// a safe method runs, identical calls to it, with the same params from the
+// same caller, wait for its result instead of calling it again. Disabled by
+// default.
+//
+// Calls are identical when the codec request implements ParamsCodecRequest
+// and the raw params are the same; calls through other codecs aren't shared.
+// Callers are told apart with the function set with SetCoalescingScope.
+func (s *Server) SetCoalescing(coalesce bool) {
+	s.coalesce = coalesce
+}
+
+// SetCoalescingScope sets the function returning the caller of a request,
+// so that coalesced calls are only shared by calls from the same caller.
+// The default scopes calls by their Authorization and Cookie headers.
+func (s *Server) SetCoalescingScope(f func(r *http.Request) string) {
+	s.coalesceScope = f
+}
+
+// ParamsCodecRequest is implemented by codec requests exposing the raw
+// encoding of their params, which keys coalesced calls.
+type ParamsCodecRequest interface {
+	// Params returns the raw params of the request.
+	Params() []byte
+}
+
+// SetSafe marks a method as safe, that is free of side effects, so that
+// identical concurrent calls can share a single execution when coalescing
+// is enabled.
+//
+// Only methods whose reply depends on nothing but their params and the
+// caller may be marked safe: calls sharing an execution get the reply
+// computed for the first one, whatever the rest of their HTTP request.
+//
+// The method uses a dotted notation as in "Service.Method".
+func (s *Server) SetSafe(method string, safe bool) error {
+	_, methodSpec, err := s.services.get(method)
+	if err != nil {
+		return err
+	}
+	s.services.mutex.Lock()
+	defer s.services.mutex.Unlock()
+	methodSpec.safe = safe
+	return nil
+}
+
+// callShared calls a safe method, sharing the result with identical
+// concurrent calls from the same caller. Calls whose codec request doesn't
+// expose its params aren't shared.
+func (s *Server) callShared(serviceSpec *service, methodSpec *serviceMethod, r *http.Request, codecReq CodecRequest, method string, args, reply reflect.Value) error {
+	paramsReq, ok := codecReq.(ParamsCodecRequest)
+	if !ok {
+		return s.call(serviceSpec, methodSpec, r, args, reply)
+	}
+	scope := s.coalesceScope
+	if scope == nil {
+		scope = defaultScope
+	}
+	h := sha256.New()
+	for _, part := range []string{method, scope(r)} {
+		fmt.Fprintf(h, "%d:%s", len(part), part)
+	}
+	h.Write(paramsReq.Params())
+	shared, errResult := s.flights.do(string(h.Sum(nil)), func() (reflect.Value, error) {
+		errResult := s.call(serviceSpec, methodSpec, r, args, reply)
+		return reply, errResult
+	})
+	if shared != reply {
+		reply.Elem().Set(shared.Elem())
+	}
+	return errResult
+}
+
+// defaultScope tells callers apart by their credentials.
+func defaultScope(r *http.Request) string {
+	return r.Header.Get("Authorization") + "\x00" + r.Header.Get("Cookie")
+}
+
+// flight is a call in progress.
+type flight struct {
+	done  chan struct{}
+	reply reflect.Value
+	err   error
+}
+
+// flightGroup runs a single call per key at a time, sharing its result
+// with the calls for the same key made meanwhile. It's the subset of
+// golang.org/x/sync/singleflight the server needs, kept here so the package
+// only depends on the charset tables of the XML codec.
+type flightGroup struct {
+	mutex sync.Mutex
+	calls map[string]*flight
+}
+
+func (g *flightGroup) do(key string, fn func() (reflect.Value, error)) (reflect.Value, error) {
+	g.mutex.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*flight)
+	}
+	if f, ok := g.calls[key]; ok {
+		g.mutex.Unlock()
+		<-f.done
+		return f.reply, f.err
+	}
+	f := &flight{done: make(chan struct{})}
+	g.calls[key] = f
+	g.mutex.Unlock()
+
+	f.reply, f.err = fn()
+
+	g.mutex.Lock()
+	delete(g.calls, key)
+	g.mutex.Unlock()
+	close(f.done)
+	return f.reply, f.err
+}
@@ -0,0 +1,129 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// defaultCompressionThreshold is the size below which responses are left
+// uncompressed when no threshold is set.
+const defaultCompressionThreshold = 1024
+
+// SetCompression makes the server gzip responses to requests accepting it
+// with an Accept-Encoding header, setting Content-Encoding: gzip. It is off
+// by default. The function receiving the response body, the wire tap and
+// the reported sizes still see the uncompressed response.
+func (s *Server) SetCompression(enabled bool) {
+	s.compression = enabled
+}
+
+// SetCompressionThreshold sets the size below which responses are left
+// uncompressed, 1024 bytes by default. Zero or less restores the default.
+func (s *Server) SetCompressionThreshold(n int) {
+	s.compressionThreshold = n
+}
+
+// acceptsGzip reports whether the Accept-Encoding header of r accepts gzip.
+func acceptsGzip(r *http.Request) bool {
+	for _, coding := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		params := strings.Split(coding, ";")
+		if name := strings.TrimSpace(params[0]); name != "gzip" && name != "*" {
+			continue
+		}
+		// A zero quality value rejects the coding.
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil && q == 0 {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// compress wraps w to gzip the response to r if compression is enabled
+// and r accepts it, and returns a function to call once the response is
+// written.
+func (s *Server) compress(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, func()) {
+	if !s.compression {
+		return w, func() {}
+	}
+	w.Header().Add("Vary", "Accept-Encoding")
+	if !acceptsGzip(r) {
+		return w, func() {}
+	}
+	threshold := s.compressionThreshold
+	if threshold <= 0 {
+		threshold = defaultCompressionThreshold
+	}
+	gw := &gzipResponseWriter{ResponseWriter: w, threshold: threshold}
+	return gw, gw.close
+}
+
+// gzipResponseWriter gzips the response written to it, unless its first
+// write is smaller than the threshold. The server writes each response
+// in one go, so the first write holds the whole body.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	threshold int
+	status    int
+	started   bool
+	gz        *gzip.Writer
+}
+
+func (w *gzipResponseWriter) WriteHeader(status int) {
+	if !w.started && w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *gzipResponseWriter) Write(p []byte) (int, error) {
+	if !w.started {
+		w.started = true
+		if len(p) >= w.threshold {
+			h := w.Header()
+			h.Set("Content-Encoding", "gzip")
+			h.Del("Content-Length")
+			w.gz = gzip.NewWriter(w.ResponseWriter)
+		}
+		if w.status != 0 {
+			w.ResponseWriter.WriteHeader(w.status)
+		}
+	}
+	if w.gz != nil {
+		return w.gz.Write(p)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Flush flushes the compressed data written so far, and the underlying
+// ResponseWriter if it is an http.Flusher.
+func (w *gzipResponseWriter) Flush() {
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// close ends the compressed stream, or sends the status of responses
+// without a body.
+func (w *gzipResponseWriter) close() {
+	if !w.started && w.status != 0 {
+		w.ResponseWriter.WriteHeader(w.status)
+	}
+	if w.gz != nil {
+		w.gz.Close()
+	}
+}
@@ -0,0 +1,230 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// contextKey is the type of the keys for values the server stores in the
+// request context.
+type contextKey int
+
+const (
+	pusherKey contextKey = iota
+	localeKey
+	abortKey
+	annotationsKey
+	startKey
+	warningsKey
+)
+
+// withPusher stores the http.Pusher of w, if any, in the context of r.
+func withPusher(w http.ResponseWriter, r *http.Request) *http.Request {
+	if p, ok := w.(http.Pusher); ok {
+		return r.WithContext(context.WithValue(r.Context(), pusherKey, p))
+	}
+	return r
+}
+
+// Pusher returns the http.Pusher of the connection serving r, so service
+// methods can send HTTP/2 server push hints.
+//
+// The second result is false when the connection doesn't support push, as
+// is always the case over HTTP/1.x. Pushing is only a hint, so callers
+// should simply skip it then.
+func Pusher(r *http.Request) (http.Pusher, bool) {
+	p, ok := r.Context().Value(pusherKey).(http.Pusher)
+	return p, ok
+}
+
+// SetLocaleSource sets where the locale of requests is read from: the args
+// field named field, matched case-insensitively, or else the HTTP header
+// named header, as in SetLocaleSource("Accept-Language", "LANGUAGE"). Only
+// the first language of a list is used. Either source may be empty.
+//
+// Service methods get the locale with Locale.
+func (s *Server) SetLocaleSource(header, field string) {
+	s.localeHeader = header
+	s.localeField = field
+}
+
+// withLocale stores the locale of the request, if any, in the context of
+// r. args is the pointer to the decoded args.
+func (s *Server) withLocale(r *http.Request, args reflect.Value) *http.Request {
+	var locale string
+	if s.localeField != "" {
+		if v := reflect.Indirect(args); v.Kind() == reflect.Struct {
+			f := v.FieldByNameFunc(func(name string) bool {
+				return strings.EqualFold(name, s.localeField)
+			})
+			if f.IsValid() && f.Kind() == reflect.String {
+				locale = f.String()
+			}
+		}
+	}
+	if locale == "" && s.localeHeader != "" {
+		locale = r.Header.Get(s.localeHeader)
+		if i := strings.IndexAny(locale, ",;"); i != -1 {
+			locale = locale[:i]
+		}
+	}
+	locale = strings.TrimSpace(locale)
+	if locale == "" {
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), localeKey, locale))
+}
+
+// Locale returns the locale of the request, read from the source set with
+// SetLocaleSource, or an empty string if there's none.
+func Locale(r *http.Request) string {
+	locale, _ := r.Context().Value(localeKey).(string)
+	return locale
+}
+
+// abort is the HTTP response requested with Abort.
+type abort struct {
+	status int
+	header http.Header
+}
+
+// Abort returns a copy of r which, returned by the Intercept Function, makes
+// the server answer with the given status and headers, and no body, instead
+// of calling the method. This lets gateway middleware reject calls at the
+// HTTP level, e.g. with a 401 and a WWW-Authenticate header:
+//
+//	s.RegisterInterceptFunc(func(i *rpc.RequestInfo) *http.Request {
+//		if !authorized(i.Request) {
+//			h := http.Header{"Www-Authenticate": {`Basic realm="ussd"`}}
+//			return rpc.Abort(i.Request, http.StatusUnauthorized, h)
+//		}
+//		return nil
+//	})
+func Abort(r *http.Request, status int, header http.Header) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), abortKey, &abort{status, header}))
+}
+
+// writeAbort writes the response requested with Abort, if any, and
+// reports whether it did.
+func (s *Server) writeAbort(w http.ResponseWriter, r *http.Request, info *RequestInfo) bool {
+	a, ok := r.Context().Value(abortKey).(*abort)
+	if !ok {
+		return false
+	}
+	for name, values := range a.header {
+		w.Header()[http.CanonicalHeaderKey(name)] = values
+	}
+	w.WriteHeader(a.status)
+	info.Request = r
+	info.StatusCode = a.status
+	s.after(info)
+	return true
+}
+
+// annotations holds the values set with Annotate during a call.
+type annotations struct {
+	mu sync.Mutex
+	m  map[string]interface{}
+}
+
+// withAnnotations gives r an empty annotations map for the call.
+func withAnnotations(r *http.Request) (*http.Request, *annotations) {
+	a := &annotations{}
+	return r.WithContext(context.WithValue(r.Context(), annotationsKey, a)), a
+}
+
+// Annotate records a value about the current call, e.g. a business outcome
+// code, that the server reports in the Annotations of the RequestInfo
+// passed to the Response and After Functions. ctx must be the context of
+// the request passed to the method; outside of a call it does nothing.
+func Annotate(ctx context.Context, key string, value interface{}) {
+	a, ok := ctx.Value(annotationsKey).(*annotations)
+	if !ok {
+		return
+	}
+	a.mu.Lock()
+	if a.m == nil {
+		a.m = make(map[string]interface{})
+	}
+	a.m[key] = value
+	a.mu.Unlock()
+}
+
+// snapshot returns a copy of the annotations, or nil if there are none.
+func (a *annotations) snapshot() map[string]interface{} {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.m) == 0 {
+		return nil
+	}
+	m := make(map[string]interface{}, len(a.m))
+	for k, v := range a.m {
+		m[k] = v
+	}
+	return m
+}
+
+// warnings holds the messages added with Warn during a call.
+type warnings struct {
+	mu   sync.Mutex
+	list []string
+}
+
+// withWarnings gives r an empty list of warnings for the call.
+func withWarnings(r *http.Request) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), warningsKey, &warnings{}))
+}
+
+// Warn adds a non-fatal warning to the response of the current call, e.g.
+// about deprecated input, without making it a fault. Codecs render the
+// warnings of successful calls, as the XML codec does with a "warnings"
+// member. ctx must be the context of the request passed to the method;
+// outside of a call it does nothing.
+func Warn(ctx context.Context, msg string) {
+	w, ok := ctx.Value(warningsKey).(*warnings)
+	if !ok {
+		return
+	}
+	w.mu.Lock()
+	w.list = append(w.list, msg)
+	w.mu.Unlock()
+}
+
+// Warnings returns the warnings added with Warn during the call of ctx, for
+// codecs to render them.
+func Warnings(ctx context.Context) []string {
+	w, ok := ctx.Value(warningsKey).(*warnings)
+	if !ok {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]string(nil), w.list...)
+}
+
+// detachedContext carries the values of its parent, but neither its
+// deadline nor its cancellation.
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (detachedContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (detachedContext) Err() error {
+	return nil
+}
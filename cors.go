@@ -0,0 +1,102 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORSConfig sets the CORS headers sent to browsers calling the server
+// from other origins.
+type CORSConfig struct {
+	// AllowedOrigins lists the origins allowed to call the server, as in
+	// "https://portal.example.com". "*" allows any origin, answered with a
+	// literal "*" and without credentials, so only listed origins can make
+	// calls with credentials.
+	AllowedOrigins []string
+	// AllowedHeaders lists the request headers calls may carry,
+	// Content-Type if empty.
+	AllowedHeaders []string
+	// ExposedHeaders lists the response headers readable by the browser.
+	ExposedHeaders []string
+	// AllowCredentials lets calls carry cookies and HTTP authentication.
+	AllowCredentials bool
+	// MaxAge is how long browsers may cache the preflight response. Zero
+	// leaves it to the browser.
+	MaxAge time.Duration
+}
+
+// EnableCORS answers OPTIONS preflight requests from the allowed origins,
+// and sets the Access-Control-Allow-* headers on the responses to their
+// calls. Preflight requests from other origins are rejected with a 403
+// Forbidden status.
+func (s *Server) EnableCORS(config CORSConfig) {
+	s.cors = &config
+}
+
+// allowOrigin reports whether calls from origin are allowed, and whether
+// only by the "*" wildcard.
+func (c *CORSConfig) allowOrigin(origin string) (allowed, wildcard bool) {
+	for _, o := range c.AllowedOrigins {
+		if strings.EqualFold(o, origin) {
+			return true, false
+		}
+		if o == "*" {
+			wildcard = true
+		}
+	}
+	return wildcard, wildcard
+}
+
+// handleCORS sets the CORS headers of the response to r, and reports
+// whether r is a preflight request, which is answered here.
+func (s *Server) handleCORS(w http.ResponseWriter, r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return false
+	}
+	preflight := r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != ""
+	h := w.Header()
+	h.Add("Vary", "Origin")
+	allowed, wildcard := s.cors.allowOrigin(origin)
+	if !allowed {
+		if preflight {
+			s.writeError(w, http.StatusForbidden, "rpc: origin not allowed: "+origin)
+		}
+		return preflight
+	}
+	// Browsers reject credentials with a wildcard origin, and echoing any
+	// origin with credentials would let every site make authenticated
+	// calls.
+	if wildcard {
+		h.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		h.Set("Access-Control-Allow-Origin", origin)
+		if s.cors.AllowCredentials {
+			h.Set("Access-Control-Allow-Credentials", "true")
+		}
+	}
+	if !preflight {
+		if len(s.cors.ExposedHeaders) > 0 {
+			h.Set("Access-Control-Expose-Headers", strings.Join(s.cors.ExposedHeaders, ", "))
+		}
+		return false
+	}
+	headers := s.cors.AllowedHeaders
+	if len(headers) == 0 {
+		headers = []string{"Content-Type"}
+	}
+	h.Set("Access-Control-Allow-Methods", "POST")
+	h.Set("Access-Control-Allow-Headers", strings.Join(headers, ", "))
+	if s.cors.MaxAge > 0 {
+		h.Set("Access-Control-Max-Age", strconv.Itoa(int(s.cors.MaxAge/time.Second)))
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
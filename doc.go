@@ -67,13 +67,19 @@ When a service is registered, the server inspects the service methods
 and make available the ones that follow these rules:
 
 	- The method name is exported.
-	- The method has three arguments: *http.Request, *args, *reply.
-	- All three arguments are pointers.
+	- The method has three arguments: *http.Request, *args, *reply. The
+	  first one may be a context.Context instead.
+	- The second and third arguments are pointers.
 	- The second and third arguments are exported or local.
 	- The method has return type error.
 
 All other methods are ignored.
 
+Responses are encoded into a buffer and written in one go once the method
+returns. If the http.ResponseWriter implements http.Flusher the response
+is flushed to the client right away; custom ResponseWriters without it
+work as well, and are left to send the response themselves.
+
 Gorilla has packages with common RPC codecs. Check out their documentation:
 
 	JSON: http://gorilla-web.appspot.com/pkg/rpc/json
@@ -0,0 +1,164 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"bytes"
+	"html/template"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// EnableExplorer makes GET requests to the endpoint serve an HTML page
+// listing the registered methods with the XML-RPC types of their args and
+// replies, and a form to try calls. The page is meant for developers, and
+// isn't subject to the Auth Function.
+//
+// Disabled by default.
+func (s *Server) EnableExplorer(enable bool) {
+	s.explorerEnabled = enable
+}
+
+// explorerMethod describes a method on the explorer page.
+type explorerMethod struct {
+	Name   string
+	Args   string
+	Reply  string
+	Fields []explorerField
+	Sample string
+}
+
+// explorerField describes a member of the args of a method.
+type explorerField struct {
+	Name string
+	Type string
+}
+
+// serveExplorer writes the explorer page.
+func (s *Server) serveExplorer(w http.ResponseWriter) {
+	var methods []explorerMethod
+	names := s.services.methodNames()
+	sort.Strings(names)
+	for _, name := range names {
+		_, methodSpec, err := s.services.get(name)
+		if err != nil {
+			continue
+		}
+		m := explorerMethod{
+			Name:  name,
+			Args:  xmlrpcType(methodSpec.argsType),
+			Reply: xmlrpcType(methodSpec.replyType),
+		}
+		m.Fields = explorerFields(methodSpec.argsType)
+		m.Sample = sampleCall(name, m.Fields)
+		methods = append(methods, m)
+	}
+	var page bytes.Buffer
+	if err := explorerTemplate.Execute(&page, methods); err != nil {
+		s.writeError(w, 500, "rpc: rendering the explorer failed: "+err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("x-content-type-options", "nosniff")
+	w.Write(page.Bytes())
+}
+
+// explorerFields returns the exported fields of the struct type t, or nil
+// if t isn't a struct.
+func explorerFields(t reflect.Type) []explorerField {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct || t == typeOfTime {
+		return nil
+	}
+	var fields []explorerField
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" || f.Anonymous && f.Type.Kind() == reflect.Interface {
+			continue
+		}
+		name := strings.Split(f.Tag.Get("xmlrpc"), ",")[0]
+		if name == "" {
+			name = strings.Split(f.Tag.Get("xml"), ",")[0]
+		}
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields = append(fields, explorerField{name, xmlrpcType(f.Type)})
+	}
+	return fields
+}
+
+// sampleCall returns an XML-RPC call of the method with empty values of
+// the args fields, to edit in the explorer form.
+func sampleCall(method string, fields []explorerField) string {
+	var b strings.Builder
+	b.WriteString("<?xml version=\"1.0\"?>\n<methodCall>\n  <methodName>" + method + "</methodName>\n")
+	if len(fields) > 0 {
+		b.WriteString("  <params><param><value><struct>\n")
+		for _, f := range fields {
+			b.WriteString("    <member><name>" + f.Name + "</name><value><" + f.Type + "></" + f.Type + "></value></member>\n")
+		}
+		b.WriteString("  </struct></value></param></params>\n")
+	}
+	b.WriteString("</methodCall>")
+	return b.String()
+}
+
+var explorerTemplate = template.Must(template.New("explorer").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>XML-RPC Explorer</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+section { border-top: 1px solid #ccc; padding: 1em 0; }
+textarea { width: 100%; height: 12em; font-family: monospace; }
+pre { background: #f4f4f4; padding: 1em; white-space: pre-wrap; }
+</style>
+</head>
+<body>
+<h1>XML-RPC Explorer</h1>
+{{range .}}<section>
+<h2>{{.Name}}</h2>
+<p>Args: <code>{{.Args}}</code>, reply: <code>{{.Reply}}</code></p>
+{{if .Fields}}<table>
+<tr><th>Member</th><th>Type</th></tr>
+{{range .Fields}}<tr><td><code>{{.Name}}</code></td><td><code>{{.Type}}</code></td></tr>
+{{end}}</table>
+{{end}}<form onsubmit="return tryCall(this)">
+<textarea name="body">{{.Sample}}</textarea>
+<button type="submit">Call</button>
+<pre class="response"></pre>
+</form>
+</section>
+{{else}}<p>No methods are registered.</p>
+{{end}}<script>
+function tryCall(form) {
+	var out = form.querySelector(".response");
+	fetch(location.href, {
+		method: "POST",
+		headers: {"Content-Type": "text/xml"},
+		body: form.body.value
+	}).then(function(res) {
+		return res.text();
+	}).then(function(text) {
+		out.textContent = text;
+	}, function(err) {
+		out.textContent = String(err);
+	});
+	return false;
+}
+</script>
+</body>
+</html>
+`))
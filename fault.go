@@ -0,0 +1,86 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Fault codes used for the faults generated by the server itself. They
+// follow http://xmlrpc-epi.sourceforge.net/specs/rfc.fault_codes.php.
+const (
+	FaultCodeParseError     = -32700
+	FaultCodeInvalidRequest = -32600
+	FaultCodeMethodNotFound = -32601
+	FaultCodeInvalidParams  = -32602
+	FaultCodeInternalError  = -32603
+	FaultCodeApplication    = -32500
+	FaultCodeTimeout        = -32001
+	FaultCodeBusy           = -32002
+	FaultCodeNotReady       = -32003
+	FaultCodeRateLimited    = -32004
+	FaultCodeAccepted       = -32005
+	FaultCodeUnauthorized   = -32098
+)
+
+// Fault is an error carrying a fault code, for codecs that support faults.
+//
+// Detail holds optional extra members that codecs encode next to the code
+// and the message.
+type Fault struct {
+	Code    int
+	Message string
+	Detail  map[string]interface{}
+	err     error // wrapped error, if any
+}
+
+// NewFault returns a fault with the given code and a message formatted
+// according to format, for service methods to return.
+func NewFault(code int, format string, args ...interface{}) error {
+	return Fault{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// WrapFault returns a fault with the given code and the message of err,
+// which remains available to errors.Is and errors.As. It returns nil if
+// err is nil.
+func WrapFault(code int, err error) error {
+	if err == nil {
+		return nil
+	}
+	return Fault{Code: code, Message: err.Error(), err: err}
+}
+
+// Error satisfies the error interface for Fault.
+func (f Fault) Error() string {
+	return fmt.Sprintf("%d: %s", f.Code, f.Message)
+}
+
+// Unwrap returns the error wrapped by WrapFault, if any.
+func (f Fault) Unwrap() error {
+	return f.err
+}
+
+var (
+	stackArgs   = regexp.MustCompile(`\(0x[0-9a-f, .x]*\)$`)
+	stackOffset = regexp.MustCompile(` \+0x[0-9a-f]+$`)
+)
+
+// sanitizeStack strips the goroutine header, argument values and program
+// counter offsets from a stack trace, keeping function names and file
+// positions.
+func sanitizeStack(stack []byte) string {
+	lines := strings.Split(strings.TrimSpace(string(stack)), "\n")
+	if len(lines) > 0 && strings.HasPrefix(lines[0], "goroutine ") {
+		lines = lines[1:]
+	}
+	for i, line := range lines {
+		line = stackArgs.ReplaceAllString(line, "(...)")
+		lines[i] = stackOffset.ReplaceAllString(line, "")
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,63 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// HeaderPolicy bounds the size of request headers. Zero limits are not
+// enforced.
+type HeaderPolicy struct {
+	// MaxTotalBytes bounds the summed length of all header names and
+	// values.
+	MaxTotalBytes int
+	// MaxValueBytes bounds the length of each header value.
+	MaxValueBytes int
+	// MaxBytes bounds the summed length of the values of single headers,
+	// by name, overriding MaxValueBytes.
+	MaxBytes map[string]int
+}
+
+// SetMaxHeaderPolicy sets the limits on request headers. Requests exceeding
+// them receive an invalid request fault, sent with a 431 Request Header
+// Fields Too Large status, without being dispatched.
+//
+// net/http already bounds the header block with http.Server's
+// MaxHeaderBytes; the policy adds tighter limits at the RPC layer.
+func (s *Server) SetMaxHeaderPolicy(policy HeaderPolicy) {
+	limits := make(map[string]int, len(policy.MaxBytes))
+	for name, max := range policy.MaxBytes {
+		limits[http.CanonicalHeaderKey(name)] = max
+	}
+	policy.MaxBytes = limits
+	s.headerPolicy = &policy
+}
+
+// check returns an error describing the first limit exceeded by header.
+func (p *HeaderPolicy) check(header http.Header) error {
+	total := 0
+	for name, values := range header {
+		size := 0
+		for _, value := range values {
+			total += len(name) + len(value)
+			size += len(value)
+			if p.MaxValueBytes > 0 && len(value) > p.MaxValueBytes {
+				if _, ok := p.MaxBytes[name]; !ok {
+					return fmt.Errorf("rpc: header %s exceeds %d bytes", name, p.MaxValueBytes)
+				}
+			}
+		}
+		if max, ok := p.MaxBytes[name]; ok && max > 0 && size > max {
+			return fmt.Errorf("rpc: header %s exceeds %d bytes", name, max)
+		}
+	}
+	if p.MaxTotalBytes > 0 && total > p.MaxTotalBytes {
+		return fmt.Errorf("rpc: headers exceed %d bytes", p.MaxTotalBytes)
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// HealthServiceName is the name the health service is registered with.
+const HealthServiceName = "Health"
+
+// EnableHealth registers or removes the built-in health service, exposing
+// the methods "Health.Ping" and "Health.Status".
+//
+// Enabling fails if a service of the caller is already registered as
+// HealthServiceName, and disabling only removes the service installed by
+// EnableHealth, never a service of the caller with that name.
+func (s *Server) EnableHealth(enable bool) error {
+	installed := s.healthInstalled()
+	if !enable {
+		if installed {
+			s.services.unregister(HealthServiceName)
+		}
+		s.health = nil
+		return nil
+	}
+	if installed {
+		return nil
+	}
+	if _, err := s.services.service(HealthServiceName); err == nil {
+		return fmt.Errorf("rpc: service name %q is already in use", HealthServiceName)
+	}
+	health := &HealthService{s}
+	if err := s.services.register(health, HealthServiceName, true, false); err != nil {
+		return err
+	}
+	s.health = health
+	return nil
+}
+
+// healthInstalled reports whether the service registered as
+// HealthServiceName is the one installed by EnableHealth.
+func (s *Server) healthInstalled() bool {
+	if s.health == nil {
+		return false
+	}
+	svc, err := s.services.service(HealthServiceName)
+	if err != nil {
+		return false
+	}
+	return svc.rcvr.Interface() == interface{}(s.health)
+}
+
+// HealthArgs are the args of the health service methods, which take none.
+type HealthArgs struct{}
+
+// PingReply is the reply of Health.Ping.
+type PingReply struct {
+	Result string
+}
+
+// StatusReply is the reply of Health.Status.
+type StatusReply struct {
+	Uptime   int // seconds since the server was created
+	Methods  int // number of registered methods
+	InFlight int // number of requests being served, including this one
+}
+
+// HealthService reports the liveness and the state of a Server. It is
+// registered with EnableHealth.
+type HealthService struct {
+	server *Server
+}
+
+// Ping replies "pong".
+func (h *HealthService) Ping(r *http.Request, args *HealthArgs, reply *PingReply) error {
+	reply.Result = "pong"
+	return nil
+}
+
+// Status replies the uptime, the number of registered methods and the
+// number of requests in flight.
+func (h *HealthService) Status(r *http.Request, args *HealthArgs, reply *StatusReply) error {
+	reply.Uptime = int(time.Since(h.server.started) / time.Second)
+	reply.Methods = h.server.services.methodCount()
+	reply.InFlight = int(atomic.LoadInt32(&h.server.active))
+	return nil
+}
@@ -0,0 +1,159 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"container/list"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// IdempotencyKeyHeader is the header carrying the idempotency key of a call.
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// DefaultIdempotencyMaxEntries is the default number of responses kept for
+// replay.
+const DefaultIdempotencyMaxEntries = 10000
+
+// SetIdempotencyTTL enables replaying responses for calls carrying an
+// Idempotency-Key header. Zero, the default, disables it.
+//
+// The response of a successful call is kept for ttl, and a call repeating
+// its method and key within that time, from the same caller, gets the same
+// response without the method being called again. Calls whose args fail to
+// decode, or returning an error, aren't kept, so they can be retried.
+//
+// At most DefaultIdempotencyMaxEntries responses are kept, unless set
+// otherwise with SetIdempotencyMaxEntries; the oldest ones are dropped to
+// keep new ones.
+func (s *Server) SetIdempotencyTTL(ttl time.Duration) {
+	if ttl <= 0 {
+		s.idempotency = nil
+		return
+	}
+	s.idempotency = &idempotencyCache{
+		ttl:     ttl,
+		max:     s.idempotencyMax,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// SetIdempotencyMaxEntries caps the number of responses kept for replay.
+// Zero or less restores DefaultIdempotencyMaxEntries.
+func (s *Server) SetIdempotencyMaxEntries(n int) {
+	s.idempotencyMax = n
+	if c := s.idempotency; c != nil {
+		c.mutex.Lock()
+		c.max = n
+		c.mutex.Unlock()
+	}
+}
+
+// SetIdempotencyScope sets the function returning the caller of a request,
+// so that a response is only replayed to the caller it was made for. The
+// default scopes calls by their Authorization and Cookie headers.
+func (s *Server) SetIdempotencyScope(f func(r *http.Request) string) {
+	s.idempotencyScope = f
+}
+
+// idempotencyKey returns the key the response of a call is kept by, from
+// its method, its caller and its idempotency key.
+func (s *Server) idempotencyKey(r *http.Request, method, key string) string {
+	scope := s.idempotencyScope
+	if scope == nil {
+		scope = defaultScope
+	}
+	var b strings.Builder
+	for _, part := range []string{method, scope(r)} {
+		fmt.Fprintf(&b, "%d:%s", len(part), part)
+	}
+	b.WriteString(key)
+	return b.String()
+}
+
+// cachedResponse is a response kept for replay.
+type cachedResponse struct {
+	key     string
+	status  int
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+// idempotencyCache keeps the responses of calls by key. All the responses
+// live for the same ttl, so order, from the oldest to the newest, is also
+// the order they expire in.
+type idempotencyCache struct {
+	mutex   sync.Mutex
+	ttl     time.Duration
+	max     int
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+// get returns the unexpired response kept for the key, if any.
+func (c *idempotencyCache) get(key string) (*cachedResponse, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	res := e.Value.(*cachedResponse)
+	if time.Now().After(res.expires) {
+		c.remove(e)
+		return nil, false
+	}
+	return res, true
+}
+
+// put keeps the buffered response for the key, dropping the expired
+// responses, and the oldest ones beyond the cap.
+func (c *idempotencyCache) put(key string, buf *responseBuffer) {
+	now := time.Now()
+	res := &cachedResponse{
+		key:     key,
+		status:  buf.statusCode(),
+		header:  buf.Header().Clone(),
+		body:    append([]byte(nil), buf.body.Bytes()...),
+		expires: now.Add(c.ttl),
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if e, ok := c.entries[key]; ok {
+		c.remove(e)
+	}
+	max := c.max
+	if max <= 0 {
+		max = DefaultIdempotencyMaxEntries
+	}
+	for e := c.order.Front(); e != nil; e = c.order.Front() {
+		if c.order.Len() < max && !now.After(e.Value.(*cachedResponse).expires) {
+			break
+		}
+		c.remove(e)
+	}
+	c.entries[key] = c.order.PushBack(res)
+}
+
+// remove drops the response held by e.
+func (c *idempotencyCache) remove(e *list.Element) {
+	c.order.Remove(e)
+	delete(c.entries, e.Value.(*cachedResponse).key)
+}
+
+// replay writes the kept response to w.
+func (res *cachedResponse) replay(w http.ResponseWriter) {
+	for k, v := range res.header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(res.status)
+	w.Write(res.body)
+}
@@ -0,0 +1,222 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Names of the built-in introspection methods.
+const (
+	listMethodsName     = "system.listMethods"
+	methodSignatureName = "system.methodSignature"
+)
+
+// EnableIntrospection enables the built-in introspection methods:
+//
+//   - system.listMethods returns the sorted names of the registered methods
+//     as an array of strings. Methods of the default service are listed
+//     without a service name.
+//   - system.methodSignature takes a method name and returns its signature
+//     as an array holding an array of XML-RPC type names, the type of the
+//     reply first, followed by the type of the args.
+//
+// Disabled by default.
+func (s *Server) EnableIntrospection(enable bool) {
+	s.introspectionEnabled = enable
+}
+
+// Annotations of methods, for MethodsWithAnnotation.
+const (
+	AnnotationSafe   = "safe"   // set with SetSafe
+	AnnotationOneWay = "oneWay" // set with SetOneWay
+	AnnotationAsync  = "async"  // set with SetAsync
+)
+
+// MethodsWithPrefix returns the sorted names of the registered methods,
+// including aliases, starting with prefix, as in "Billing." for the methods
+// of the Billing service.
+func (s *Server) MethodsWithPrefix(prefix string) []string {
+	var names []string
+	for _, name := range s.services.methodNames() {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// MethodsWithAnnotation returns the sorted names of the registered methods,
+// including aliases, carrying the annotation, one of AnnotationSafe,
+// AnnotationOneWay and AnnotationAsync. Other annotations match no method.
+func (s *Server) MethodsWithAnnotation(annotation string) []string {
+	var names []string
+	for _, name := range s.services.methodNames() {
+		serviceSpec, methodSpec, err := s.services.get(name)
+		if err != nil {
+			continue
+		}
+		if s.services.settings(serviceSpec, methodSpec).annotated(annotation) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// annotated reports whether the method carries the annotation.
+func (m methodSettings) annotated(annotation string) bool {
+	switch annotation {
+	case AnnotationSafe:
+		return m.safe
+	case AnnotationOneWay:
+		return m.oneWay
+	case AnnotationAsync:
+		return m.async
+	}
+	return false
+}
+
+// builtinMethod is a method served by the server itself.
+type builtinMethod struct {
+	// args returns a pointer to new args, or nil for methods taking none.
+	args func() interface{}
+	// call returns a pointer to the reply for the args.
+	call func(args interface{}) (interface{}, error)
+}
+
+// builtin returns the built-in method with the given name, if enabled.
+func (s *Server) builtin(method string) (*builtinMethod, bool) {
+	if !s.introspectionEnabled {
+		return nil, false
+	}
+	switch method {
+	case listMethodsName:
+		return &builtinMethod{call: s.listMethods}, true
+	case methodSignatureName:
+		return &builtinMethod{
+			args: func() interface{} { return new(string) },
+			call: s.methodSignature,
+		}, true
+	}
+	return nil, false
+}
+
+// serveBuiltin calls a built-in method and writes its reply.
+func (s *Server) serveBuiltin(w http.ResponseWriter, r *http.Request, codecReq CodecRequest, method string, builtin *builtinMethod) {
+	if errAuth := s.authorize(r, method); errAuth != nil {
+		s.writeFault(w, r, codecReq, http.StatusOK, Fault{Code: FaultCodeUnauthorized, Message: errAuth.Error()})
+		return
+	}
+	var args interface{}
+	if builtin.args != nil {
+		args = builtin.args()
+		if errRead := codecReq.ReadRequest(args); errRead != nil {
+			s.writeMethodFault(w, r, codecReq, method, http.StatusOK, Fault{Code: FaultCodeInvalidParams, Message: errRead.Error()})
+			return
+		}
+	}
+	reply, errResult := builtin.call(args)
+	w.Header().Set("x-content-type-options", "nosniff")
+	buf := &responseBuffer{w: w}
+	if errWrite := codecReq.WriteResponse(buf, reply, errResult); errWrite != nil {
+		s.writeError(w, 400, errWrite.Error())
+		return
+	}
+	if errResult != nil {
+		markFailed(w)
+	}
+	buf.flush()
+	s.after(&RequestInfo{
+		Request:    r,
+		Method:     method,
+		Error:      errResult,
+		StatusCode: buf.statusCode(),
+	})
+}
+
+// listMethods implements system.listMethods.
+func (s *Server) listMethods(args interface{}) (interface{}, error) {
+	names := append(s.services.methodNames(), listMethodsName, methodSignatureName)
+	sort.Strings(names)
+	return &names, nil
+}
+
+// methodSignature implements system.methodSignature.
+func (s *Server) methodSignature(args interface{}) (interface{}, error) {
+	method := *args.(*string)
+	_, methodSpec, err := s.resolve(method)
+	if err != nil {
+		return nil, Fault{Code: FaultCodeMethodNotFound, Message: fmt.Sprintf("Method Not Found: %q", method)}
+	}
+	signatures := [][]string{{xmlrpcType(methodSpec.replyType), xmlrpcType(methodSpec.argsType)}}
+	return &signatures, nil
+}
+
+var typeOfTime = reflect.TypeOf(time.Time{})
+
+// xmlrpcType returns the name of the XML-RPC type values of type t are
+// encoded as.
+func xmlrpcType(t reflect.Type) string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint8, reflect.Uint16:
+		return "int"
+	case reflect.Int64, reflect.Uint, reflect.Uint32, reflect.Uint64:
+		// Encoded as <i8> by the XML codec.
+		return "i8"
+	case reflect.Float32, reflect.Float64:
+		return "double"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.String:
+		return "string"
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return "base64"
+		}
+		return "array"
+	case reflect.Struct:
+		if t == typeOfTime {
+			return "dateTime.iso8601"
+		}
+		return "struct"
+	case reflect.Map:
+		return "struct"
+	}
+	return "undef"
+}
+
+// methodNames returns the names of the registered methods, as in
+// "Service.Method", and the bare names of the methods of the default
+// service.
+func (m *serviceMap) methodNames() []string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	var names []string
+	for _, s := range m.services {
+		for name := range s.methods {
+			names = append(names, s.name+"."+name)
+		}
+	}
+	if m.defaultService != nil {
+		for name := range m.defaultService.methods {
+			names = append(names, name)
+		}
+	}
+	for name := range m.aliases {
+		names = append(names, name)
+	}
+	return names
+}
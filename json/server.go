@@ -55,6 +55,18 @@ func NewCodec() *Codec {
 type Codec struct {
 }
 
+// WriteFault encodes the fault as the response to a request the server
+// rejected before reading it, with a null id. It implements
+// rpc.FaultWriter.
+func (c *Codec) WriteFault(w http.ResponseWriter, fault rpc.Fault) error {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	return json.NewEncoder(w).Encode(&serverResponse{
+		Result: &null,
+		Error:  fault.Error(),
+		Id:     &null,
+	})
+}
+
 // NewRequest returns a CodecRequest.
 func (c *Codec) NewRequest(r *http.Request) rpc.CodecRequest {
 	return newCodecRequest(r)
@@ -89,6 +101,14 @@ func (c *CodecRequest) Method() (string, error) {
 	return "", c.err
 }
 
+// Params returns the raw params of the request, which key coalesced calls.
+func (c *CodecRequest) Params() []byte {
+	if c.request == nil || c.request.Params == nil {
+		return nil
+	}
+	return *c.request.Params
+}
+
 // ReadRequest fills the request object for the RPC method.
 func (c *CodecRequest) ReadRequest(args interface{}) error {
 	if c.err == nil {
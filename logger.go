@@ -0,0 +1,33 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+// Logger receives the diagnostic messages of the server, such as the
+// methods skipped when registering a service. *log.Logger satisfies it.
+type Logger interface {
+	Printf(format string, args ...interface{})
+}
+
+// SetLogger sets the logger receiving the diagnostic messages of the
+// server. By default they are discarded; a nil logger restores the default.
+//
+// The logger should be set before registering services.
+func (s *Server) SetLogger(logger Logger) {
+	s.services.mutex.Lock()
+	defer s.services.mutex.Unlock()
+	s.services.logger = logger
+}
+
+// logf sends a diagnostic message to the logger, if any. It must be called
+// without holding the mutex.
+func (m *serviceMap) logf(format string, args ...interface{}) {
+	m.mutex.Lock()
+	logger := m.logger
+	m.mutex.Unlock()
+	if logger != nil {
+		logger.Printf(format, args...)
+	}
+}
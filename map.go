@@ -6,20 +6,23 @@
 package rpc
 
 import (
+	"context"
 	"fmt"
-	"log"
 	"net/http"
 	"reflect"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 	"unicode"
 	"unicode/utf8"
 )
 
 var (
-	// Precompute the reflect.Type of error and http.Request
+	// Precompute the reflect.Type of error, http.Request and context.Context
 	typeOfError   = reflect.TypeOf((*error)(nil)).Elem()
 	typeOfRequest = reflect.TypeOf((*http.Request)(nil)).Elem()
+	typeOfContext = reflect.TypeOf((*context.Context)(nil)).Elem()
 )
 
 // ----------------------------------------------------------------------------
@@ -31,13 +34,79 @@ type service struct {
 	rcvr     reflect.Value             // receiver of methods for the service
 	rcvrType reflect.Type              // type of the receiver
 	methods  map[string]*serviceMethod // registered methods
+	folded   map[string]*serviceMethod // registered methods by lowercased name
 	passReq  bool
+	timeout  time.Duration // default timeout for the service methods
+	rejected map[string]string // reasons methods were skipped, by name
 }
 
 type serviceMethod struct {
+	name      string         // name of the method
 	method    reflect.Method // receiver method
+	rcvr      reflect.Value  // receiver overriding the service receiver
 	argsType  reflect.Type   // type of the request argument
 	replyType reflect.Type   // type of the response argument
+	timeout   time.Duration  // timeout overriding the service timeout
+	oneWay    bool           // whether calls don't wait for the method
+	async     bool           // whether calls with a callback URL run in the background
+	safe      bool           // whether identical calls can share a result
+	passCtx   bool           // whether the method takes a context.Context instead of the HTTP request
+}
+
+// MethodInfo is a read-only view of a resolved service method, for the
+// functions registered on the server.
+type MethodInfo struct {
+	service *service
+	method  *serviceMethod
+}
+
+// Name returns the registered name of the method, as in "Service.Method",
+// or an empty string for the nil MethodInfo of unknown methods.
+func (m *MethodInfo) Name() string {
+	if m == nil {
+		return ""
+	}
+	return m.service.name + "." + m.method.name
+}
+
+// ArgsType returns the type of the request argument, or nil for the nil
+// MethodInfo of unknown methods.
+func (m *MethodInfo) ArgsType() reflect.Type {
+	if m == nil {
+		return nil
+	}
+	return m.method.argsType
+}
+
+// ReplyType returns the type of the response argument, or nil for the nil
+// MethodInfo of unknown methods.
+func (m *MethodInfo) ReplyType() reflect.Type {
+	if m == nil {
+		return nil
+	}
+	return m.method.replyType
+}
+
+// PassRequest reports whether the method receives the HTTP request.
+func (m *MethodInfo) PassRequest() bool {
+	return m != nil && m.service.passReq && !m.method.passCtx
+}
+
+// PassContext reports whether the method receives the context of the HTTP
+// request instead of the request itself.
+func (m *MethodInfo) PassContext() bool {
+	return m != nil && m.method.passCtx
+}
+
+// Receiver returns the receiver the service was registered with, so that
+// middleware can reach its dependencies, e.g. a config field. It returns
+// nil for the nil MethodInfo of unknown methods and for services built
+// from single functions, as with RegisterTyped.
+func (m *MethodInfo) Receiver() interface{} {
+	if m == nil || !m.service.rcvr.IsValid() {
+		return nil
+	}
+	return m.service.rcvr.Interface()
 }
 
 // ----------------------------------------------------------------------------
@@ -46,9 +115,16 @@ type serviceMethod struct {
 
 // serviceMap is a registry for services.
 type serviceMap struct {
-	mutex    sync.Mutex
-	services map[string]*service
-	defaultService *service
+	mutex           sync.Mutex
+	services        map[string]*service
+	defaultService  *service
+	defaultDisabled bool                   // whether bare method names are rejected
+	caseInsensitive bool                   // whether lookups fall back to folded names
+	folded          map[string]*service    // services by lowercased name
+	aliases         map[string]*MethodInfo // methods by external name
+	logger          Logger                 // receives diagnostic messages, if not nil
+	maxServices     int                    // maximum number of services, 0 for no limit
+	maxMethods      int                    // maximum number of methods per service, 0 for no limit
 }
 
 // register adds a new service using reflection to extract its methods.
@@ -62,6 +138,9 @@ func (m *serviceMap) register(rcvr interface{}, name string, passReq,isDefault b
 		passReq:  passReq,
 	}
 	if name == "" {
+		s.name = declaredName(rcvr)
+	}
+	if s.name == "" {
 		s.name = reflect.Indirect(s.rcvr).Type().Name()
 		if !isExported(s.name) {
 			return fmt.Errorf("rpc: type %q is not exported", s.name)
@@ -77,7 +156,7 @@ func (m *serviceMap) register(rcvr interface{}, name string, passReq,isDefault b
 		method := s.rcvrType.Method(i)
 		mtype := method.Type
 
-		log.Printf("got method %s",method.Name)
+		m.logf("got method %s",method.Name)
 
 		// offset the parameter indexes by one if the
 		// service methods accept an HTTP request pointer
@@ -91,24 +170,30 @@ func (m *serviceMap) register(rcvr interface{}, name string, passReq,isDefault b
 		// Method must be exported.
 		if method.PkgPath != "" {
 
-			log.Printf("got method %s is not exported skipping it",method.Name)
+			m.logf("got method %s is not exported skipping it",method.Name)
+			s.reject(method.Name, "not exported")
 			continue
 		}
 		// Method needs four ins: receiver, *http.Request, *args, *reply.
 		if mtype.NumIn() != 3+paramOffset {
 
-			log.Printf("got method %s does not Method needs four ins: receiver, *http.Request, *args, *reply. skipping it",method.Name)
+			m.logf("got method %s does not Method needs four ins: receiver, *http.Request, *args, *reply. skipping it",method.Name)
+			s.reject(method.Name, fmt.Sprintf("takes %d arguments, should take %d", mtype.NumIn()-1, 2+paramOffset))
 			continue
 		}
 
 		// If the service methods accept an HTTP request pointer
+		var passCtx bool
 		if passReq {
 
-			// First argument must be a pointer and must be http.Request.
+			// First argument must be a pointer to http.Request, or a
+			// context.Context.
 			reqType := mtype.In(1)
-			if reqType.Kind() != reflect.Ptr || reqType.Elem() != typeOfRequest {
+			passCtx = reqType == typeOfContext
+			if !passCtx && (reqType.Kind() != reflect.Ptr || reqType.Elem() != typeOfRequest) {
 
-				log.Printf("got method %s First argument is not a pointer and must be http.Request. skipping it",method.Name)
+				m.logf("got method %s First argument is not a pointer to http.Request or a context.Context. skipping it",method.Name)
+				s.reject(method.Name, "first argument is not a *http.Request or a context.Context")
 				continue
 			}
 		}
@@ -116,7 +201,8 @@ func (m *serviceMap) register(rcvr interface{}, name string, passReq,isDefault b
 		args := mtype.In(1 + paramOffset)
 		if args.Kind() != reflect.Ptr || !isExportedOrBuiltin(args) {
 
-			log.Printf("got method %s 1 Next argument must be a pointer and must be exported.. skipping it",method.Name)
+			m.logf("got method %s 1 Next argument must be a pointer and must be exported.. skipping it",method.Name)
+			s.reject(method.Name, "args must be an exported pointer")
 			continue
 		}
 
@@ -124,26 +210,31 @@ func (m *serviceMap) register(rcvr interface{}, name string, passReq,isDefault b
 		reply := mtype.In(2 + paramOffset)
 		if reply.Kind() != reflect.Ptr || !isExportedOrBuiltin(reply) {
 
-			log.Printf("got method %s 2 Next argument must be a pointer and must be exported.. skipping it",method.Name)
+			m.logf("got method %s 2 Next argument must be a pointer and must be exported.. skipping it",method.Name)
+			s.reject(method.Name, "reply must be an exported pointer")
 			continue
 		}
 		// Method needs one out: error.
 		if mtype.NumOut() != 1 {
 
-			log.Printf("got method %s Method needs one out: error. skipping it",method.Name)
+			m.logf("got method %s Method needs one out: error. skipping it",method.Name)
+			s.reject(method.Name, "must return exactly one value, an error")
 			continue
 		}
 
 		if returnType := mtype.Out(0); returnType != typeOfError {
 
-			log.Printf("got method %s return type is not error. skipping it",method.Name)
+			m.logf("got method %s return type is not error. skipping it",method.Name)
+			s.reject(method.Name, "must return an error")
 			continue
 		}
-		s.methods[method.Name] = &serviceMethod{
+		s.addMethod(method.Name, &serviceMethod{
+			name:      method.Name,
 			method:    method,
 			argsType:  args.Elem(),
 			replyType: reply.Elem(),
-		}
+			passCtx:   passCtx,
+		})
 	}
 
 	if len(s.methods) == 0 {
@@ -159,8 +250,16 @@ func (m *serviceMap) register(rcvr interface{}, name string, passReq,isDefault b
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
 
+	if m.maxMethods > 0 && len(s.methods) > m.maxMethods {
+		return fmt.Errorf("rpc: %q has %d methods, more than the maximum of %d",
+			s.name, len(s.methods), m.maxMethods)
+	}
+
 	if isDefault {
 
+		if m.defaultDisabled {
+			return fmt.Errorf("rpc: default service disabled")
+		}
 		m.defaultService = s
 		return nil
 
@@ -174,15 +273,163 @@ func (m *serviceMap) register(rcvr interface{}, name string, passReq,isDefault b
 
 			return fmt.Errorf("rpc: service already defined: %q", s.name)
 		}
+		if err := m.checkServiceCount(); err != nil {
+			return err
+		}
 	}
 
 	m.services[s.name] = s
+	m.fold(s)
+	return nil
+}
+
+// registerFunc adds a single method to a service, creating the service if
+// needed. The method is the Call method of rcvr, which must take the three
+// arguments *http.Request, *args, *reply and return an error.
+//
+// The name uses a dotted notation as in "Service.Method". Services
+// registered with a receiver can't be extended this way.
+func (m *serviceMap) registerFunc(rcvr interface{}, name string) error {
+	parts := strings.Split(name, ".")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return fmt.Errorf("rpc: service/method name ill-formed: %q", name)
+	}
+	v := reflect.ValueOf(rcvr)
+	method, ok := v.Type().MethodByName("Call")
+	if !ok {
+		return fmt.Errorf("rpc: type %q has no Call method", v.Type().String())
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.services == nil {
+		m.services = make(map[string]*service)
+	}
+	s := m.services[parts[0]]
+	if s == nil {
+		if err := m.checkServiceCount(); err != nil {
+			return err
+		}
+		s = &service{
+			name:    parts[0],
+			methods: make(map[string]*serviceMethod),
+			passReq: true,
+		}
+		m.services[s.name] = s
+		m.fold(s)
+	} else if s.rcvr.IsValid() {
+		return fmt.Errorf("rpc: service already defined: %q", s.name)
+	} else if _, ok := s.methods[parts[1]]; ok {
+		return fmt.Errorf("rpc: method already defined: %q", name)
+	} else if m.maxMethods > 0 && len(s.methods) >= m.maxMethods {
+		return fmt.Errorf("rpc: %q already has the maximum of %d methods", s.name, m.maxMethods)
+	}
+	s.addMethod(parts[1], &serviceMethod{
+		name:      parts[1],
+		method:    method,
+		rcvr:      v,
+		argsType:  method.Type.In(2).Elem(),
+		replyType: method.Type.In(3).Elem(),
+	})
+	return nil
+}
+
+// checkServiceCount returns an error if registering one more service would
+// exceed the maximum. The caller must hold the mutex.
+func (m *serviceMap) checkServiceCount() error {
+	if m.maxServices > 0 && len(m.services) >= m.maxServices {
+		return fmt.Errorf("rpc: maximum of %d services already registered", m.maxServices)
+	}
+	return nil
+}
+
+// registered returns the sorted names of the methods of the named service,
+// or of the default service for an empty name, and the reasons methods of
+// its receiver were skipped.
+func (m *serviceMap) registered(name string) ([]string, map[string]string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	s := m.services[name]
+	if name == "" {
+		s = m.defaultService
+	}
+	if s == nil {
+		return nil, nil
+	}
+	names := make([]string, 0, len(s.methods))
+	for method := range s.methods {
+		names = append(names, method)
+	}
+	sort.Strings(names)
+	rejected := make(map[string]string, len(s.rejected))
+	for method, reason := range s.rejected {
+		rejected[method] = reason
+	}
+	return names, rejected
+}
+
+// reject records why the method with the given name was skipped.
+func (s *service) reject(name, reason string) {
+	if s.rejected == nil {
+		s.rejected = make(map[string]string)
+	}
+	s.rejected[name] = reason
+}
+
+// addMethod adds the method to the service under name, indexing it by the
+// lowercased name as well. On collisions the first method wins the index.
+func (s *service) addMethod(name string, method *serviceMethod) {
+	s.methods[name] = method
+	if s.folded == nil {
+		s.folded = make(map[string]*serviceMethod)
+	}
+	if key := strings.ToLower(name); s.folded[key] == nil {
+		s.folded[key] = method
+	}
+}
+
+// registerAlias makes the method of the named service callable under the
+// external name as well.
+func (m *serviceMap) registerAlias(external, serviceName, methodName string) error {
+	if external == "" {
+		return fmt.Errorf("rpc: empty method alias")
+	}
+	service, err := m.service(serviceName)
+	if err != nil {
+		return err
+	}
+	method := service.methods[methodName]
+	if method == nil {
+		return fmt.Errorf("rpc: can't find method %q", serviceName+"."+methodName)
+	}
+	if _, _, err := m.get(external); err == nil {
+		return fmt.Errorf("rpc: method already defined: %q", external)
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.aliases == nil {
+		m.aliases = make(map[string]*MethodInfo)
+	}
+	m.aliases[external] = &MethodInfo{service, method}
 	return nil
 }
 
+// fold indexes the service by its lowercased name. On collisions the first
+// service wins the index. The caller holds the mutex.
+func (m *serviceMap) fold(s *service) {
+	if m.folded == nil {
+		m.folded = make(map[string]*service)
+	}
+	if key := strings.ToLower(s.name); m.folded[key] == nil {
+		m.folded[key] = s
+	}
+}
+
 // get returns a registered service given a method name.
 //
-// The method name uses a dotted notation as in "Service.Method".
+// The method name uses a dotted notation as in "Service.Method". Lookups
+// only read the indexes built at registration, so clients sending many
+// distinct names can't grow them.
 func (m *serviceMap) get(method string) (*service, *serviceMethod, error) {
 	parts := strings.Split(method, ".")
 
@@ -191,24 +438,37 @@ func (m *serviceMap) get(method string) (*service, *serviceMethod, error) {
 		return nil, nil, err
 	}
 
-	log.Printf("wants to look for method %s",method)
+	m.logf("wants to look for method %s",method)
 
 	m.mutex.Lock()
 
+	if alias, ok := m.aliases[method]; ok {
+		m.mutex.Unlock()
+		return alias.service, alias.method, nil
+	}
+
 	var service *service
+	insensitive := m.caseInsensitive
 
 	if len(parts) == 1 {
 
+		if m.defaultDisabled || m.defaultService == nil {
+			m.mutex.Unlock()
+			err := fmt.Errorf("rpc: no default service for method %q", method)
+			return nil, nil, err
+		}
+
 		service = m.defaultService
 
 	} else {
 
 		service = m.services[parts[0]]
+		if service == nil && insensitive {
+			service = m.folded[strings.ToLower(parts[0])]
+		}
 
 	}
 
-	log.Printf("wants to look for method %s.%s",service.name,method)
-
 	m.mutex.Unlock()
 
 	if service == nil {
@@ -217,16 +477,14 @@ func (m *serviceMap) get(method string) (*service, *serviceMethod, error) {
 		return nil, nil, err
 	}
 
-	var serviceMethod *serviceMethod
+	m.logf("wants to look for method %s.%s", service.name, method)
 
-	if len(parts) == 1 {
-
-		serviceMethod = service.methods[parts[0]]
-
-	} else {
-
-		serviceMethod = service.methods[parts[1]]
+	var serviceMethod *serviceMethod
 
+	name := parts[len(parts)-1]
+	serviceMethod = service.methods[name]
+	if serviceMethod == nil && insensitive {
+		serviceMethod = service.folded[strings.ToLower(name)]
 	}
 
 	if serviceMethod == nil {
@@ -237,6 +495,123 @@ func (m *serviceMap) get(method string) (*service, *serviceMethod, error) {
 	return service, serviceMethod, nil
 }
 
+// service returns the registered service with the given name, including
+// the default service.
+func (m *serviceMap) service(name string) (*service, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if s, ok := m.services[name]; ok {
+		return s, nil
+	}
+	if m.defaultService != nil && m.defaultService.name == name {
+		return m.defaultService, nil
+	}
+	return nil, fmt.Errorf("rpc: can't find service %q", name)
+}
+
+// unregister removes the service with the given name, and the default
+// service if it has that name, along with their aliases.
+func (m *serviceMap) unregister(name string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	removed := m.services[name]
+	delete(m.services, name)
+	removedDefault := m.defaultService != nil && m.defaultService.name == name
+	if removedDefault {
+		m.defaultService = nil
+	}
+	if removed == nil && !removedDefault {
+		return fmt.Errorf("rpc: can't find service %q", name)
+	}
+	for external, alias := range m.aliases {
+		if alias.service.name == name && (alias.service == removed || removedDefault) {
+			delete(m.aliases, external)
+		}
+	}
+	m.folded = nil
+	for _, s := range m.services {
+		m.fold(s)
+	}
+	return nil
+}
+
+// methodCount returns the number of registered methods.
+func (m *serviceMap) methodCount() int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	count := 0
+	for _, s := range m.services {
+		count += len(s.methods)
+	}
+	if m.defaultService != nil {
+		count += len(m.defaultService.methods)
+	}
+	return count
+}
+
+// methodSettings are the settings of a method that can be changed while
+// the server is serving.
+type methodSettings struct {
+	timeout time.Duration // method timeout, or else the service timeout
+	oneWay  bool
+	async   bool
+	safe    bool
+}
+
+// settings returns the settings of the method, read under the mutex as the
+// setters of the server change them under it.
+func (m *serviceMap) settings(serviceSpec *service, methodSpec *serviceMethod) methodSettings {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	settings := methodSettings{
+		timeout: serviceSpec.timeout,
+		oneWay:  methodSpec.oneWay,
+		async:   methodSpec.async,
+		safe:    methodSpec.safe,
+	}
+	if methodSpec.timeout > 0 {
+		settings.timeout = methodSpec.timeout
+	}
+	return settings
+}
+
+// ServiceNamer is implemented by receivers declaring the name of their
+// service, used when registering them without a name.
+type ServiceNamer interface {
+	ServiceName() string
+}
+
+// Named is a marker declaring the name of a service in its rpc tag, used
+// when registering the receiver embedding it without a name:
+//
+//	type HelloService struct {
+//		rpc.Named `rpc:"Greeter"`
+//	}
+type Named struct{}
+
+var typeOfNamed = reflect.TypeOf(Named{})
+
+// declaredName returns the service name declared by rcvr, with a
+// ServiceName method or else with the tag of an embedded Named field.
+func declaredName(rcvr interface{}) string {
+	if namer, ok := rcvr.(ServiceNamer); ok {
+		return namer.ServiceName()
+	}
+	t := reflect.TypeOf(rcvr)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return ""
+	}
+	for i := 0; i < t.NumField(); i++ {
+		if f := t.Field(i); f.Anonymous && f.Type == typeOfNamed {
+			return f.Tag.Get("rpc")
+		}
+	}
+	return ""
+}
+
 // isExported returns true of a string is an exported (upper case) name.
 func isExported(name string) bool {
 	inString, _ := utf8.DecodeRuneInString(name)
@@ -0,0 +1,59 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// UnknownMethodLabel is the method reported to the metrics observer for
+// calls that don't resolve to a registered method.
+const UnknownMethodLabel = "unknown"
+
+// SetMetricsObserver registers f to be called after every dispatched call
+// with the method, the wall-clock time spent serving it and the error of
+// the method or of the dispatch, if any. It's called for faults as well,
+// with UnknownMethodLabel as the method when it couldn't be resolved, so
+// it can feed per-method latency and error counts to a metrics library.
+//
+// Note: Only one function can be registered, subsequent calls to this
+// method will overwrite all the previous functions.
+func (s *Server) SetMetricsObserver(f func(method string, duration time.Duration, err error)) {
+	s.metricsObserver = f
+}
+
+// withStart stores the time serving r started in its context, for the
+// metrics observer.
+func (s *Server) withStart(r *http.Request, start time.Time) *http.Request {
+	if s.metricsObserver == nil {
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), startKey, start))
+}
+
+// after reports a served call to the After Function and the metrics
+// observer.
+func (s *Server) after(info *RequestInfo) {
+	if s.afterFunc != nil {
+		s.afterFunc(info)
+	}
+	if s.metricsObserver == nil {
+		return
+	}
+	duration := info.Duration
+	if duration == 0 && info.Request != nil {
+		if start, ok := info.Request.Context().Value(startKey).(time.Time); ok {
+			duration = time.Since(start)
+		}
+	}
+	method := info.Method
+	if fault, ok := info.Error.(Fault); method == "" || ok && fault.Code == FaultCodeMethodNotFound {
+		method = UnknownMethodLabel
+	}
+	s.metricsObserver(method, duration, info.Error)
+}
@@ -0,0 +1,174 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"sync"
+)
+
+// multicallName is the name of the built-in method batching calls.
+const multicallName = "system.multicall"
+
+// MulticallCodecRequest is implemented by the requests of codecs
+// supporting system.multicall, which batches several calls in a single
+// request.
+//
+// The server calls each sub-call as it would a single call, authorizing it
+// and transforming its args, and a failed sub-call doesn't abort the
+// others. Sub-calls to system.multicall itself are rejected.
+type MulticallCodecRequest interface {
+	// Calls returns the sub-calls of a system.multicall request, in order.
+	Calls() ([]CodecRequest, error)
+	// WriteMulticallResponse encodes the replies of the sub-calls, or
+	// their errors, in order. The error of a failed sub-call is not nil.
+	WriteMulticallResponse(w http.ResponseWriter, replies []interface{}, errs []error) error
+}
+
+// SetMaxMulticall caps the number of sub-calls of a system.multicall
+// request. Larger batches are rejected as a whole with an invalid request
+// fault. Zero, the default, means no cap.
+func (s *Server) SetMaxMulticall(n int) {
+	s.maxMulticall = n
+}
+
+// SetMulticallParallelism sets how many sub-calls of a system.multicall
+// request run at the same time. Results keep the order of the calls. By
+// default sub-calls run one after the other.
+func (s *Server) SetMulticallParallelism(n int) {
+	s.multicallParallelism = n
+}
+
+// checkMulticall returns a fault if a batch of n sub-calls exceeds the cap.
+func (s *Server) checkMulticall(n int) error {
+	if s.maxMulticall > 0 && n > s.maxMulticall {
+		return Fault{
+			Code:    FaultCodeInvalidRequest,
+			Message: fmt.Sprintf("Too Many Calls: %d exceeds the limit of %d", n, s.maxMulticall),
+		}
+	}
+	return nil
+}
+
+// runBatch calls call for each index below n, running at most parallelism
+// calls at the same time, and returns once all are done.
+func runBatch(n, parallelism int, call func(i int)) {
+	if parallelism <= 1 {
+		for i := 0; i < n; i++ {
+			call(i)
+		}
+		return
+	}
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, parallelism)
+	for i := 0; i < n; i++ {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			call(i)
+		}(i)
+	}
+	wg.Wait()
+}
+
+// serveMulticall calls the sub-calls of a system.multicall request and
+// writes their replies. A failed sub-call doesn't abort the others.
+func (s *Server) serveMulticall(w http.ResponseWriter, r *http.Request, codecReq CodecRequest, batch MulticallCodecRequest) {
+	calls, err := batch.Calls()
+	if err != nil {
+		s.writeFault(w, r, codecReq, http.StatusOK, Fault{Code: FaultCodeInvalidRequest, Message: err.Error()})
+		return
+	}
+	if err := s.checkMulticall(len(calls)); err != nil {
+		s.writeFault(w, r, codecReq, http.StatusOK, err.(Fault))
+		return
+	}
+	replies := make([]interface{}, len(calls))
+	errs := make([]error, len(calls))
+	runBatch(len(calls), s.multicallParallelism, func(i int) {
+		replies[i], errs[i] = s.subCall(r, calls[i])
+	})
+
+	w.Header().Set("x-content-type-options", "nosniff")
+	buf := &responseBuffer{w: w, limit: s.maxResponse}
+	var errResult error
+	errWrite := batch.WriteMulticallResponse(buf, replies, errs)
+	if buf.exceeded {
+		// Replace the oversized response with a fault, as for single calls.
+		errResult = Fault{Code: FaultCodeApplication, Message: "Response Too Large"}
+		buf = &responseBuffer{w: w}
+		errWrite = codecReq.WriteResponse(buf, nil, errResult)
+	}
+	if errWrite != nil {
+		s.writeError(w, 400, errWrite.Error())
+		return
+	}
+	if errResult != nil {
+		markFailed(w)
+	}
+	buf.flush()
+	s.after(&RequestInfo{
+		Request:    r,
+		Method:     multicallName,
+		Error:      errResult,
+		StatusCode: buf.statusCode(),
+	})
+}
+
+// subCall calls a sub-call of a system.multicall request, returning the
+// pointer to its reply.
+func (s *Server) subCall(r *http.Request, call CodecRequest) (interface{}, error) {
+	method, err := call.Method()
+	if err != nil {
+		return nil, Fault{Code: FaultCodeInvalidRequest, Message: err.Error()}
+	}
+	if method == multicallName {
+		return nil, Fault{Code: FaultCodeInvalidRequest, Message: "Recursive system.multicall"}
+	}
+	if builtin, ok := s.builtin(method); ok {
+		if errAuth := s.authorize(r, method); errAuth != nil {
+			return nil, Fault{Code: FaultCodeUnauthorized, Message: errAuth.Error()}
+		}
+		var args interface{}
+		if builtin.args != nil {
+			args = builtin.args()
+			if errRead := call.ReadRequest(args); errRead != nil {
+				return nil, Fault{Code: FaultCodeInvalidParams, Message: errRead.Error()}
+			}
+		}
+		return builtin.call(args)
+	}
+	serviceSpec, methodSpec, errGet := s.resolve(method)
+	if errGet != nil {
+		return nil, Fault{Code: FaultCodeMethodNotFound, Message: errGet.Error()}
+	}
+	if errAuth := s.authorize(r, (&MethodInfo{serviceSpec, methodSpec}).Name()); errAuth != nil {
+		return nil, Fault{Code: FaultCodeUnauthorized, Message: errAuth.Error()}
+	}
+	args := reflect.New(methodSpec.argsType)
+	if errRead := call.ReadRequest(args.Interface()); errRead != nil {
+		return nil, Fault{Code: FaultCodeInvalidParams, Message: errRead.Error()}
+	}
+	if s.transformArgs != nil {
+		if errTransform := s.transformArgs(method, args.Interface()); errTransform != nil {
+			return nil, Fault{Code: FaultCodeInvalidParams, Message: errTransform.Error()}
+		}
+	}
+	if errValidate := validateArgs(args.Interface()); errValidate != nil {
+		return nil, errValidate
+	}
+	reply := reflect.New(methodSpec.replyType)
+	if err := s.call(serviceSpec, methodSpec, r, args, reply); err != nil {
+		return nil, err
+	}
+	return reply.Interface(), nil
+}
@@ -0,0 +1,74 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+)
+
+// errResponseTooLarge is returned by responseBuffer writes exceeding the
+// limit of the buffer.
+var errResponseTooLarge = errors.New("rpc: response too large")
+
+// responseBuffer is an http.ResponseWriter holding the encoded response
+// until the server flushes it to the underlying ResponseWriter.
+//
+// Headers are set directly on the underlying ResponseWriter. Once the body
+// would grow beyond limit, if positive, writes fail and the buffer is
+// marked as exceeded.
+type responseBuffer struct {
+	w        http.ResponseWriter
+	status   int
+	body     bytes.Buffer
+	limit    int
+	exceeded bool
+}
+
+func (b *responseBuffer) Header() http.Header {
+	return b.w.Header()
+}
+
+func (b *responseBuffer) Write(p []byte) (int, error) {
+	if b.status == 0 {
+		b.status = http.StatusOK
+	}
+	if b.limit > 0 && b.body.Len()+len(p) > b.limit {
+		b.exceeded = true
+		return 0, errResponseTooLarge
+	}
+	return b.body.Write(p)
+}
+
+func (b *responseBuffer) WriteHeader(status int) {
+	if b.status == 0 {
+		b.status = status
+	}
+}
+
+// statusCode returns the status of the buffered response.
+func (b *responseBuffer) statusCode() int {
+	if b.status == 0 {
+		return http.StatusOK
+	}
+	return b.status
+}
+
+// flush writes the buffered response to the underlying ResponseWriter,
+// then flushes it to the client if the ResponseWriter is an http.Flusher.
+// Otherwise the response is left to the ResponseWriter to send, as with
+// custom writers buffering the whole response.
+func (b *responseBuffer) flush() error {
+	if b.status != 0 {
+		b.w.WriteHeader(b.status)
+	}
+	_, err := b.w.Write(b.body.Bytes())
+	if f, ok := b.w.(http.Flusher); ok && err == nil {
+		f.Flush()
+	}
+	return err
+}
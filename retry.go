@@ -0,0 +1,58 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// retryStatus maps the codes of the faults asking clients to retry later to
+// the HTTP status they are sent with.
+var retryStatus = map[int]int{
+	FaultCodeBusy:        http.StatusServiceUnavailable,
+	FaultCodeNotReady:    http.StatusServiceUnavailable,
+	FaultCodeRateLimited: http.StatusTooManyRequests,
+}
+
+// SetRetryAfter registers the specified function as the function that
+// computes the Retry-After hint sent with busy, not ready and rate limited
+// faults, from the fault and the number of requests in flight. Durations
+// are rounded up to whole seconds. By default the hint is one second.
+//
+// Service methods and functions rejecting calls can return a Fault with
+// FaultCodeRateLimited, which is sent with a 429 Too Many Requests status
+// and the hint.
+//
+// Note: Only one function can be registered, subsequent calls to this
+// method will overwrite all the previous functions.
+func (s *Server) SetRetryAfter(f func(fault Fault, inFlight int) time.Duration) {
+	s.retryAfter = f
+}
+
+// setRetryAfter sets the status and the Retry-After header for faults
+// asking clients to retry later, including faults wrapped by other errors,
+// returning false for other errors.
+func (s *Server) setRetryAfter(b *responseBuffer, err error) bool {
+	var fault Fault
+	if !errors.As(err, &fault) || retryStatus[fault.Code] == 0 {
+		return false
+	}
+	b.WriteHeader(retryStatus[fault.Code])
+	d := time.Second
+	if s.retryAfter != nil {
+		d = s.retryAfter(fault, int(atomic.LoadInt32(&s.active)))
+	}
+	seconds := int((d + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	b.Header().Set("Retry-After", strconv.Itoa(seconds))
+	return true
+}
@@ -0,0 +1,70 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Router resolves the method name of a request to the method to call.
+//
+// The registered services are the default router. Custom routers can
+// resolve methods from other sources, e.g. backends discovered at runtime,
+// using methods created with NewMethodInfo.
+type Router interface {
+	// Resolve returns the method for the method name, as in
+	// "Service.Method", and false if there's none.
+	Resolve(method string) (*MethodInfo, bool)
+}
+
+// NewMethodInfo resolves a method of receiver, to be returned by a Router.
+//
+// The method uses a dotted notation as in "Service.Method" and must
+// follow the same rules as the methods of services registered with
+// RegisterService.
+func NewMethodInfo(receiver interface{}, method string) (*MethodInfo, error) {
+	parts := strings.Split(method, ".")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("rpc: service/method name ill-formed: %q", method)
+	}
+	m := new(serviceMap)
+	if err := m.register(receiver, parts[0], true, false); err != nil {
+		return nil, err
+	}
+	serviceSpec, methodSpec, err := m.get(method)
+	if err != nil {
+		return nil, err
+	}
+	return &MethodInfo{serviceSpec, methodSpec}, nil
+}
+
+// Resolve implements Router for the registered services.
+func (m *serviceMap) Resolve(method string) (*MethodInfo, bool) {
+	serviceSpec, methodSpec, err := m.get(method)
+	if err != nil {
+		return nil, false
+	}
+	return &MethodInfo{serviceSpec, methodSpec}, true
+}
+
+// SetRouter sets the router used to dispatch requests, replacing the
+// registered services. A nil router restores the registered services.
+func (s *Server) SetRouter(router Router) {
+	s.router = router
+}
+
+// resolve returns the method to call for the method name.
+func (s *Server) resolve(method string) (*service, *serviceMethod, error) {
+	if s.router == nil {
+		return s.services.get(method)
+	}
+	info, ok := s.router.Resolve(method)
+	if !ok || info == nil {
+		return nil, nil, fmt.Errorf("rpc: can't find method %q", method)
+	}
+	return info.service, info.method, nil
+}
@@ -6,10 +6,17 @@
 package rpc
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"mime"
 	"net/http"
+	"net/url"
 	"reflect"
+	"runtime/debug"
 	"strings"
+	"sync/atomic"
+	"time"
 )
 
 // ----------------------------------------------------------------------------
@@ -33,6 +40,36 @@ type CodecRequest interface {
 	WriteResponse(http.ResponseWriter, interface{}, error) error
 }
 
+// FaultWriter is implemented by codecs able to encode a fault without a
+// request, for the requests the server rejects before reading their body,
+// e.g. when busy. Faults for other codecs are written as text.
+type FaultWriter interface {
+	WriteFault(w http.ResponseWriter, fault Fault) error
+}
+
+// unreadRequest is the CodecRequest of a request rejected before its body
+// is read, writing faults with the FaultWriter of its codec.
+type unreadRequest struct {
+	codec Codec
+}
+
+func (c unreadRequest) Method() (string, error) {
+	return "", errors.New("rpc: request body not read")
+}
+
+func (c unreadRequest) ReadRequest(args interface{}) error {
+	return errors.New("rpc: request body not read")
+}
+
+func (c unreadRequest) WriteResponse(w http.ResponseWriter, reply interface{}, methodErr error) error {
+	writer, ok := c.codec.(FaultWriter)
+	fault, isFault := methodErr.(Fault)
+	if !ok || !isFault {
+		return errors.New("rpc: codec can't write a fault without a request")
+	}
+	return writer.WriteFault(w, fault)
+}
+
 // ----------------------------------------------------------------------------
 // Server
 // ----------------------------------------------------------------------------
@@ -41,25 +78,96 @@ type CodecRequest interface {
 func NewServer() *Server {
 	return &Server{
 		codecs:   make(map[string]Codec),
-		services: new(serviceMap),
+		services:   new(serviceMap),
+		started:    time.Now(),
+		maxRequest: DefaultMaxRequestBytes,
 	}
 }
 
 // RequestInfo contains all the information we pass to before/after functions
 type RequestInfo struct {
 	Method     string
+	MethodInfo *MethodInfo
 	Error      error
 	Request    *http.Request
 	StatusCode int
+	// DedupHit is true when the response was replayed for a repeated
+	// idempotency key, without calling the method.
+	DedupHit bool
+	// JobID is the job ID of an async call, only set when reporting the
+	// delivery of its result.
+	JobID string
+	// Duration is the time spent serving the request, split into decoding
+	// the args, calling the method and encoding the response. Only set for
+	// the Response and After Functions.
+	Duration        time.Duration
+	DecodeDuration  time.Duration
+	HandlerDuration time.Duration
+	EncodeDuration  time.Duration
+	// RequestBytes and ResponseBytes are the sizes of the request body read
+	// by the codec and of the encoded response, uncompressed. Only set for
+	// the Response and After Functions.
+	RequestBytes  int64
+	ResponseBytes int64
+	// Annotations are the values the method recorded with Annotate. Only
+	// set for the Response and After Functions.
+	Annotations map[string]interface{}
 }
 
 // Server serves registered RPC services using registered codecs.
 type Server struct {
 	codecs        map[string]Codec
 	services      *serviceMap
+	router        Router
 	interceptFunc func(i *RequestInfo) *http.Request
 	beforeFunc    func(i *RequestInfo)
 	afterFunc     func(i *RequestInfo)
+	responseFunc  func(i *RequestInfo, body []byte)
+	debug         bool
+	timeout       time.Duration
+	wireTap       func(direction string, body []byte, r *http.Request)
+	wireTapLimit  int
+	wireTapErrors bool
+	inFlight      chan struct{}
+	notReady      int32
+	maxResponse   int
+	idempotency   *idempotencyCache
+	headerPolicy  *HeaderPolicy
+	cors          *CORSConfig
+	transformArgs func(method string, args interface{}) error
+	panicMapper   func(recovered interface{}) (code int, msg string)
+	errorMapper   func(err error) (code int, msg string)
+	started       time.Time
+	health        *HealthService
+	active        int32
+	coalesce      bool
+	coalesceScope func(r *http.Request) string
+	flights       flightGroup
+	userAgents    []string
+	retryAfter    func(fault Fault, inFlight int) time.Duration
+	authFunc      func(r *http.Request, method string) error
+	authExempt    map[string]bool
+	localeHeader  string
+	localeField   string
+
+	callbackAttempts  int
+	callbackDelay     time.Duration
+	callbackClient    *http.Client
+	callbackValidator func(u *url.URL) error
+
+	idempotencyMax   int
+	idempotencyScope func(r *http.Request) string
+
+	introspectionEnabled bool
+	explorerEnabled      bool
+	maxMulticall         int
+	multicallParallelism int
+	maxRequest           int64
+	maxRequestFor        map[string]int64
+	compression          bool
+	compressionThreshold int
+
+	metricsObserver func(method string, duration time.Duration, err error)
 }
 
 // RegisterCodec adds a new codec to the server.
@@ -73,8 +181,12 @@ func (s *Server) RegisterCodec(codec Codec, contentType string) {
 
 // RegisterService adds a new service to the server.
 //
-// The name parameter is optional: if empty it will be inferred from
-// the receiver type name.
+// The name parameter is optional: if empty the name declared by the
+// receiver, with a ServiceName method or an embedded Named field, is used,
+// or else it will be inferred from the receiver type name. Services are
+// keyed by name, so several receivers
+// of the same type, e.g. configured with different dependencies, can be
+// registered under distinct names.
 //
 // Methods from the receiver will be extracted if these rules are satisfied:
 //
@@ -82,7 +194,9 @@ func (s *Server) RegisterCodec(codec Codec, contentType string) {
 //      (defined in the package registering the service).
 //    - The method name is exported.
 //    - The method has three arguments: *http.Request, *args, *reply.
-//    - All three arguments are pointers.
+//      The first one may be a context.Context instead, receiving the
+//      context of the HTTP request, canceled when the client goes away.
+//    - The second and third arguments are pointers.
 //    - The second and third arguments are exported or local.
 //    - The method has return type error.
 //
@@ -97,6 +211,76 @@ func (s *Server) RegisterDefaultService(receiver interface{}, name string) error
 }
 
 
+// DisableDefaultService rejects calls to bare method names, without a
+// service name, even if a default service was registered, and prevents
+// registering one afterwards. This lets deployments only expose namespaced
+// methods.
+func (s *Server) DisableDefaultService() {
+	s.services.mutex.Lock()
+	defer s.services.mutex.Unlock()
+	s.services.defaultDisabled = true
+	s.services.defaultService = nil
+}
+
+// RegisterMethodAlias exposes the method of a registered service under an
+// external name, as in RegisterMethodAlias("ussd.message", "USSD",
+// "Message"), for spec-style names that can't be Go method names. The
+// alias is dispatched exactly like the method itself. It fails if the
+// method doesn't exist, or if the name is already taken.
+func (s *Server) RegisterMethodAlias(externalName, serviceName, methodName string) error {
+	return s.services.registerAlias(externalName, serviceName, methodName)
+}
+
+// UnregisterService removes the service registered with the given name, or
+// the default service if it has that name, so that plugins can be unloaded
+// at runtime. Calls to its methods then fail with a method not found
+// fault, as for any unknown method.
+func (s *Server) UnregisterService(name string) error {
+	return s.services.unregister(name)
+}
+
+// RegisteredMethods returns the sorted names of the methods registered for
+// the named service, or for the default service with an empty name.
+func (s *Server) RegisteredMethods(serviceName string) []string {
+	names, _ := s.services.registered(serviceName)
+	return names
+}
+
+// RejectedMethods returns the reasons the methods of the receiver of the
+// named service were skipped when registering it, by method name, as for
+// methods whose signature doesn't match.
+func (s *Server) RejectedMethods(serviceName string) map[string]string {
+	_, rejected := s.services.registered(serviceName)
+	return rejected
+}
+
+// SetCaseInsensitive makes method names match registered services and
+// methods regardless of case, as for clients calling "hello.say" for
+// "Hello.Say", when no name matches exactly. Exact matches always win.
+func (s *Server) SetCaseInsensitive(insensitive bool) {
+	s.services.mutex.Lock()
+	defer s.services.mutex.Unlock()
+	s.services.caseInsensitive = insensitive
+}
+
+// SetMaxServices limits the number of services that can be registered to
+// n, guarding hosts of plugins against runaway registration. Registering
+// more services returns an error. Zero, the default, means no limit.
+func (s *Server) SetMaxServices(n int) {
+	s.services.mutex.Lock()
+	defer s.services.mutex.Unlock()
+	s.services.maxServices = n
+}
+
+// SetMaxMethodsPerService limits the number of methods of each registered
+// service to n. Registering a service with more methods, or adding more
+// with RegisterTyped, returns an error. Zero, the default, means no limit.
+func (s *Server) SetMaxMethodsPerService(n int) {
+	s.services.mutex.Lock()
+	defer s.services.mutex.Unlock()
+	s.services.maxMethods = n
+}
+
 // RegisterTCPService adds a new TCP service to the server.
 // No HTTP request struct will be passed to the service methods.
 //
@@ -118,19 +302,22 @@ func (s *Server) RegisterTCPService(receiver interface{}, name string) error {
 	return s.services.register(receiver, name, false,false)
 }
 
-// HasMethod returns true if the given method is registered.
+// HasMethod returns true if the given method is registered, or is an
+// enabled built-in method.
 //
 // The method uses a dotted notation as in "Service.Method".
 func (s *Server) HasMethod(method string) bool {
-	if _, _, err := s.services.get(method); err == nil {
+	if _, _, err := s.resolve(method); err == nil {
 		return true
 	}
-	return false
+	_, ok := s.builtin(method)
+	return ok
 }
 
 // RegisterInterceptFunc registers the specified function as the function
 // that will be called before every request. The function is allowed to intercept
-// the request e.g. add values to the context.
+// the request e.g. add values to the context, or to answer it at the HTTP
+// level by returning the request wrapped with Abort.
 //
 // Note: Only one function can be registered, subsequent calls to this
 // method will overwrite all the previous functions.
@@ -156,17 +343,238 @@ func (s *Server) RegisterAfterFunc(f func(i *RequestInfo)) {
 	s.afterFunc = f
 }
 
+// RegisterResponseFunc registers the specified function as the function
+// that will be called with the encoded response of every request, right
+// before it is written. This lets proxies cache or forward the exact bytes
+// sent on the wire. The body must not be modified or retained after the
+// function returns.
+//
+// Note: Only one function can be registered, subsequent calls to this
+// method will overwrite all the previous functions.
+func (s *Server) RegisterResponseFunc(f func(i *RequestInfo, body []byte)) {
+	s.responseFunc = f
+}
+
+// SetDebug enables or disables debug mode.
+//
+// A panic in a service method is always recovered and returned to the client
+// as an internal error fault. In debug mode the fault also carries the panic
+// value and a sanitized stack trace, so it must stay off in production.
+func (s *Server) SetDebug(debug bool) {
+	s.debug = debug
+}
+
+// SetPanicMapper registers the specified function as the function that
+// chooses the fault returned for a panic in a service method, from the
+// recovered value. This lets e.g. typed business panics map to their own
+// fault codes. By default panics map to an internal error fault.
+//
+// Note: Only one function can be registered, subsequent calls to this
+// method will overwrite all the previous functions.
+func (s *Server) SetPanicMapper(f func(recovered interface{}) (code int, msg string)) {
+	s.panicMapper = f
+}
+
+// SetErrorMapper registers the specified function as the function that
+// chooses the fault returned for an error of a service method which isn't
+// a Fault, e.g. mapping a sentinel ErrSessionExpired to its own fault code.
+// A zero code falls back to the default fault of the codec.
+//
+// Note: Only one function can be registered, subsequent calls to this
+// method will overwrite all the previous functions.
+func (s *Server) SetErrorMapper(f func(err error) (code int, msg string)) {
+	s.errorMapper = f
+}
+
+// SetTimeout sets the default timeout for service method calls. Zero, the
+// default, means no timeout.
+//
+// When a call times out the client receives a timeout fault right away. The
+// context of the request passed to the method is canceled, but the method
+// itself keeps running until it returns.
+func (s *Server) SetTimeout(d time.Duration) {
+	s.timeout = d
+}
+
+// SetServiceTimeout sets the timeout for the methods of the named service,
+// overriding the server default.
+func (s *Server) SetServiceTimeout(name string, d time.Duration) error {
+	service, err := s.services.service(name)
+	if err != nil {
+		return err
+	}
+	s.services.mutex.Lock()
+	defer s.services.mutex.Unlock()
+	service.timeout = d
+	return nil
+}
+
+// SetMethodTimeout sets the timeout for a single method, overriding the
+// service and server timeouts.
+//
+// The method uses a dotted notation as in "Service.Method".
+func (s *Server) SetMethodTimeout(method string, d time.Duration) error {
+	_, methodSpec, err := s.services.get(method)
+	if err != nil {
+		return err
+	}
+	s.services.mutex.Lock()
+	defer s.services.mutex.Unlock()
+	methodSpec.timeout = d
+	return nil
+}
+
+// SetOneWay marks a method as one-way, or fire-and-forget.
+//
+// Calls to a one-way method get an empty 204 No Content response right away
+// while the method runs in the background. Its reply is discarded, and any
+// error is only reported to the After Function.
+//
+// The method uses a dotted notation as in "Service.Method".
+func (s *Server) SetOneWay(method string, oneWay bool) error {
+	_, methodSpec, err := s.services.get(method)
+	if err != nil {
+		return err
+	}
+	s.services.mutex.Lock()
+	defer s.services.mutex.Unlock()
+	methodSpec.oneWay = oneWay
+	return nil
+}
+
+// SetReady sets whether the server accepts calls. A server is ready unless
+// told otherwise, so a server registering its services asynchronously
+// should call SetReady(false) before serving and SetReady(true) once done.
+//
+// Until then clients receive a not ready fault, sent with a 503 Service
+// Unavailable status. SetReady is safe to call while serving.
+func (s *Server) SetReady(ready bool) {
+	var notReady int32
+	if !ready {
+		notReady = 1
+	}
+	atomic.StoreInt32(&s.notReady, notReady)
+}
+
+// SetArgsTransformer registers the specified function as the function
+// that will be called with the decoded args of every request, before the
+// method is called. The function may modify the args in place, e.g. to
+// upgrade args sent in an older schema version. args is a pointer to the
+// method's args struct. A non-nil error rejects the request.
+//
+// Note: Only one function can be registered, subsequent calls to this
+// method will overwrite all the previous functions.
+func (s *Server) SetArgsTransformer(f func(method string, args interface{}) error) {
+	s.transformArgs = f
+}
+
+// SetMaxResponseBytes bounds the size of encoded responses. Zero, the
+// default, means no limit.
+//
+// The limit is checked as the codec writes the response, which the XML and
+// JSON codecs only do once it's fully encoded, so an oversized response is
+// still built in memory before it's dropped. The client then receives an
+// application error fault instead, and nothing of the oversized response
+// is sent.
+func (s *Server) SetMaxResponseBytes(n int) {
+	s.maxResponse = n
+}
+
+// SetMaxInFlight caps the number of requests the server handles at once.
+// Zero, the default, means no limit.
+//
+// Requests beyond the cap are not queued: the client receives a server busy
+// fault right away, sent with a 503 Service Unavailable status.
+func (s *Server) SetMaxInFlight(n int) {
+	if n <= 0 {
+		s.inFlight = nil
+		return
+	}
+	s.inFlight = make(chan struct{}, n)
+}
+
+// SetAuthFunc registers the specified function as the function that
+// authorizes every request. It is called with the resolved method name
+// before the args are decoded, and a non-nil error is returned to the
+// client as an unauthorized fault without calling the method.
+//
+// Note: Only one function can be registered, subsequent calls to this
+// method will overwrite all the previous functions.
+func (s *Server) SetAuthFunc(f func(r *http.Request, method string) error) {
+	s.authFunc = f
+}
+
+// SetAuthExempt sets the methods that skip the auth function, such as
+// health checks, replacing any previous set.
+//
+// The methods use a dotted notation as in "Service.Method", with their
+// registered names: calls through aliases or case-folded names are matched
+// by the method they resolve to.
+func (s *Server) SetAuthExempt(methods ...string) {
+	s.authExempt = make(map[string]bool, len(methods))
+	for _, method := range methods {
+		s.authExempt[method] = true
+	}
+}
+
+// authorize runs the auth function for the method with the given
+// canonical name, as returned by MethodInfo.Name, so that aliases and
+// case-folded names are authorized as the method they resolve to.
+func (s *Server) authorize(r *http.Request, name string) error {
+	if s.authFunc == nil || s.authExempt[name] {
+		return nil
+	}
+	return s.authFunc(r, name)
+}
+
+// MethodHandler returns an http.Handler calling the given method for every
+// request, e.g. to mount "/charge" to "Billing.Charge". The method name in
+// the request body may be omitted; if present it must match, or the call
+// gets a method not found fault.
+//
+// The method uses a dotted notation as in "Service.Method".
+func (s *Server) MethodHandler(method string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.serve(w, r, method)
+	})
+}
+
 // ServeHTTP
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.serve(w, r, "")
+}
+
+// serve handles a request, calling fixedMethod if not empty and the method
+// named in the request otherwise.
+func (s *Server) serve(w http.ResponseWriter, r *http.Request, fixedMethod string) {
+	start := time.Now()
+	r = s.withStart(r, start)
+	r = withWarnings(r)
+	atomic.AddInt32(&s.active, 1)
+	defer atomic.AddInt32(&s.active, -1)
+	// Expose the connection's http.Pusher to the service methods.
+	r = withPusher(w, r)
+	w, closeGzip := s.compress(w, r)
+	defer closeGzip()
+	if s.wireTap != nil {
+		var flushTap func(r *http.Request)
+		w, flushTap = s.tap(w, r)
+		defer func() {
+			flushTap(r)
+		}()
+	}
+	if s.cors != nil && s.handleCORS(w, r) {
+		return
+	}
+	if s.explorerEnabled && r.Method == "GET" {
+		s.serveExplorer(w)
+		return
+	}
 	if r.Method != "POST" {
 		s.writeError(w, 405, "rpc: POST method required, received "+r.Method)
 		return
 	}
-	contentType := r.Header.Get("Content-Type")
-	idx := strings.Index(contentType, ";")
-	if idx != -1 {
-		contentType = contentType[:idx]
-	}
+	contentType := mediaType(r.Header.Get("Content-Type"))
 	var codec Codec
 	if contentType == "" && len(s.codecs) == 1 {
 		// If Content-Type is not set and only one codec has been registered,
@@ -174,102 +582,429 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		for _, c := range s.codecs {
 			codec = c
 		}
-	} else if codec = s.codecs[strings.ToLower(contentType)]; codec == nil {
+	} else if codec = s.codecs[contentType]; codec == nil {
 		s.writeError(w, 415, "rpc: unrecognized Content-Type: "+contentType)
 		return
 	}
+	// Reject calls before reading their body, taking the in-flight slot
+	// first, so rejected and excess requests cost no more than their
+	// headers. Faults are written with the FaultWriter of the codec.
+	unread := unreadRequest{codec}
+	// Reject calls until the services are ready.
+	if atomic.LoadInt32(&s.notReady) != 0 {
+		s.writeFault(w, r, unread, http.StatusServiceUnavailable, Fault{Code: FaultCodeNotReady, Message: "Server Not Ready"})
+		return
+	}
+	// Reject unknown clients.
+	if !s.allowedUserAgent(r.UserAgent()) {
+		s.writeFault(w, r, unread, http.StatusForbidden, Fault{Code: FaultCodeUnauthorized, Message: "Client Not Allowed"})
+		return
+	}
+	// Enforce the header policy.
+	if s.headerPolicy != nil {
+		if errHeader := s.headerPolicy.check(r.Header); errHeader != nil {
+			s.writeFault(w, r, unread, http.StatusRequestHeaderFieldsTooLarge, Fault{Code: FaultCodeInvalidRequest, Message: errHeader.Error()})
+			return
+		}
+	}
+	// Enforce the in-flight cap.
+	if inFlight := s.inFlight; inFlight != nil {
+		select {
+		case inFlight <- struct{}{}:
+			defer func() { <-inFlight }()
+		default:
+			s.writeFault(w, r, unread, http.StatusServiceUnavailable, Fault{Code: FaultCodeBusy, Message: "Server Busy"})
+			return
+		}
+	}
+	// Count the bytes of the body, capping its size.
+	reqBody := &countingBody{ReadCloser: r.Body}
+	if r.Body != nil {
+		r.Body = reqBody
+	}
+	var body *limitedBody
+	if n := s.maxRequestBytes(contentType); n > 0 && r.Body != nil {
+		if r.ContentLength > n {
+			s.rejectTooLarge(w)
+			return
+		}
+		body = &limitedBody{ReadCloser: r.Body, remaining: n}
+		r.Body = body
+	}
 	// Create a new codec request.
 	codecReq := codec.NewRequest(r)
+	if body != nil && body.exceeded {
+		s.rejectTooLarge(w)
+		return
+	}
 	// Get service method to be called.
 	method, errMethod := codecReq.Method()
 	if errMethod != nil {
-		s.writeError(w, 400, errMethod.Error())
+		s.writeFault(w, r, codecReq, http.StatusOK, Fault{Code: FaultCodeParseError, Message: errMethod.Error()})
 		return
 	}
-	serviceSpec, methodSpec, errGet := s.services.get(method)
+	if fixedMethod != "" {
+		if method != "" && method != fixedMethod {
+			s.writeMethodFault(w, r, codecReq, method, http.StatusOK, Fault{Code: FaultCodeMethodNotFound, Message: fmt.Sprintf("rpc: method %q doesn't match %q", method, fixedMethod)})
+			return
+		}
+		method = fixedMethod
+	}
+	if batch, ok := codecReq.(MulticallCodecRequest); ok && method == multicallName {
+		s.serveMulticall(w, r, codecReq, batch)
+		return
+	}
+	if builtin, ok := s.builtin(method); ok {
+		s.serveBuiltin(w, r, codecReq, method, builtin)
+		return
+	}
+	// Unknown methods get a fault, as spec-compliant clients expect. The
+	// Before and After Functions still see the call, without MethodInfo.
+	serviceSpec, methodSpec, errGet := s.resolve(method)
 	if errGet != nil {
-		s.writeError(w, 400, errGet.Error())
+		if s.beforeFunc != nil {
+			s.beforeFunc(&RequestInfo{
+				Request: r,
+				Method:  method,
+			})
+		}
+		s.writeMethodFault(w, r, codecReq, method, http.StatusOK, Fault{Code: FaultCodeMethodNotFound, Message: errGet.Error()})
+		return
+	}
+	// Authorize the call by the name of the resolved method.
+	if errAuth := s.authorize(r, (&MethodInfo{serviceSpec, methodSpec}).Name()); errAuth != nil {
+		s.writeMethodFault(w, r, codecReq, method, http.StatusOK, Fault{Code: FaultCodeUnauthorized, Message: errAuth.Error()})
 		return
 	}
+	// Replay the response of a repeated call.
+	var idempotencyKey string
+	if s.idempotency != nil {
+		if key := r.Header.Get(IdempotencyKeyHeader); key != "" {
+			idempotencyKey = s.idempotencyKey(r, method, key)
+		}
+	}
+	if idempotencyKey != "" {
+		if res, ok := s.idempotency.get(idempotencyKey); ok {
+			res.replay(w)
+			s.after(&RequestInfo{
+				Request:    r,
+				Method:     method,
+				MethodInfo: &MethodInfo{serviceSpec, methodSpec},
+				StatusCode: res.status,
+				DedupHit:   true,
+			})
+			return
+		}
+	}
 	// Decode the args.
+	decodeStart := time.Now()
 	args := reflect.New(methodSpec.argsType)
 	if errRead := codecReq.ReadRequest(args.Interface()); errRead != nil {
-		s.writeError(w, 400, errRead.Error())
+		if body != nil && body.exceeded {
+			s.rejectTooLarge(w)
+			return
+		}
+		// The method isn't called with args that failed to decode.
+		s.writeMethodFault(w, r, codecReq, method, http.StatusOK, Fault{Code: FaultCodeInvalidParams, Message: errRead.Error()})
+		return
+	}
+	if s.transformArgs != nil {
+		if errTransform := s.transformArgs(method, args.Interface()); errTransform != nil {
+			s.writeMethodFault(w, r, codecReq, method, http.StatusOK, Fault{Code: FaultCodeInvalidParams, Message: errTransform.Error()})
+			return
+		}
+	}
+	if errValidate := validateArgs(args.Interface()); errValidate != nil {
+		s.writeMethodFault(w, r, codecReq, method, http.StatusOK, errValidate.(Fault))
 		return
 	}
+	if s.localeHeader != "" || s.localeField != "" {
+		r = s.withLocale(r, args)
+	}
+	decodeDuration := time.Since(decodeStart)
+
+	methodInfo := &MethodInfo{serviceSpec, methodSpec}
+	r, notes := withAnnotations(r)
 
 	// Call the registered Intercept Function
 	if s.interceptFunc != nil {
 		req := s.interceptFunc(&RequestInfo{
-			Request: r,
-			Method:  method,
+			Request:    r,
+			Method:     method,
+			MethodInfo: methodInfo,
 		})
 		if req != nil {
 			r = req
 		}
+		if s.writeAbort(w, r, &RequestInfo{Method: method, MethodInfo: methodInfo}) {
+			return
+		}
 	}
 	// Call the registered Before Function
 	if s.beforeFunc != nil {
 		s.beforeFunc(&RequestInfo{
-			Request: r,
-			Method:  method,
+			Request:    r,
+			Method:     method,
+			MethodInfo: methodInfo,
 		})
 	}
 
-	// Call the service method.
+	// Call the service method. The reply is allocated apart from the args,
+	// so methods whose args and reply share a type can't alias them.
 	reply := reflect.New(methodSpec.replyType)
+	settings := s.services.settings(serviceSpec, methodSpec)
+	if settings.oneWay {
+		s.callOneWay(serviceSpec, methodSpec, r, method, args, reply)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if settings.async {
+		if callbackURL := r.Header.Get(CallbackURLHeader); callbackURL != "" {
+			if errCallback := s.checkCallback(callbackURL); errCallback != nil {
+				s.writeMethodFault(w, r, codecReq, method, http.StatusOK, Fault{Code: FaultCodeInvalidRequest, Message: errCallback.Error()})
+				return
+			}
+			s.callAsync(w, r, codecReq, serviceSpec, methodSpec, method, callbackURL, args, reply)
+			return
+		}
+	}
+	var errResult error
+	handlerStart := time.Now()
+	if s.coalesce && settings.safe {
+		errResult = s.callShared(serviceSpec, methodSpec, r, codecReq, method, args, reply)
+	} else {
+		errResult = s.call(serviceSpec, methodSpec, r, args, reply)
+	}
+	handlerDuration := time.Since(handlerStart)
+
+	// Prevents Internet Explorer from MIME-sniffing a response away
+	// from the declared content-type
+	w.Header().Set("x-content-type-options", "nosniff")
+	// Encode the response.
+	encodeStart := time.Now()
+	buf := &responseBuffer{w: w, limit: s.maxResponse}
+	s.setRetryAfter(buf, errResult)
+	errWrite := codecReq.WriteResponse(buf, reply.Interface(), errResult)
+	if buf.exceeded {
+		// Replace the oversized response with a fault.
+		errResult = Fault{Code: FaultCodeApplication, Message: "Response Too Large"}
+		buf = &responseBuffer{w: w}
+		errWrite = codecReq.WriteResponse(buf, nil, errResult)
+	}
+	encodeDuration := time.Since(encodeStart)
+	duration := time.Since(start)
+	if errResult != nil {
+		markFailed(w)
+	}
+	if errWrite != nil {
+		s.writeError(w, 400, errWrite.Error())
+	} else {
+		// Call the registered Response Function
+		if s.responseFunc != nil {
+			s.responseFunc(&RequestInfo{
+				Request:         r,
+				Method:          method,
+				MethodInfo:      methodInfo,
+				Error:           errResult,
+				StatusCode:      buf.statusCode(),
+				Duration:        duration,
+				DecodeDuration:  decodeDuration,
+				HandlerDuration: handlerDuration,
+				EncodeDuration:  encodeDuration,
+				RequestBytes:    reqBody.n,
+				ResponseBytes:   int64(buf.body.Len()),
+				Annotations:     notes.snapshot(),
+			}, buf.body.Bytes())
+		}
+		// Calls failing to decode never get here, so only responses of
+		// calls that decoded and succeeded are kept.
+		if idempotencyKey != "" && errResult == nil {
+			s.idempotency.put(idempotencyKey, buf)
+		}
+		buf.flush()
+		// Call the registered After Function
+		s.after(&RequestInfo{
+			Request:         r,
+			Method:          method,
+			MethodInfo:      methodInfo,
+			Error:           errResult,
+			StatusCode:      buf.statusCode(),
+			Duration:        duration,
+			DecodeDuration:  decodeDuration,
+			HandlerDuration: handlerDuration,
+			EncodeDuration:  encodeDuration,
+			RequestBytes:    reqBody.n,
+			ResponseBytes:   int64(buf.body.Len()),
+			Annotations:     notes.snapshot(),
+		})
+	}
+}
+
+// callOneWay invokes a one-way service method in the background. The
+// outcome is only reported to the After Function.
+func (s *Server) callOneWay(serviceSpec *service, methodSpec *serviceMethod, r *http.Request, method string, args, reply reflect.Value) {
+	// The method outlives the HTTP request, so it gets a context that
+	// isn't canceled when the response is written.
+	r = r.WithContext(detachedContext{r.Context()})
+	go func() {
+		errResult := s.call(serviceSpec, methodSpec, r, args, reply)
+		s.after(&RequestInfo{
+			Request:    r,
+			Method:     method,
+			MethodInfo: &MethodInfo{serviceSpec, methodSpec},
+			Error:      errResult,
+			StatusCode: http.StatusNoContent,
+		})
+	}()
+}
 
-	// omit the HTTP request if the service method doesn't accept it
+// call invokes the service method within the timeout that applies to it.
+func (s *Server) call(serviceSpec *service, methodSpec *serviceMethod, r *http.Request, args, reply reflect.Value) error {
+	timeout := s.timeout
+	if t := s.services.settings(serviceSpec, methodSpec).timeout; t > 0 {
+		timeout = t
+	}
+	if timeout <= 0 {
+		return s.invoke(serviceSpec, methodSpec, r, args, reply)
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- s.invoke(serviceSpec, methodSpec, r.WithContext(ctx), args, reply)
+	}()
+	select {
+	case errResult := <-done:
+		return errResult
+	case <-ctx.Done():
+		return Fault{Code: FaultCodeTimeout, Message: "Method Timeout"}
+	}
+}
+
+// invoke calls the service method, recovering a panic as an internal
+// error fault.
+func (s *Server) invoke(serviceSpec *service, methodSpec *serviceMethod, r *http.Request, args, reply reflect.Value) (errResult error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			fault := Fault{Code: FaultCodeInternalError, Message: "Internal Server Error"}
+			if s.panicMapper != nil {
+				fault.Code, fault.Message = s.panicMapper(recovered)
+			}
+			if s.debug {
+				fault.Detail = map[string]interface{}{
+					"panic": fmt.Sprint(recovered),
+					"stack": sanitizeStack(debug.Stack()),
+				}
+			}
+			errResult = fault
+		}
+	}()
+
+	rcvr := serviceSpec.rcvr
+	if methodSpec.rcvr.IsValid() {
+		rcvr = methodSpec.rcvr
+	}
+	// omit the HTTP request if the service method doesn't accept it, and
+	// pass its context to methods taking one instead
 	var errValue []reflect.Value
 	if serviceSpec.passReq {
+		req := reflect.ValueOf(r)
+		if methodSpec.passCtx {
+			req = reflect.ValueOf(r.Context())
+		}
 		errValue = methodSpec.method.Func.Call([]reflect.Value{
-			serviceSpec.rcvr,
-			reflect.ValueOf(r),
+			rcvr,
+			req,
 			args,
 			reply,
 		})
 	} else {
 		errValue = methodSpec.method.Func.Call([]reflect.Value{
-			serviceSpec.rcvr,
+			rcvr,
 			args,
 			reply,
 		})
 	}
 
 	// Cast the result to error if needed.
-	var errResult error
 	errInter := errValue[0].Interface()
 	if errInter != nil {
-		errResult = errInter.(error)
+		errResult = s.mapError(errInter.(error))
 	}
+	return errResult
+}
 
-	// Prevents Internet Explorer from MIME-sniffing a response away
-	// from the declared content-type
-	w.Header().Set("x-content-type-options", "nosniff")
-	// Encode the response.
-	if errWrite := codecReq.WriteResponse(w, reply.Interface(), errResult); errWrite != nil {
-		s.writeError(w, 400, errWrite.Error())
-	} else {
-		// Call the registered After Function
-		if s.afterFunc != nil {
-			s.afterFunc(&RequestInfo{
-				Request:    r,
-				Method:     method,
-				Error:      errResult,
-				StatusCode: 200,
-			})
+// mapError translates an error returned by a service method into a fault
+// with the Error Mapper, unless it's a fault already or the mapper returns
+// a zero code.
+func (s *Server) mapError(err error) error {
+	if s.errorMapper == nil {
+		return err
+	}
+	var fault Fault
+	if errors.As(err, &fault) {
+		return err
+	}
+	if code, msg := s.errorMapper(err); code != 0 {
+		return Fault{Code: code, Message: msg}
+	}
+	return err
+}
+
+// writeFault encodes a fault raised by the server itself with the codec,
+// sending it with the given HTTP status.
+func (s *Server) writeFault(w http.ResponseWriter, r *http.Request, codecReq CodecRequest, status int, fault Fault) {
+	s.writeMethodFault(w, r, codecReq, "", status, fault)
+}
+
+// writeMethodFault is writeFault for faults raised once the method name is
+// known, reported to the After Function.
+func (s *Server) writeMethodFault(w http.ResponseWriter, r *http.Request, codecReq CodecRequest, method string, status int, fault Fault) {
+	markFailed(w)
+	buf := &responseBuffer{w: w}
+	if !s.setRetryAfter(buf, fault) {
+		buf.WriteHeader(status)
+	}
+	if errWrite := codecReq.WriteResponse(buf, nil, fault); errWrite != nil {
+		// Codecs that can't encode a fault for a request they failed to
+		// decode get it as text, with a client error status.
+		if status < http.StatusBadRequest {
+			status = http.StatusBadRequest
 		}
+		s.writeError(w, status, fault.Message)
+		return
 	}
+	buf.flush()
+	s.after(&RequestInfo{
+		Request:    r,
+		Method:     method,
+		Error:      fault,
+		StatusCode: status,
+	})
+}
+
+// mediaType returns the lowercased media type of a Content-Type header,
+// without parameters such as the charset.
+func mediaType(header string) string {
+	mediatype, _, err := mime.ParseMediaType(header)
+	if err != nil && err != mime.ErrInvalidMediaParameter {
+		// Not a valid media type, only strip the parameters.
+		if idx := strings.Index(header, ";"); idx != -1 {
+			header = header[:idx]
+		}
+		return strings.ToLower(strings.TrimSpace(header))
+	}
+	return mediatype
 }
 
 func (s *Server) writeError(w http.ResponseWriter, status int, msg string) {
+	markFailed(w)
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	w.WriteHeader(status)
 	fmt.Fprint(w, msg)
-	if s.afterFunc != nil {
-		s.afterFunc(&RequestInfo{
-			Error:      fmt.Errorf(msg),
-			StatusCode: status,
-		})
-	}
+	s.after(&RequestInfo{
+		Error:      fmt.Errorf(msg),
+		StatusCode: status,
+	})
 }
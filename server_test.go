@@ -6,9 +6,25 @@
 package rpc
 
 import (
+	"bytes"
+	"compress/gzip"
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 type Service1Request struct {
@@ -33,6 +49,10 @@ func (t *Service1) Add(req *Service1Request, res *Service1Response) error {
 	return nil
 }
 
+func (t *Service1) Panic(r *http.Request, req *Service1Request, res *Service1Response) error {
+	panic("something went wrong")
+}
+
 type Service2 struct {
 }
 
@@ -105,6 +125,10 @@ func (r MockCodecRequest) ReadRequest(args interface{}) error {
 	return nil
 }
 
+func (r MockCodecRequest) Params() []byte {
+	return []byte(fmt.Sprintf("%d,%d", r.A, r.B))
+}
+
 func (r MockCodecRequest) WriteResponse(w http.ResponseWriter, reply interface{}, methodErr error) error {
 	if methodErr != nil {
 		w.Write([]byte(methodErr.Error()))
@@ -115,6 +139,53 @@ func (r MockCodecRequest) WriteResponse(w http.ResponseWriter, reply interface{}
 	return nil
 }
 
+// MockMethodCodec decodes to the given method and records the error
+// passed to WriteResponse. Args, if set, is copied into the args.
+type MockMethodCodec struct {
+	Method  string
+	A, B    int
+	Args    interface{}
+	ReadErr error
+	Err     error
+}
+
+func (c *MockMethodCodec) NewRequest(r *http.Request) CodecRequest {
+	if r.Body != nil {
+		ioutil.ReadAll(r.Body)
+	}
+	return &MockMethodCodecRequest{c}
+}
+
+func (c *MockMethodCodec) WriteFault(w http.ResponseWriter, fault Fault) error {
+	c.Err = fault
+	return MockCodecRequest{}.WriteResponse(w, nil, fault)
+}
+
+type MockMethodCodecRequest struct {
+	codec *MockMethodCodec
+}
+
+func (r *MockMethodCodecRequest) Method() (string, error) {
+	return r.codec.Method, nil
+}
+
+func (r *MockMethodCodecRequest) ReadRequest(args interface{}) error {
+	if r.codec.ReadErr != nil {
+		return r.codec.ReadErr
+	}
+	if r.codec.Args != nil {
+		reflect.ValueOf(args).Elem().Set(reflect.ValueOf(r.codec.Args).Elem())
+	} else if req, ok := args.(*Service1Request); ok {
+		req.A, req.B = r.codec.A, r.codec.B
+	}
+	return nil
+}
+
+func (r *MockMethodCodecRequest) WriteResponse(w http.ResponseWriter, reply interface{}, methodErr error) error {
+	r.codec.Err = methodErr
+	return MockCodecRequest{}.WriteResponse(w, reply, methodErr)
+}
+
 type MockResponseWriter struct {
 	header http.Header
 	Status int
@@ -228,3 +299,2482 @@ func TestInterception(t *testing.T) {
 		t.Errorf("Response body was %s, should be %s.", w.Body, strconv.Itoa(expected))
 	}
 }
+
+func TestPanicDebug(t *testing.T) {
+	s := NewServer()
+	s.RegisterService(new(Service1), "")
+	codec := &MockMethodCodec{Method: "Service1.Panic"}
+	s.RegisterCodec(codec, "mock")
+
+	for _, debug := range []bool{false, true} {
+		s.SetDebug(debug)
+		r, err := http.NewRequest("POST", "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("Content-Type", "mock")
+		s.ServeHTTP(NewMockResponseWriter(), r)
+
+		fault, ok := codec.Err.(Fault)
+		if !ok {
+			t.Fatalf("Expected a Fault, got %v", codec.Err)
+		}
+		if fault.Code != FaultCodeInternalError {
+			t.Errorf("Fault code was %d, should be %d.", fault.Code, FaultCodeInternalError)
+		}
+		stack, ok := fault.Detail["stack"].(string)
+		if debug != ok {
+			t.Errorf("Stack present was %v, should be %v in debug mode %v.", ok, debug, debug)
+		}
+		if debug && !strings.Contains(stack, "(*Service1).Panic") {
+			t.Errorf("Stack should mention the panicking method, got:\n%s", stack)
+		}
+		if debug && fault.Detail["panic"] != "something went wrong" {
+			t.Errorf("Panic value was %v.", fault.Detail["panic"])
+		}
+	}
+}
+
+type PushService struct {
+	pushSupported bool
+}
+
+func (t *PushService) Check(r *http.Request, req *Service1Request, res *Service1Response) error {
+	_, t.pushSupported = Pusher(r)
+	return nil
+}
+
+type MockPusherResponseWriter struct {
+	*MockResponseWriter
+}
+
+func (w MockPusherResponseWriter) Push(target string, opts *http.PushOptions) error {
+	return nil
+}
+
+func TestPusher(t *testing.T) {
+	service := new(PushService)
+	s := NewServer()
+	s.RegisterService(service, "")
+	s.RegisterCodec(&MockMethodCodec{Method: "PushService.Check"}, "mock")
+
+	// HTTP/1.1 connections don't support server push.
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	service.pushSupported = true
+	res, err := http.Post(ts.URL, "mock", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if service.pushSupported {
+		t.Errorf("Pusher should not be available over HTTP/1.1.")
+	}
+
+	r, err := http.NewRequest("POST", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Content-Type", "mock")
+	s.ServeHTTP(MockPusherResponseWriter{NewMockResponseWriter()}, r)
+	if !service.pushSupported {
+		t.Errorf("Pusher should be available when the ResponseWriter supports it.")
+	}
+}
+
+func TestResponseFunc(t *testing.T) {
+	s := NewServer()
+	s.RegisterService(new(Service1), "")
+	s.RegisterCodec(MockCodec{4, 5}, "mock")
+
+	var encoded []byte
+	var info *RequestInfo
+	s.RegisterResponseFunc(func(i *RequestInfo, body []byte) {
+		info = i
+		encoded = append([]byte(nil), body...)
+	})
+
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	res, err := http.Post(ts.URL, "mock", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(encoded) != string(body) {
+		t.Errorf("Encoded response was %q, should be %q.", encoded, body)
+	}
+	if string(body) != "20" {
+		t.Errorf("Response body was %q, should be %q.", body, "20")
+	}
+	if info == nil || info.Method != "Service1.Multiply" || info.StatusCode != 200 {
+		t.Errorf("Wrong request info: %+v", info)
+	}
+}
+
+type SlowService struct {
+	delay time.Duration
+}
+
+func (t *SlowService) Sleep(r *http.Request, req *Service1Request, res *Service1Response) error {
+	select {
+	case <-time.After(t.delay):
+	case <-r.Context().Done():
+	}
+	return nil
+}
+
+func (t *SlowService) Nap(r *http.Request, req *Service1Request, res *Service1Response) error {
+	return t.Sleep(r, req, res)
+}
+
+func TestTimeouts(t *testing.T) {
+	s := NewServer()
+	s.RegisterService(&SlowService{50 * time.Millisecond}, "Strict")
+	s.RegisterService(&SlowService{50 * time.Millisecond}, "Lenient")
+	s.SetTimeout(10 * time.Millisecond)
+	if err := s.SetServiceTimeout("Lenient", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetMethodTimeout("Lenient.Nap", 10*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetServiceTimeout("Missing", time.Second); err == nil {
+		t.Error("Expected an error setting the timeout of a missing service")
+	}
+
+	tests := []struct {
+		method   string
+		timedOut bool
+	}{
+		{"Strict.Sleep", true},
+		{"Lenient.Sleep", false},
+		{"Lenient.Nap", true},
+	}
+	for _, test := range tests {
+		codec := &MockMethodCodec{Method: test.method}
+		s.RegisterCodec(codec, "mock")
+		r, err := http.NewRequest("POST", "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("Content-Type", "mock")
+		s.ServeHTTP(NewMockResponseWriter(), r)
+
+		fault, ok := codec.Err.(Fault)
+		if timedOut := ok && fault.Code == FaultCodeTimeout; timedOut != test.timedOut {
+			t.Errorf("%s: timed out was %v, should be %v (error: %v).", test.method, timedOut, test.timedOut, codec.Err)
+		}
+	}
+}
+
+func TestSettingsWhileServing(t *testing.T) {
+	s := NewServer()
+	s.RegisterService(new(Service1), "")
+	s.RegisterCodec(MockCodec{2, 3}, "mock")
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			s.SetServiceTimeout("Service1", time.Second)
+			s.SetMethodTimeout("Service1.Multiply", time.Second)
+			s.SetSafe("Service1.Multiply", i%2 == 0)
+			s.SetAsync("Service1.Multiply", i%2 == 0)
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		r, _ := http.NewRequest("POST", "", nil)
+		r.Header.Set("Content-Type", "mock")
+		w := NewMockResponseWriter()
+		s.ServeHTTP(w, r)
+		if w.Body != "6" {
+			t.Fatalf("Response body was %q, should be %q.", w.Body, "6")
+		}
+	}
+	<-done
+}
+
+func TestWireTap(t *testing.T) {
+	s := NewServer()
+	s.RegisterService(new(Service1), "")
+	s.RegisterCodec(&MockMethodCodec{Method: "Service1.Multiply", A: 6, B: 7}, "mock")
+
+	captured := map[string]string{}
+	s.SetWireTap(func(direction string, body []byte, r *http.Request) {
+		captured[direction] = string(body)
+	}, 8)
+
+	r, err := http.NewRequest("POST", "", strings.NewReader("<methodCall>...</methodCall>"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Content-Type", "mock")
+	w := NewMockResponseWriter()
+	s.ServeHTTP(w, r)
+
+	if captured[WireRequest] != "<methodC" {
+		t.Errorf("Captured request was %q, should be %q.", captured[WireRequest], "<methodC")
+	}
+	if captured[WireResponse] != "42" || w.Body != "42" {
+		t.Errorf("Captured response was %q, should be %q.", captured[WireResponse], w.Body)
+	}
+}
+
+type NotifyService struct {
+	called chan *Service1Request
+}
+
+func (t *NotifyService) Notify(r *http.Request, req *Service1Request, res *Service1Response) error {
+	t.called <- req
+	return ErrNotified
+}
+
+var ErrNotified = errors.New("notified")
+
+func TestOneWay(t *testing.T) {
+	service := &NotifyService{called: make(chan *Service1Request, 1)}
+	s := NewServer()
+	s.RegisterService(service, "")
+	s.RegisterCodec(&MockMethodCodec{Method: "NotifyService.Notify", A: 1, B: 2}, "mock")
+	if err := s.SetOneWay("NotifyService.Notify", true); err != nil {
+		t.Fatal(err)
+	}
+	after := make(chan *RequestInfo, 1)
+	s.RegisterAfterFunc(func(i *RequestInfo) {
+		after <- i
+	})
+
+	r, err := http.NewRequest("POST", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Content-Type", "mock")
+	w := NewMockResponseWriter()
+	s.ServeHTTP(w, r)
+	if w.Status != 204 || w.Body != "" {
+		t.Errorf("Response was %d %q, should be an empty 204.", w.Status, w.Body)
+	}
+
+	select {
+	case req := <-service.called:
+		if req.A != 1 || req.B != 2 {
+			t.Errorf("Wrong args: %+v", req)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("The one-way method was not executed.")
+	}
+	select {
+	case i := <-after:
+		if i.Error != ErrNotified || i.Method != "NotifyService.Notify" {
+			t.Errorf("Wrong request info: %+v", i)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("The After Function was not called.")
+	}
+}
+
+type BlockingService struct {
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (t *BlockingService) Multiply(r *http.Request, req *Service1Request, res *Service1Response) error {
+	t.entered <- struct{}{}
+	<-t.release
+	res.Result = req.A * req.B
+	return nil
+}
+
+func TestMaxInFlight(t *testing.T) {
+	const max = 2
+	service := &BlockingService{
+		entered: make(chan struct{}, max),
+		release: make(chan struct{}),
+	}
+	s := NewServer()
+	s.RegisterService(service, "Service1")
+	s.RegisterCodec(MockCodec{2, 3}, "mock")
+	busy := &MockMethodCodec{Method: "Service1.Multiply", A: 2, B: 3}
+	s.RegisterCodec(busy, "busy")
+	s.SetMaxInFlight(max)
+
+	serve := func(contentType string) *MockResponseWriter {
+		r, err := http.NewRequest("POST", "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("Content-Type", contentType)
+		w := NewMockResponseWriter()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	done := make(chan *MockResponseWriter, max)
+	for i := 0; i < max; i++ {
+		go func() {
+			done <- serve("mock")
+		}()
+	}
+	for i := 0; i < max; i++ {
+		<-service.entered
+	}
+
+	// Both slots are taken, so the next request is rejected.
+	w := serve("busy")
+	if w.Status != 503 {
+		t.Errorf("Status was %d, should be 503.", w.Status)
+	}
+	if fault, ok := busy.Err.(Fault); !ok || fault.Code != FaultCodeBusy {
+		t.Errorf("Error was %v, should be a busy fault.", busy.Err)
+	}
+
+	close(service.release)
+	for i := 0; i < max; i++ {
+		if w := <-done; w.Status != 200 || w.Body != "6" {
+			t.Errorf("Response was %d %q, should be 200 %q.", w.Status, w.Body, "6")
+		}
+	}
+
+	// The slots are released once the requests complete.
+	busy.Err = nil
+	w = serve("busy")
+	if w.Status != 200 || busy.Err != nil {
+		t.Errorf("Response was %d (error: %v), should be 200.", w.Status, busy.Err)
+	}
+}
+
+func TestInterceptMethodInfo(t *testing.T) {
+	s := NewServer()
+	s.RegisterService(new(Service1), "")
+	s.RegisterCodec(MockCodec{2, 3}, "mock")
+
+	var logged []string
+	s.RegisterInterceptFunc(func(i *RequestInfo) *http.Request {
+		m := i.MethodInfo
+		logged = append(logged, fmt.Sprintf("%s(%s) %s %v", m.Name(), m.ArgsType().Name(), m.ReplyType().Name(), m.PassRequest()))
+		return nil
+	})
+
+	r, err := http.NewRequest("POST", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Content-Type", "mock")
+	s.ServeHTTP(NewMockResponseWriter(), r)
+
+	expected := "Service1.Multiply(Service1Request) Service1Response true"
+	if len(logged) != 1 || logged[0] != expected {
+		t.Errorf("Logged %q, should be %q.", logged, expected)
+	}
+}
+
+func TestAuthExempt(t *testing.T) {
+	s := NewServer()
+	s.RegisterService(new(SlowService), "Health")
+	var authorized []string
+	s.SetAuthFunc(func(r *http.Request, method string) error {
+		authorized = append(authorized, method)
+		if r.Header.Get("Authorization") == "" {
+			return errors.New("missing credentials")
+		}
+		return nil
+	})
+	s.SetAuthExempt("Health.Nap")
+
+	tests := []struct {
+		method     string
+		authorized bool
+		rejected   bool
+	}{
+		{"Health.Nap", false, false},
+		{"Health.Sleep", true, true},
+	}
+	for _, test := range tests {
+		authorized = nil
+		codec := &MockMethodCodec{Method: test.method}
+		s.RegisterCodec(codec, "mock")
+		r, err := http.NewRequest("POST", "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("Content-Type", "mock")
+		s.ServeHTTP(NewMockResponseWriter(), r)
+
+		if ran := len(authorized) != 0; ran != test.authorized {
+			t.Errorf("%s: auth function ran was %v, should be %v.", test.method, ran, test.authorized)
+		}
+		fault, ok := codec.Err.(Fault)
+		if rejected := ok && fault.Code == FaultCodeUnauthorized; rejected != test.rejected {
+			t.Errorf("%s: rejected was %v, should be %v (error: %v).", test.method, rejected, test.rejected, codec.Err)
+		}
+	}
+}
+
+func TestAuthResolvedName(t *testing.T) {
+	s := NewServer()
+	s.RegisterService(new(Service1), "")
+	s.SetCaseInsensitive(true)
+	if err := s.RegisterMethodAlias("math.multiply", "Service1", "Multiply"); err != nil {
+		t.Fatal(err)
+	}
+	codec := &MockMethodCodec{A: 4, B: 2}
+	s.RegisterCodec(codec, "mock")
+	var authorized []string
+	s.SetAuthFunc(func(r *http.Request, method string) error {
+		authorized = append(authorized, method)
+		if method == "Service1.Multiply" {
+			return errors.New("denied")
+		}
+		return nil
+	})
+
+	for _, method := range []string{"Service1.Multiply", "service1.multiply", "math.multiply"} {
+		authorized = nil
+		codec.Method = method
+		r, _ := http.NewRequest("POST", "", nil)
+		r.Header.Set("Content-Type", "mock")
+		s.ServeHTTP(NewMockResponseWriter(), r)
+		if len(authorized) != 1 || authorized[0] != "Service1.Multiply" {
+			t.Errorf("%s: auth function got %v, should be [Service1.Multiply].", method, authorized)
+		}
+		if fault, ok := codec.Err.(Fault); !ok || fault.Code != FaultCodeUnauthorized {
+			t.Errorf("%s: expected an unauthorized fault, got %v.", method, codec.Err)
+		}
+	}
+
+	// Exemptions match the resolved name as well.
+	s.SetAuthExempt("Service1.Multiply")
+	authorized = nil
+	codec.Method = "math.multiply"
+	r, _ := http.NewRequest("POST", "", nil)
+	r.Header.Set("Content-Type", "mock")
+	s.ServeHTTP(NewMockResponseWriter(), r)
+	if len(authorized) != 0 || codec.Err != nil {
+		t.Errorf("Expected the alias of an exempt method to skip auth, got %v (%v).", authorized, codec.Err)
+	}
+}
+
+func TestAuthFunc(t *testing.T) {
+	s := NewServer()
+	s.RegisterService(new(Service1), "")
+	codec := &MockMethodCodec{Method: "Service1.Multiply", A: 4, B: 2}
+	s.RegisterCodec(codec, "mock")
+	var authorized string
+	s.SetAuthFunc(func(r *http.Request, method string) error {
+		authorized = method
+		if r.Header.Get("USER_ID") != "alice" || r.Header.Get("USER_PASSWORD") != "secret" {
+			return errors.New("invalid credentials")
+		}
+		return nil
+	})
+
+	tests := []struct {
+		password string
+		body     string
+		rejected bool
+	}{
+		{"secret", "8", false},
+		{"wrong", "", true},
+	}
+	for _, test := range tests {
+		authorized = ""
+		r, _ := http.NewRequest("POST", "", nil)
+		r.Header.Set("Content-Type", "mock")
+		r.Header.Set("USER_ID", "alice")
+		r.Header.Set("USER_PASSWORD", test.password)
+		w := NewMockResponseWriter()
+		s.ServeHTTP(w, r)
+
+		if authorized != "Service1.Multiply" {
+			t.Errorf("%s: auth function got method %q.", test.password, authorized)
+		}
+		fault, ok := codec.Err.(Fault)
+		if rejected := ok && fault.Code == FaultCodeUnauthorized; rejected != test.rejected {
+			t.Errorf("%s: rejected was %v, should be %v (error: %v).", test.password, rejected, test.rejected, codec.Err)
+		}
+		if test.rejected && fault.Message != "invalid credentials" {
+			t.Errorf("%s: expected fault message %q, got %q.", test.password, "invalid credentials", fault.Message)
+		}
+		if !test.rejected && w.Body != test.body {
+			t.Errorf("%s: expected body %q, got %q.", test.password, test.body, w.Body)
+		}
+	}
+}
+
+func TestRegisterTyped(t *testing.T) {
+	s := NewServer()
+	err := RegisterTyped(s, "Typed.Multiply", func(ctx context.Context, req *Service1Request) (*Service1Response, error) {
+		return &Service1Response{req.A * req.B}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = RegisterTyped(s, "Typed.Fail", func(ctx context.Context, req *Service1Request) (*Service1Response, error) {
+		return nil, ErrNotified
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := RegisterTyped(s, "Typed.Fail", func(ctx context.Context, req *Service1Request) (*Service1Response, error) {
+		return nil, nil
+	}); err == nil {
+		t.Error("Expected an error registering a method twice")
+	}
+	s.RegisterService(new(Service1), "")
+	if err := RegisterTyped(s, "Service1.Typed", func(ctx context.Context, req *Service1Request) (*Service1Response, error) {
+		return nil, nil
+	}); err == nil {
+		t.Error("Expected an error adding a method to a receiver service")
+	}
+
+	var methodName string
+	s.RegisterBeforeFunc(func(i *RequestInfo) {
+		methodName = i.MethodInfo.Name()
+	})
+	for _, test := range []struct {
+		method string
+		body   string
+		err    error
+	}{
+		{"Typed.Multiply", "42", nil},
+		{"Typed.Fail", "notified", ErrNotified},
+	} {
+		codec := &MockMethodCodec{Method: test.method, A: 6, B: 7}
+		s.RegisterCodec(codec, "mock")
+		r, err := http.NewRequest("POST", "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("Content-Type", "mock")
+		w := NewMockResponseWriter()
+		s.ServeHTTP(w, r)
+		if w.Body != test.body || codec.Err != test.err {
+			t.Errorf("%s: response was %q (error: %v), should be %q (error: %v).", test.method, w.Body, codec.Err, test.body, test.err)
+		}
+		if methodName != test.method {
+			t.Errorf("Method name was %q, should be %q.", methodName, test.method)
+		}
+	}
+}
+
+func TestReady(t *testing.T) {
+	s := NewServer()
+	s.SetReady(false)
+	codec := &MockMethodCodec{Method: "Service1.Multiply", A: 2, B: 3}
+	s.RegisterCodec(codec, "mock")
+
+	serve := func() *MockResponseWriter {
+		r, err := http.NewRequest("POST", "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("Content-Type", "mock")
+		w := NewMockResponseWriter()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	// The service isn't registered yet, but the client is told to retry.
+	w := serve()
+	if w.Status != 503 {
+		t.Errorf("Status was %d, should be 503.", w.Status)
+	}
+	if fault, ok := codec.Err.(Fault); !ok || fault.Code != FaultCodeNotReady {
+		t.Errorf("Error was %v, should be a not ready fault.", codec.Err)
+	}
+
+	s.RegisterService(new(Service1), "")
+	s.SetReady(true)
+	codec.Err = nil
+	w = serve()
+	if w.Status != 200 || w.Body != "6" || codec.Err != nil {
+		t.Errorf("Response was %d %q (error: %v), should be 200 %q.", w.Status, w.Body, codec.Err, "6")
+	}
+}
+
+type CountingService struct {
+	calls int
+}
+
+func (t *CountingService) Multiply(r *http.Request, req *Service1Request, res *Service1Response) error {
+	t.calls++
+	res.Result = req.A * req.B * t.calls
+	return nil
+}
+
+func TestIdempotencyDedupHit(t *testing.T) {
+	service := new(CountingService)
+	s := NewServer()
+	s.RegisterService(service, "Service1")
+	s.RegisterCodec(MockCodec{2, 3}, "mock")
+	s.SetIdempotencyTTL(time.Minute)
+	var hits []bool
+	s.RegisterAfterFunc(func(i *RequestInfo) {
+		hits = append(hits, i.DedupHit)
+	})
+
+	serve := func(key string) *MockResponseWriter {
+		r, err := http.NewRequest("POST", "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("Content-Type", "mock")
+		r.Header.Set(IdempotencyKeyHeader, key)
+		w := NewMockResponseWriter()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	for _, test := range []struct {
+		key  string
+		body string
+	}{
+		{"a", "6"},
+		{"a", "6"},
+		{"b", "12"},
+	} {
+		if w := serve(test.key); w.Status != 200 || w.Body != test.body {
+			t.Errorf("Key %s: response was %d %q, should be 200 %q.", test.key, w.Status, w.Body, test.body)
+		}
+	}
+	if service.calls != 2 {
+		t.Errorf("Method was called %d times, should be 2.", service.calls)
+	}
+	if expected := []bool{false, true, false}; !reflect.DeepEqual(hits, expected) {
+		t.Errorf("Dedup hits were %v, should be %v.", hits, expected)
+	}
+}
+
+func TestIdempotencyDecodeFault(t *testing.T) {
+	service := new(CountingService)
+	s := NewServer()
+	s.RegisterService(service, "Service1")
+	codec := &MockMethodCodec{Method: "Service1.Multiply", A: 2, B: 3, ReadErr: errors.New("bad args")}
+	s.RegisterCodec(codec, "mock")
+	s.SetIdempotencyTTL(time.Minute)
+
+	serve := func() *MockResponseWriter {
+		r, _ := http.NewRequest("POST", "", nil)
+		r.Header.Set("Content-Type", "mock")
+		r.Header.Set(IdempotencyKeyHeader, "a")
+		w := NewMockResponseWriter()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	serve()
+	if service.calls != 0 {
+		t.Errorf("Method was called %d times with undecodable args, should be 0.", service.calls)
+	}
+	// The fault isn't kept, so the retry with valid args is served.
+	codec.ReadErr = nil
+	if w := serve(); w.Body != "6" {
+		t.Errorf("Retry response was %q, should be \"6\".", w.Body)
+	}
+	if service.calls != 1 {
+		t.Errorf("Method was called %d times, should be 1.", service.calls)
+	}
+}
+
+func TestIdempotencyScope(t *testing.T) {
+	service := new(CountingService)
+	s := NewServer()
+	s.RegisterService(service, "Service1")
+	s.RegisterCodec(MockCodec{2, 3}, "mock")
+	s.SetIdempotencyTTL(time.Minute)
+
+	serve := func(auth string) *MockResponseWriter {
+		r, _ := http.NewRequest("POST", "", nil)
+		r.Header.Set("Content-Type", "mock")
+		r.Header.Set("Authorization", auth)
+		r.Header.Set(IdempotencyKeyHeader, "a")
+		w := NewMockResponseWriter()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	// The same key from another caller doesn't replay the response.
+	for _, test := range []struct {
+		auth string
+		body string
+	}{
+		{"Bearer alice", "6"},
+		{"Bearer bob", "12"},
+		{"Bearer alice", "6"},
+	} {
+		if w := serve(test.auth); w.Body != test.body {
+			t.Errorf("%s: response was %q, should be %q.", test.auth, w.Body, test.body)
+		}
+	}
+}
+
+func TestIdempotencyMaxEntries(t *testing.T) {
+	c := &idempotencyCache{
+		ttl:     time.Minute,
+		max:     2,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+	for _, key := range []string{"a", "b", "c"} {
+		buf := &responseBuffer{w: NewMockResponseWriter()}
+		buf.Write([]byte(key))
+		c.put(key, buf)
+	}
+	if _, ok := c.get("a"); ok {
+		t.Error("Expected the oldest response to be dropped")
+	}
+	for _, key := range []string{"b", "c"} {
+		if res, ok := c.get(key); !ok || string(res.body) != key {
+			t.Errorf("Expected the response for %q to be kept", key)
+		}
+	}
+	if n := len(c.entries); n != 2 {
+		t.Errorf("Kept %d responses, should be 2.", n)
+	}
+
+	// Expired responses are dropped when read.
+	c.order.Back().Value.(*cachedResponse).expires = time.Now().Add(-time.Second)
+	if _, ok := c.get("c"); ok || len(c.entries) != 1 {
+		t.Errorf("Expected the expired response to be dropped, %d kept", len(c.entries))
+	}
+}
+
+// FlushResponseWriter is a MockResponseWriter implementing http.Flusher.
+type FlushResponseWriter struct {
+	*MockResponseWriter
+	flushed int
+}
+
+func (w *FlushResponseWriter) Flush() {
+	w.flushed++
+}
+
+func TestFlusher(t *testing.T) {
+	s := NewServer()
+	s.RegisterService(new(Service1), "")
+	s.RegisterCodec(&MockMethodCodec{Method: "Service1.Multiply", A: 6, B: 7}, "mock")
+
+	for _, tap := range []bool{false, true} {
+		if tap {
+			s.SetWireTap(func(direction string, body []byte, r *http.Request) {}, 0)
+		}
+
+		// Without a Flusher, the response is simply written.
+		r, _ := http.NewRequest("POST", "", nil)
+		r.Header.Set("Content-Type", "mock")
+		w := NewMockResponseWriter()
+		s.ServeHTTP(w, r)
+		if w.Status != 200 || w.Body != "42" {
+			t.Errorf("tap %v: response was %d %q, should be 200 %q.", tap, w.Status, w.Body, "42")
+		}
+
+		r, _ = http.NewRequest("POST", "", nil)
+		r.Header.Set("Content-Type", "mock")
+		fw := &FlushResponseWriter{MockResponseWriter: NewMockResponseWriter()}
+		s.ServeHTTP(fw, r)
+		if fw.Body != "42" || fw.flushed != 1 {
+			t.Errorf("tap %v: response was %q flushed %d times, should be %q flushed once.", tap, fw.Body, fw.flushed, "42")
+		}
+	}
+}
+
+func TestWireTapOnError(t *testing.T) {
+	s := NewServer()
+	s.RegisterService(new(Service1), "")
+	s.RegisterService(&NotifyService{called: make(chan *Service1Request, 1)}, "")
+
+	captured := map[string]string{}
+	s.SetWireTap(func(direction string, body []byte, r *http.Request) {
+		captured[direction] = string(body)
+	}, 0)
+	s.SetWireTapOnError(true)
+
+	tests := []struct {
+		method   string
+		captured bool
+	}{
+		{"Service1.Multiply", false},
+		{"NotifyService.Notify", true},
+	}
+	for _, test := range tests {
+		captured = map[string]string{}
+		s.RegisterCodec(&MockMethodCodec{Method: test.method, A: 6, B: 7}, "mock")
+		r, err := http.NewRequest("POST", "", strings.NewReader("<methodCall/>"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("Content-Type", "mock")
+		w := NewMockResponseWriter()
+		s.ServeHTTP(w, r)
+
+		if got := len(captured) != 0; got != test.captured {
+			t.Errorf("%s: captured was %v, should be %v.", test.method, got, test.captured)
+		}
+		if test.captured && (captured[WireRequest] != "<methodCall/>" || captured[WireResponse] != w.Body) {
+			t.Errorf("%s: wrong capture %q.", test.method, captured)
+		}
+	}
+}
+
+func TestMaxHeaderPolicy(t *testing.T) {
+	s := NewServer()
+	s.RegisterService(new(Service1), "")
+	codec := &MockMethodCodec{Method: "Service1.Multiply", A: 2, B: 3}
+	s.RegisterCodec(codec, "mock")
+	s.SetMaxHeaderPolicy(HeaderPolicy{
+		MaxTotalBytes: 1024,
+		MaxValueBytes: 64,
+		MaxBytes:      map[string]int{"x-signature": 128},
+	})
+
+	tests := []struct {
+		header   string
+		size     int
+		rejected bool
+	}{
+		{"X-Partner", 64, false},
+		{"X-Partner", 65, true},
+		{"X-Signature", 128, false},
+		{"X-Signature", 129, true},
+	}
+	for _, test := range tests {
+		codec.Err = nil
+		r, err := http.NewRequest("POST", "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("Content-Type", "mock")
+		r.Header.Set(test.header, strings.Repeat("x", test.size))
+		w := NewMockResponseWriter()
+		s.ServeHTTP(w, r)
+
+		fault, ok := codec.Err.(Fault)
+		rejected := ok && fault.Code == FaultCodeInvalidRequest
+		if rejected != test.rejected {
+			t.Errorf("%s of %d bytes: rejected was %v, should be %v (error: %v).", test.header, test.size, rejected, test.rejected, codec.Err)
+		}
+		if rejected && w.Status != 431 {
+			t.Errorf("Status was %d, should be 431.", w.Status)
+		}
+	}
+
+	r, err := http.NewRequest("POST", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Content-Type", "mock")
+	for i := 0; i < 20; i++ {
+		r.Header.Set("X-Extra-"+strconv.Itoa(i), strings.Repeat("x", 60))
+	}
+	w := NewMockResponseWriter()
+	s.ServeHTTP(w, r)
+	if w.Status != 431 {
+		t.Errorf("Status was %d, should be 431 for oversized headers.", w.Status)
+	}
+}
+
+type GreetingRequest struct {
+	Name      string // v1
+	FirstName string // v2
+	LastName  string // v2
+}
+
+type GreetingService struct {
+	args GreetingRequest
+}
+
+func (t *GreetingService) Hello(r *http.Request, req *GreetingRequest, res *Service1Response) error {
+	t.args = *req
+	return nil
+}
+
+func TestArgsTransformer(t *testing.T) {
+	service := new(GreetingService)
+	s := NewServer()
+	s.RegisterService(service, "")
+	s.RegisterCodec(&MockMethodCodec{Method: "GreetingService.Hello", Args: &GreetingRequest{Name: "Ada Lovelace"}}, "mock")
+	s.SetArgsTransformer(func(method string, args interface{}) error {
+		if method != "GreetingService.Hello" {
+			t.Errorf("Method was %q, should be %q.", method, "GreetingService.Hello")
+		}
+		v := reflect.ValueOf(args).Elem()
+		name := v.FieldByName("Name")
+		if name.String() != "" {
+			parts := strings.SplitN(name.String(), " ", 2)
+			v.FieldByName("FirstName").SetString(parts[0])
+			v.FieldByName("LastName").SetString(parts[1])
+			name.SetString("")
+		}
+		return nil
+	})
+
+	r, err := http.NewRequest("POST", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Content-Type", "mock")
+	s.ServeHTTP(NewMockResponseWriter(), r)
+
+	expected := GreetingRequest{FirstName: "Ada", LastName: "Lovelace"}
+	if service.args != expected {
+		t.Errorf("Args were %+v, should be %+v.", service.args, expected)
+	}
+
+	// An error rejects the request.
+	service.args = GreetingRequest{}
+	s.SetArgsTransformer(func(method string, args interface{}) error {
+		return errors.New("unsupported version")
+	})
+	w := NewMockResponseWriter()
+	s.ServeHTTP(w, r)
+	fault := Fault{Code: FaultCodeInvalidParams, Message: "unsupported version"}
+	if w.Status != 200 || w.Body != fault.Error() || service.args != (GreetingRequest{}) {
+		t.Errorf("Response was %d %q, should be 200 %q.", w.Status, w.Body, fault.Error())
+	}
+}
+
+type InsufficientFunds struct {
+	Balance int
+}
+
+type LedgerService struct{}
+
+func (t *LedgerService) Debit(r *http.Request, req *Service1Request, res *Service1Response) error {
+	if req.A > req.B {
+		panic(InsufficientFunds{req.B})
+	}
+	panic("ledger corrupted")
+}
+
+func TestPanicMapper(t *testing.T) {
+	s := NewServer()
+	s.RegisterService(new(LedgerService), "")
+	s.SetPanicMapper(func(recovered interface{}) (int, string) {
+		if p, ok := recovered.(InsufficientFunds); ok {
+			return 402, fmt.Sprintf("Insufficient funds: balance %d", p.Balance)
+		}
+		return FaultCodeInternalError, "Internal Server Error"
+	})
+
+	tests := []struct {
+		a, b    int
+		code    int
+		message string
+	}{
+		{10, 3, 402, "Insufficient funds: balance 3"},
+		{1, 3, FaultCodeInternalError, "Internal Server Error"},
+	}
+	for _, test := range tests {
+		codec := &MockMethodCodec{Method: "LedgerService.Debit", A: test.a, B: test.b}
+		s.RegisterCodec(codec, "mock")
+		r, err := http.NewRequest("POST", "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("Content-Type", "mock")
+		s.ServeHTTP(NewMockResponseWriter(), r)
+
+		fault, ok := codec.Err.(Fault)
+		if !ok || fault.Code != test.code || fault.Message != test.message {
+			t.Errorf("Error was %v, should be %d: %s.", codec.Err, test.code, test.message)
+		}
+	}
+}
+
+type SharedService struct {
+	calls   int32
+	release chan struct{}
+}
+
+func (t *SharedService) Multiply(r *http.Request, req *Service1Request, res *Service1Response) error {
+	atomic.AddInt32(&t.calls, 1)
+	<-t.release
+	res.Result = req.A * req.B
+	return nil
+}
+
+func TestCoalescing(t *testing.T) {
+	const n = 10
+	service := &SharedService{release: make(chan struct{})}
+	s := NewServer()
+	s.RegisterService(service, "Service1")
+	s.RegisterCodec(MockCodec{2, 3}, "mock")
+	s.SetCoalescing(true)
+	if err := s.SetSafe("Service1.Multiply", true); err != nil {
+		t.Fatal(err)
+	}
+	before := make(chan struct{}, n)
+	s.RegisterBeforeFunc(func(i *RequestInfo) {
+		before <- struct{}{}
+	})
+
+	done := make(chan *MockResponseWriter, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			r, _ := http.NewRequest("POST", "", nil)
+			r.Header.Set("Content-Type", "mock")
+			w := NewMockResponseWriter()
+			s.ServeHTTP(w, r)
+			done <- w
+		}()
+	}
+	// Wait for all the calls to be dispatched, then give them time to join
+	// the first one.
+	for i := 0; i < n; i++ {
+		<-before
+	}
+	for atomic.LoadInt32(&service.calls) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(service.release)
+
+	for i := 0; i < n; i++ {
+		if w := <-done; w.Body != "6" {
+			t.Errorf("Response body was %q, should be %q.", w.Body, "6")
+		}
+	}
+	if calls := atomic.LoadInt32(&service.calls); calls != 1 {
+		t.Errorf("Method was called %d times, should be 1.", calls)
+	}
+}
+
+func TestCoalescingScope(t *testing.T) {
+	service := &SharedService{release: make(chan struct{})}
+	s := NewServer()
+	s.RegisterService(service, "Service1")
+	s.RegisterCodec(MockCodec{2, 3}, "mock")
+	s.SetCoalescing(true)
+	if err := s.SetSafe("Service1.Multiply", true); err != nil {
+		t.Fatal(err)
+	}
+
+	// Identical calls from different callers aren't shared.
+	done := make(chan *MockResponseWriter, 2)
+	for _, auth := range []string{"Bearer alice", "Bearer bob"} {
+		go func(auth string) {
+			r, _ := http.NewRequest("POST", "", nil)
+			r.Header.Set("Content-Type", "mock")
+			r.Header.Set("Authorization", auth)
+			w := NewMockResponseWriter()
+			s.ServeHTTP(w, r)
+			done <- w
+		}(auth)
+	}
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt32(&service.calls) < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	close(service.release)
+	for i := 0; i < 2; i++ {
+		if w := <-done; w.Body != "6" {
+			t.Errorf("Response body was %q, should be %q.", w.Body, "6")
+		}
+	}
+	if calls := atomic.LoadInt32(&service.calls); calls != 2 {
+		t.Errorf("Method was called %d times, should be 2.", calls)
+	}
+}
+
+// UnreadBody is a request body recording whether it was read.
+type UnreadBody struct {
+	read bool
+}
+
+func (b *UnreadBody) Read(p []byte) (int, error) {
+	b.read = true
+	return 0, io.EOF
+}
+
+func (b *UnreadBody) Close() error {
+	return nil
+}
+
+func TestRejectBeforeReadingBody(t *testing.T) {
+	s := NewServer()
+	s.RegisterService(new(Service1), "")
+	codec := &MockMethodCodec{Method: "Service1.Multiply", A: 2, B: 3}
+	s.RegisterCodec(codec, "mock")
+	s.SetAllowedUserAgents([]string{"USSDGateway"})
+	s.SetMaxHeaderPolicy(HeaderPolicy{MaxValueBytes: 16})
+
+	serve := func(userAgent string) (*MockResponseWriter, *UnreadBody) {
+		body := new(UnreadBody)
+		r, err := http.NewRequest("POST", "", body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("Content-Type", "mock")
+		r.Header.Set("User-Agent", userAgent)
+		r.Header.Set("X-Tenant", "a-very-long-tenant-name")
+		w := NewMockResponseWriter()
+		s.ServeHTTP(w, r)
+		return w, body
+	}
+
+	s.SetReady(false)
+	if w, body := serve("USSDGateway"); w.Status != 503 || body.read {
+		t.Errorf("Not ready: status was %d and body read %v, should be 503 and unread.", w.Status, body.read)
+	}
+	s.SetReady(true)
+	if w, body := serve("curl/8.0"); w.Status != 403 || body.read {
+		t.Errorf("Unknown client: status was %d and body read %v, should be 403 and unread.", w.Status, body.read)
+	}
+	w, body := serve("USSDGateway")
+	if fault, ok := codec.Err.(Fault); !ok || fault.Code != FaultCodeInvalidRequest || body.read {
+		t.Errorf("Header policy: got %d %v and body read %v, should be an invalid request fault and unread.", w.Status, codec.Err, body.read)
+	}
+}
+
+func TestAllowedUserAgents(t *testing.T) {
+	s := NewServer()
+	s.RegisterService(new(Service1), "")
+	codec := &MockMethodCodec{Method: "Service1.Multiply", A: 2, B: 3}
+	s.RegisterCodec(codec, "mock")
+	s.SetAllowedUserAgents([]string{"USSDGateway", "*Billing/2.*"})
+
+	tests := []struct {
+		userAgent string
+		allowed   bool
+	}{
+		{"USSDGateway/1.4", true},
+		{"Acme Billing/2.3 (linux)", true},
+		{"Acme Billing/1.0", false},
+		{"curl/8.0", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		codec.Err = nil
+		r, err := http.NewRequest("POST", "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("Content-Type", "mock")
+		r.Header.Set("User-Agent", test.userAgent)
+		w := NewMockResponseWriter()
+		s.ServeHTTP(w, r)
+
+		if allowed := w.Status == 200 && codec.Err == nil; allowed != test.allowed {
+			t.Errorf("%q: allowed was %v, should be %v (status %d, error: %v).", test.userAgent, allowed, test.allowed, w.Status, codec.Err)
+		}
+		if fault, ok := codec.Err.(Fault); !test.allowed && (!ok || fault.Code != FaultCodeUnauthorized || w.Status != 403) {
+			t.Errorf("%q: expected an unauthorized fault with status 403, got %d %v.", test.userAgent, w.Status, codec.Err)
+		}
+	}
+}
+
+type ThrottledService struct{}
+
+func (t *ThrottledService) Send(r *http.Request, req *Service1Request, res *Service1Response) error {
+	return Fault{Code: FaultCodeRateLimited, Message: "Rate Limited"}
+}
+
+func (t *ThrottledService) Relay(r *http.Request, req *Service1Request, res *Service1Response) error {
+	return fmt.Errorf("relay: %w", Fault{Code: FaultCodeRateLimited, Message: "Rate Limited"})
+}
+
+func TestRetryAfter(t *testing.T) {
+	s := NewServer()
+	s.RegisterService(new(ThrottledService), "")
+	codec := &MockMethodCodec{Method: "ThrottledService.Send"}
+	s.RegisterCodec(codec, "mock")
+
+	serve := func() *MockResponseWriter {
+		r, err := http.NewRequest("POST", "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("Content-Type", "mock")
+		w := NewMockResponseWriter()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	w := serve()
+	if w.Status != 429 || w.Header().Get("Retry-After") != "1" {
+		t.Errorf("Response was %d with Retry-After %q, should be 429 with %q.", w.Status, w.Header().Get("Retry-After"), "1")
+	}
+
+	// Wrapped faults get the hint as well.
+	codec.Method = "ThrottledService.Relay"
+	w = serve()
+	if w.Status != 429 || w.Header().Get("Retry-After") != "1" {
+		t.Errorf("Wrapped fault response was %d with Retry-After %q, should be 429 with %q.", w.Status, w.Header().Get("Retry-After"), "1")
+	}
+	codec.Method = "ThrottledService.Send"
+
+	s.SetRetryAfter(func(fault Fault, inFlight int) time.Duration {
+		return time.Duration(inFlight)*2*time.Second + 500*time.Millisecond
+	})
+	w = serve()
+	if w.Status != 429 || w.Header().Get("Retry-After") != "3" {
+		t.Errorf("Response was %d with Retry-After %q, should be 429 with %q.", w.Status, w.Header().Get("Retry-After"), "3")
+	}
+
+	// Faults raised by the server, such as not ready, carry the hint too.
+	s.SetReady(false)
+	w = serve()
+	if w.Status != 503 || w.Header().Get("Retry-After") != "3" {
+		t.Errorf("Response was %d with Retry-After %q, should be 503 with %q.", w.Status, w.Header().Get("Retry-After"), "3")
+	}
+}
+
+func TestUnknownMethodFlood(t *testing.T) {
+	s := NewServer()
+	s.RegisterService(new(Service1), "")
+	s.EnableHealth(true)
+	services, methods := len(s.services.services), s.services.methodCount()
+
+	for i := 0; i < 10000; i++ {
+		codec := &MockMethodCodec{Method: "Service1.Method" + strconv.Itoa(i)}
+		s.RegisterCodec(codec, "mock")
+		r, err := http.NewRequest("POST", "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("Content-Type", "mock")
+		w := NewMockResponseWriter()
+		s.ServeHTTP(w, r)
+		if fault, ok := codec.Err.(Fault); w.Status != 200 || !ok || fault.Code != FaultCodeMethodNotFound {
+			t.Fatalf("Response was %d %v, should be a method not found fault.", w.Status, codec.Err)
+		}
+	}
+
+	if len(s.services.services) != services || s.services.methodCount() != methods {
+		t.Errorf("Registry grew from %d services and %d methods to %d and %d.",
+			services, methods, len(s.services.services), s.services.methodCount())
+	}
+}
+
+func TestDisableDefaultService(t *testing.T) {
+	s := NewServer()
+	s.RegisterDefaultService(new(Service1), "Service1")
+	codec := &MockMethodCodec{Method: "Multiply", A: 2, B: 3}
+	s.RegisterCodec(codec, "mock")
+
+	serve := func() *MockResponseWriter {
+		r, err := http.NewRequest("POST", "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("Content-Type", "mock")
+		w := NewMockResponseWriter()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := serve(); w.Status != 200 || w.Body != "6" {
+		t.Errorf("Response was %d %q, should be 200 %q.", w.Status, w.Body, "6")
+	}
+
+	s.DisableDefaultService()
+	w := serve()
+	if fault, ok := codec.Err.(Fault); w.Status != 200 || !ok || fault.Code != FaultCodeMethodNotFound {
+		t.Errorf("Response was %d %v, should be a method not found fault for a bare method name.", w.Status, codec.Err)
+	}
+	if err := s.RegisterDefaultService(new(Service1), "Service1"); err == nil {
+		t.Error("Expected an error registering a default service once disabled")
+	}
+}
+
+type mapRouter map[string]*MethodInfo
+
+func (m mapRouter) Resolve(method string) (*MethodInfo, bool) {
+	info, ok := m[method]
+	return info, ok
+}
+
+func TestRouter(t *testing.T) {
+	multiply, err := NewMethodInfo(new(Service1), "Service1.Multiply")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer()
+	s.SetRouter(mapRouter{"Math.Product": multiply})
+	codec := &MockMethodCodec{Method: "Math.Product", A: 2, B: 3}
+	s.RegisterCodec(codec, "mock")
+
+	serve := func() *MockResponseWriter {
+		r, err := http.NewRequest("POST", "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("Content-Type", "mock")
+		w := NewMockResponseWriter()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := serve(); w.Status != 200 || w.Body != "6" {
+		t.Errorf("Response was %d %q, should be 200 %q.", w.Status, w.Body, "6")
+	}
+	if !s.HasMethod("Math.Product") || s.HasMethod("Service1.Multiply") {
+		t.Error("HasMethod should resolve methods through the router")
+	}
+
+	codec.Method = "Math.Sum"
+	w := serve()
+	if fault, ok := codec.Err.(Fault); w.Status != 200 || !ok || fault.Code != FaultCodeMethodNotFound {
+		t.Errorf("Response was %d %v, should be a method not found fault for an unknown method.", w.Status, codec.Err)
+	}
+
+	if _, err := NewMethodInfo(new(Service1), "Service1.Missing"); err == nil {
+		t.Error("Expected an error resolving a missing method")
+	}
+}
+
+// SlowCodec delays decoding and encoding by the given durations.
+type SlowCodec struct {
+	MockMethodCodec
+	decode, encode time.Duration
+}
+
+func (c *SlowCodec) NewRequest(r *http.Request) CodecRequest {
+	return &SlowCodecRequest{c.MockMethodCodec.NewRequest(r), c}
+}
+
+type SlowCodecRequest struct {
+	CodecRequest
+	codec *SlowCodec
+}
+
+func (r *SlowCodecRequest) ReadRequest(args interface{}) error {
+	time.Sleep(r.codec.decode)
+	return r.CodecRequest.ReadRequest(args)
+}
+
+func (r *SlowCodecRequest) WriteResponse(w http.ResponseWriter, reply interface{}, methodErr error) error {
+	time.Sleep(r.codec.encode)
+	return r.CodecRequest.WriteResponse(w, reply, methodErr)
+}
+
+func TestPhaseDurations(t *testing.T) {
+	s := NewServer()
+	s.RegisterService(&SlowService{30 * time.Millisecond}, "")
+	codec := &SlowCodec{MockMethodCodec{Method: "SlowService.Sleep"}, 20 * time.Millisecond, 40 * time.Millisecond}
+	s.RegisterCodec(codec, "mock")
+
+	var info *RequestInfo
+	s.RegisterAfterFunc(func(i *RequestInfo) {
+		info = i
+	})
+
+	r, err := http.NewRequest("POST", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Content-Type", "mock")
+	s.ServeHTTP(NewMockResponseWriter(), r)
+
+	if info == nil {
+		t.Fatal("After Function wasn't called")
+	}
+	phases := []struct {
+		name     string
+		got, min time.Duration
+	}{
+		{"decode", info.DecodeDuration, 20 * time.Millisecond},
+		{"handler", info.HandlerDuration, 30 * time.Millisecond},
+		{"encode", info.EncodeDuration, 40 * time.Millisecond},
+	}
+	for _, phase := range phases {
+		if phase.got < phase.min {
+			t.Errorf("The %s phase took %v, should be at least %v.", phase.name, phase.got, phase.min)
+		}
+	}
+	sum := info.DecodeDuration + info.HandlerDuration + info.EncodeDuration
+	if sum > info.Duration || info.Duration-sum > 10*time.Millisecond {
+		t.Errorf("The phases took %v, should add up to about %v.", sum, info.Duration)
+	}
+}
+
+func TestWrapFault(t *testing.T) {
+	if err := NewFault(404, "no such %s", "user"); err.Error() != "404: no such user" {
+		t.Errorf("Error was %q, should be %q.", err, "404: no such user")
+	}
+	cause := errors.New("backend down")
+	err := WrapFault(503, cause)
+	if !errors.Is(err, cause) {
+		t.Error("Expected the fault to wrap the cause")
+	}
+	if fault, ok := err.(Fault); !ok || fault.Code != 503 || fault.Message != "backend down" {
+		t.Errorf("Fault was %v, should be 503 backend down.", err)
+	}
+	if WrapFault(503, nil) != nil {
+		t.Error("Expected no fault wrapping a nil error")
+	}
+}
+
+// HelloService scales its results, standing for a dependency that differs
+// between instances.
+type HelloService struct {
+	factor int
+}
+
+func (t *HelloService) Multiply(r *http.Request, req *Service1Request, res *Service1Response) error {
+	res.Result = req.A * req.B * t.factor
+	return nil
+}
+
+func TestRegisterSameTypeTwice(t *testing.T) {
+	s := NewServer()
+	if err := s.RegisterService(&HelloService{1}, "HelloA"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RegisterService(&HelloService{10}, "HelloB"); err != nil {
+		t.Fatalf("Registering a second instance under another name failed: %v", err)
+	}
+	if err := s.RegisterService(&HelloService{100}, "HelloB"); err == nil {
+		t.Error("Expected an error registering a name twice")
+	}
+	codec := &MockMethodCodec{A: 2, B: 3}
+	s.RegisterCodec(codec, "mock")
+
+	for method, expected := range map[string]string{"HelloA.Multiply": "6", "HelloB.Multiply": "60"} {
+		codec.Method = method
+		r, err := http.NewRequest("POST", "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("Content-Type", "mock")
+		w := NewMockResponseWriter()
+		s.ServeHTTP(w, r)
+		if w.Body != expected {
+			t.Errorf("%s returned %q, should be %q.", method, w.Body, expected)
+		}
+	}
+}
+
+type recordingLogger struct {
+	messages []string
+}
+
+func (l *recordingLogger) Printf(format string, args ...interface{}) {
+	l.messages = append(l.messages, fmt.Sprintf(format, args...))
+}
+
+func TestLogger(t *testing.T) {
+	var stdlog bytes.Buffer
+	log.SetOutput(&stdlog)
+	defer log.SetOutput(os.Stderr)
+
+	s := NewServer()
+	s.RegisterService(new(Service1), "")
+	s.HasMethod("Service1.Multiply")
+	if stdlog.Len() != 0 {
+		t.Errorf("Logged %q, should be silent by default.", stdlog.String())
+	}
+
+	logger := new(recordingLogger)
+	s.SetLogger(logger)
+	s.RegisterService(new(Service1), "Other")
+	s.HasMethod("Other.Multiply")
+	if len(logger.messages) == 0 || stdlog.Len() != 0 {
+		t.Errorf("Logged %q and %q to the standard logger, should only use the set logger.", logger.messages, stdlog.String())
+	}
+	var found bool
+	for _, msg := range logger.messages {
+		found = found || strings.Contains(msg, "Other.Multiply")
+	}
+	if !found {
+		t.Errorf("Logged %q, should include the lookup of Other.Multiply.", logger.messages)
+	}
+}
+
+type USSDRequest struct {
+	MSISDN   string
+	Language string
+}
+
+type LocaleService struct {
+	locale string
+}
+
+func (t *LocaleService) Menu(r *http.Request, req *USSDRequest, res *Service1Response) error {
+	t.locale = Locale(r)
+	return nil
+}
+
+func TestLocale(t *testing.T) {
+	service := new(LocaleService)
+	s := NewServer()
+	s.RegisterService(service, "")
+	codec := &MockMethodCodec{Method: "LocaleService.Menu", Args: &USSDRequest{MSISDN: "254700000000"}}
+	s.RegisterCodec(codec, "mock")
+
+	serve := func(acceptLanguage string) string {
+		r, err := http.NewRequest("POST", "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("Content-Type", "mock")
+		r.Header.Set("Accept-Language", acceptLanguage)
+		service.locale = ""
+		s.ServeHTTP(NewMockResponseWriter(), r)
+		return service.locale
+	}
+
+	if locale := serve("sw-KE"); locale != "" {
+		t.Errorf("Locale was %q, should be empty without a source.", locale)
+	}
+
+	s.SetLocaleSource("Accept-Language", "LANGUAGE")
+	if locale := serve("sw-KE, en;q=0.8"); locale != "sw-KE" {
+		t.Errorf("Locale was %q, should be %q from the header.", locale, "sw-KE")
+	}
+	codec.Args = &USSDRequest{MSISDN: "254700000000", Language: "fr"}
+	if locale := serve("sw-KE"); locale != "fr" {
+		t.Errorf("Locale was %q, should be %q from the args.", locale, "fr")
+	}
+}
+
+func TestAsync(t *testing.T) {
+	type delivery struct {
+		jobID, body string
+	}
+	deliveries := make(chan delivery, 1)
+	var attempts int32
+	callback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Fail the first attempt to exercise the retry.
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		deliveries <- delivery{r.Header.Get(JobIDHeader), string(body)}
+	}))
+	defer callback.Close()
+
+	// The method blocks until the acknowledgment is checked.
+	service := &BlockingService{
+		entered: make(chan struct{}, 1),
+		release: make(chan struct{}),
+	}
+	s := NewServer()
+	s.RegisterService(service, "Service1")
+	codec := &MockMethodCodec{Method: "Service1.Multiply", A: 2, B: 3}
+	s.RegisterCodec(codec, "mock")
+	if err := s.SetAsync("Service1.Multiply", true); err != nil {
+		t.Fatal(err)
+	}
+	s.SetCallbackRetry(3, 10*time.Millisecond)
+	// The callback server listens on a loopback address.
+	s.SetCallbackValidator(func(u *url.URL) error { return nil })
+	after := make(chan *RequestInfo, 1)
+	s.RegisterAfterFunc(func(i *RequestInfo) {
+		after <- i
+	})
+
+	r, err := http.NewRequest("POST", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Content-Type", "mock")
+	r.Header.Set(CallbackURLHeader, callback.URL)
+	w := NewMockResponseWriter()
+	s.ServeHTTP(w, r)
+
+	jobID := w.Header().Get(JobIDHeader)
+	fault, ok := codec.Err.(Fault)
+	if w.Status != http.StatusAccepted || jobID == "" || !ok || fault.Code != FaultCodeAccepted || fault.Detail["jobId"] != jobID {
+		t.Fatalf("Response was %d with job ID %q and %v, should be an accepted fault.", w.Status, jobID, codec.Err)
+	}
+	close(service.release)
+
+	select {
+	case d := <-deliveries:
+		if d.jobID != jobID || d.body != "6" {
+			t.Errorf("Delivered %q for job %q, should be %q for job %q.", d.body, d.jobID, "6", jobID)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("The result wasn't delivered")
+	}
+	select {
+	case i := <-after:
+		if i.JobID != jobID || i.Error != nil || i.StatusCode != http.StatusOK {
+			t.Errorf("Reported job %q with %v and status %d, should be job %q delivered with status 200.", i.JobID, i.Error, i.StatusCode, jobID)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("The delivery wasn't reported to the After Function")
+	}
+	if n := atomic.LoadInt32(&attempts); n != 2 {
+		t.Errorf("Posted the result %d times, should be 2.", n)
+	}
+}
+
+func TestAsyncCallbackValidation(t *testing.T) {
+	s := NewServer()
+	s.RegisterService(new(Service1), "")
+	codec := &MockMethodCodec{Method: "Service1.Multiply", A: 2, B: 3}
+	s.RegisterCodec(codec, "mock")
+	if err := s.SetAsync("Service1.Multiply", true); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, callback := range []string{
+		"http://127.0.0.1:8080/done",
+		"http://[::1]/done",
+		"http://10.0.0.1/done",
+		"http://169.254.169.254/latest/meta-data",
+		"http://localhost/done",
+		"file:///etc/passwd",
+		"/done",
+	} {
+		codec.Err = nil
+		r, err := http.NewRequest("POST", "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("Content-Type", "mock")
+		r.Header.Set(CallbackURLHeader, callback)
+		w := NewMockResponseWriter()
+		s.ServeHTTP(w, r)
+		fault, ok := codec.Err.(Fault)
+		if !ok || fault.Code != FaultCodeInvalidRequest || w.Header().Get(JobIDHeader) != "" {
+			t.Errorf("Callback %q got %v, should be rejected with an invalid request fault.", callback, codec.Err)
+		}
+	}
+	if err := ValidateCallbackURL(&url.URL{Scheme: "https", Host: "203.0.113.7"}); err != nil {
+		t.Errorf("Expected a public address to be accepted, got %v", err)
+	}
+}
+
+func TestGetMissingService(t *testing.T) {
+	m := new(serviceMap)
+	if err := m.register(new(Service1), "", true, false); err != nil {
+		t.Fatal(err)
+	}
+	for _, method := range []string{"NoSuchService.Foo", "Bare"} {
+		if _, _, err := m.get(method); err == nil {
+			t.Errorf("Expected an error getting %q", method)
+		}
+	}
+}
+
+func TestMulticallLimits(t *testing.T) {
+	s := NewServer()
+	if err := s.checkMulticall(10000); err != nil {
+		t.Errorf("Expected no cap by default, got %v", err)
+	}
+	s.SetMaxMulticall(100)
+	if err := s.checkMulticall(100); err != nil {
+		t.Errorf("Expected 100 calls to be accepted, got %v", err)
+	}
+	err := s.checkMulticall(101)
+	if fault, ok := err.(Fault); !ok || fault.Code != FaultCodeInvalidRequest {
+		t.Errorf("Expected an invalid request fault, got %v", err)
+	}
+
+	const calls, parallelism = 20, 3
+	var running, peak int32
+	done := make([]bool, calls)
+	runBatch(calls, parallelism, func(i int) {
+		n := atomic.AddInt32(&running, 1)
+		for {
+			p := atomic.LoadInt32(&peak)
+			if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+				break
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+		atomic.AddInt32(&running, -1)
+		done[i] = true
+	})
+	if peak > parallelism || peak < 2 {
+		t.Errorf("Ran up to %d calls at the same time, should be at most %d and more than one.", peak, parallelism)
+	}
+	for i, ok := range done {
+		if !ok {
+			t.Errorf("Call %d didn't run.", i)
+		}
+	}
+}
+
+func TestXMLRPCType(t *testing.T) {
+	tests := []struct {
+		value    interface{}
+		expected string
+	}{
+		{0, "int"},
+		{int32(0), "int"},
+		{int64(0), "i8"},
+		{uint64(0), "i8"},
+		{"", "string"},
+		{0.5, "double"},
+		{true, "boolean"},
+		{Service1Request{}, "struct"},
+		{&Service1Request{}, "struct"},
+		{[]int{}, "array"},
+		{[]byte{}, "base64"},
+		{time.Time{}, "dateTime.iso8601"},
+		{map[string]int{}, "struct"},
+	}
+	for _, test := range tests {
+		if name := xmlrpcType(reflect.TypeOf(test.value)); name != test.expected {
+			t.Errorf("Type of %T was %q, should be %q.", test.value, name, test.expected)
+		}
+	}
+}
+
+type NamedService struct {
+	Service1
+}
+
+func (t *NamedService) ServiceName() string {
+	return "Calculator"
+}
+
+type TaggedService struct {
+	Named `rpc:"Arithmetic"`
+	Service1
+}
+
+func TestDeclaredServiceName(t *testing.T) {
+	s := NewServer()
+	if err := s.RegisterService(new(NamedService), ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RegisterService(new(TaggedService), ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RegisterService(new(NamedService), "Explicit"); err != nil {
+		t.Fatal(err)
+	}
+	for _, method := range []string{"Calculator.Multiply", "Arithmetic.Multiply", "Explicit.Multiply"} {
+		if !s.HasMethod(method) {
+			t.Errorf("Expected to be registered: %s", method)
+		}
+	}
+	for _, method := range []string{"NamedService.Multiply", "TaggedService.Multiply", "Calculator.ServiceName"} {
+		if s.HasMethod(method) {
+			t.Errorf("Expected not to be registered: %s", method)
+		}
+	}
+}
+
+func TestMaxRequestBytesFor(t *testing.T) {
+	s := NewServer()
+	s.RegisterService(new(Service1), "")
+	s.RegisterCodec(&MockMethodCodec{Method: "Service1.Multiply", A: 2, B: 3}, "text/xml")
+	s.RegisterCodec(&MockMethodCodec{Method: "Service1.Multiply", A: 2, B: 3}, "application/json")
+	s.SetMaxRequestBytesFor("text/xml", 100)
+	s.SetMaxRequestBytesFor("Application/JSON", 50)
+
+	tests := []struct {
+		contentType string
+		size        int
+		status      int
+	}{
+		{"text/xml", 100, 200},
+		{"text/xml", 101, 413},
+		{"application/json; charset=utf-8", 50, 200},
+		{"application/json; charset=utf-8", 80, 413},
+	}
+	for _, test := range tests {
+		r, err := http.NewRequest("POST", "", strings.NewReader(strings.Repeat("x", test.size)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("Content-Type", test.contentType)
+		w := NewMockResponseWriter()
+		s.ServeHTTP(w, r)
+		if w.Status != test.status {
+			t.Errorf("%s body of %d bytes: status was %d, should be %d.", test.contentType, test.size, w.Status, test.status)
+		}
+	}
+}
+
+func TestMaxRequestBytes(t *testing.T) {
+	s := NewServer()
+	s.RegisterService(new(Service1), "")
+	s.RegisterCodec(&MockMethodCodec{Method: "Service1.Multiply", A: 2, B: 3}, "text/xml")
+	s.RegisterCodec(&MockMethodCodec{Method: "Service1.Multiply", A: 2, B: 3}, "application/json")
+
+	serve := func(contentType string, size int, chunked bool) *MockResponseWriter {
+		r, err := http.NewRequest("POST", "", strings.NewReader(strings.Repeat("x", size)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if chunked {
+			r.ContentLength = -1
+		}
+		r.Header.Set("Content-Type", contentType)
+		w := NewMockResponseWriter()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := serve("text/xml", DefaultMaxRequestBytes+1, true); w.Status != 413 {
+		t.Errorf("Status was %d over the default limit, should be 413.", w.Status)
+	}
+
+	s.SetMaxRequestBytes(100)
+	s.SetMaxRequestBytesFor("application/json", 200)
+	tests := []struct {
+		contentType string
+		size        int
+		chunked     bool
+		status      int
+	}{
+		{"text/xml", 100, false, 200},
+		{"text/xml", 101, false, 413},
+		{"text/xml", 101, true, 413},
+		{"application/json", 150, false, 200},
+	}
+	for _, test := range tests {
+		w := serve(test.contentType, test.size, test.chunked)
+		if w.Status != test.status {
+			t.Errorf("%s body of %d bytes: status was %d, should be %d.", test.contentType, test.size, w.Status, test.status)
+		}
+		if w.Status == 413 && (w.Header().Get("Connection") != "close" || w.Body != "rpc: request body too large") {
+			t.Errorf("%s body of %d bytes: response was %q with headers %v.", test.contentType, test.size, w.Body, w.Header())
+		}
+	}
+
+	s.SetMaxRequestBytes(0)
+	if w := serve("text/xml", DefaultMaxRequestBytes+1, false); w.Status != 200 {
+		t.Errorf("Status was %d without a limit, should be 200.", w.Status)
+	}
+}
+
+func TestCORS(t *testing.T) {
+	s := NewServer()
+	s.RegisterService(new(Service1), "")
+	s.RegisterCodec(&MockMethodCodec{Method: "Service1.Multiply", A: 6, B: 7}, "mock")
+	s.EnableCORS(CORSConfig{
+		AllowedOrigins: []string{"https://portal.example.com"},
+		AllowedHeaders: []string{"Content-Type", "Authorization"},
+		ExposedHeaders: []string{JobIDHeader},
+		MaxAge:         10 * time.Minute,
+	})
+
+	request := func(method, origin string) *MockResponseWriter {
+		r, _ := http.NewRequest(method, "", nil)
+		r.Header.Set("Content-Type", "mock")
+		r.Header.Set("Origin", origin)
+		if method == "OPTIONS" {
+			r.Header.Set("Access-Control-Request-Method", "POST")
+		}
+		w := NewMockResponseWriter()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	w := request("OPTIONS", "https://portal.example.com")
+	expected := map[string]string{
+		"Access-Control-Allow-Origin":  "https://portal.example.com",
+		"Access-Control-Allow-Methods": "POST",
+		"Access-Control-Allow-Headers": "Content-Type, Authorization",
+		"Access-Control-Max-Age":       "600",
+	}
+	if w.Status != http.StatusNoContent {
+		t.Errorf("Preflight status was %d, should be %d.", w.Status, http.StatusNoContent)
+	}
+	for name, value := range expected {
+		if got := w.Header().Get(name); got != value {
+			t.Errorf("Preflight %s was %q, should be %q.", name, got, value)
+		}
+	}
+
+	w = request("POST", "https://portal.example.com")
+	if w.Body != "42" || w.Header().Get("Access-Control-Allow-Origin") != "https://portal.example.com" || w.Header().Get("Access-Control-Expose-Headers") != JobIDHeader {
+		t.Errorf("Call got %q with headers %v.", w.Body, w.Header())
+	}
+
+	w = request("OPTIONS", "https://evil.example.com")
+	if w.Status != http.StatusForbidden || w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("Preflight from another origin got %d with headers %v.", w.Status, w.Header())
+	}
+}
+
+func TestCORSWildcardCredentials(t *testing.T) {
+	s := NewServer()
+	s.RegisterService(new(Service1), "")
+	s.RegisterCodec(&MockMethodCodec{Method: "Service1.Multiply", A: 6, B: 7}, "mock")
+	s.EnableCORS(CORSConfig{
+		AllowedOrigins:   []string{"https://portal.example.com", "*"},
+		AllowCredentials: true,
+	})
+
+	tests := []struct {
+		origin      string
+		allow       string
+		credentials string
+	}{
+		{"https://portal.example.com", "https://portal.example.com", "true"},
+		{"https://evil.example.com", "*", ""},
+	}
+	for _, test := range tests {
+		r, _ := http.NewRequest("POST", "", nil)
+		r.Header.Set("Content-Type", "mock")
+		r.Header.Set("Origin", test.origin)
+		w := NewMockResponseWriter()
+		s.ServeHTTP(w, r)
+		if allow, credentials := w.Header().Get("Access-Control-Allow-Origin"), w.Header().Get("Access-Control-Allow-Credentials"); allow != test.allow || credentials != test.credentials {
+			t.Errorf("%s got origin %q and credentials %q, should be %q and %q.", test.origin, allow, credentials, test.allow, test.credentials)
+		}
+	}
+}
+
+type ContextService struct {
+	ctx context.Context
+}
+
+func (t *ContextService) Multiply(ctx context.Context, req *Service1Request, res *Service1Response) error {
+	t.ctx = ctx
+	res.Result = req.A * req.B
+	return nil
+}
+
+func TestContextMethod(t *testing.T) {
+	service := new(ContextService)
+	s := NewServer()
+	if err := s.RegisterService(service, ""); err != nil {
+		t.Fatal(err)
+	}
+	s.RegisterCodec(&MockMethodCodec{Method: "ContextService.Multiply", A: 6, B: 7}, "mock")
+	info, ok := s.services.Resolve("ContextService.Multiply")
+	if !ok || !info.PassContext() || info.PassRequest() {
+		t.Fatal("Expected ContextService.Multiply to take a context")
+	}
+
+	type key struct{}
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), key{}, "value"))
+	r, _ := http.NewRequest("POST", "", nil)
+	r = r.WithContext(ctx)
+	r.Header.Set("Content-Type", "mock")
+	w := NewMockResponseWriter()
+	s.ServeHTTP(w, r)
+
+	if w.Body != "42" {
+		t.Errorf("Response body was %q, should be %q.", w.Body, "42")
+	}
+	if service.ctx == nil || service.ctx.Value(key{}) != "value" {
+		t.Fatal("Method didn't receive the request context")
+	}
+	cancel()
+	select {
+	case <-service.ctx.Done():
+	case <-time.After(time.Second):
+		t.Error("Canceling the request didn't cancel the method context")
+	}
+}
+
+func TestCaseInsensitive(t *testing.T) {
+	s := NewServer()
+	s.RegisterService(&HelloService{1}, "Hello")
+	s.RegisterService(&HelloService{10}, "hello")
+	s.RegisterDefaultService(&HelloService{100}, "Default")
+	codec := &MockMethodCodec{A: 2, B: 3}
+	s.RegisterCodec(codec, "mock")
+
+	serve := func(method string) *MockResponseWriter {
+		codec.Method = method
+		r, _ := http.NewRequest("POST", "", nil)
+		r.Header.Set("Content-Type", "mock")
+		w := NewMockResponseWriter()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := serve("HELLO.multiply"); w.Body == "6" {
+		t.Error("Expected mixed-case names not to match by default")
+	}
+
+	s.SetCaseInsensitive(true)
+	tests := []struct {
+		method   string
+		expected string
+	}{
+		{"Hello.Multiply", "6"},
+		{"hello.Multiply", "60"},
+		{"HELLO.multiply", "6"},
+		{"hello.MULTIPLY", "60"},
+		{"multiply", "600"},
+	}
+	for _, test := range tests {
+		if w := serve(test.method); w.Body != test.expected {
+			t.Errorf("%s: response was %q, should be %q.", test.method, w.Body, test.expected)
+		}
+	}
+	if !s.HasMethod("hello.multiply") || s.HasMethod("hello.divide") {
+		t.Error("Expected HasMethod to match regardless of case")
+	}
+}
+
+func TestRegisterMethodAlias(t *testing.T) {
+	s := NewServer()
+	s.RegisterService(new(Service1), "")
+	codec := &MockMethodCodec{A: 4, B: 5}
+	s.RegisterCodec(codec, "mock")
+
+	if err := s.RegisterMethodAlias("ussd.message", "Service1", "Multiply"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RegisterMethodAlias("multiply", "Service1", "Multiply"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RegisterMethodAlias("ussd.divide", "Service1", "Divide"); err == nil {
+		t.Error("Expected an error aliasing a missing method")
+	}
+	if err := s.RegisterMethodAlias("ussd.message", "Service1", "Multiply"); err == nil {
+		t.Error("Expected an error registering an alias twice")
+	}
+
+	for _, method := range []string{"Service1.Multiply", "ussd.message", "multiply"} {
+		codec.Method = method
+		r, _ := http.NewRequest("POST", "", nil)
+		r.Header.Set("Content-Type", "mock")
+		w := NewMockResponseWriter()
+		s.ServeHTTP(w, r)
+		if w.Body != "20" {
+			t.Errorf("%s: response was %q, should be %q.", method, w.Body, "20")
+		}
+	}
+}
+
+func TestInterceptAbort(t *testing.T) {
+	s := NewServer()
+	s.RegisterService(new(Service1), "")
+	codec := &MockMethodCodec{Method: "Service1.Multiply", A: 2, B: 3}
+	s.RegisterCodec(codec, "mock")
+	s.RegisterInterceptFunc(func(i *RequestInfo) *http.Request {
+		if i.Request.Header.Get("Authorization") == "" {
+			return Abort(i.Request, http.StatusUnauthorized, http.Header{"www-authenticate": {`Basic realm="ussd"`}})
+		}
+		return nil
+	})
+	var status int
+	s.RegisterAfterFunc(func(i *RequestInfo) {
+		status = i.StatusCode
+	})
+
+	r, _ := http.NewRequest("POST", "", nil)
+	r.Header.Set("Content-Type", "mock")
+	w := NewMockResponseWriter()
+	s.ServeHTTP(w, r)
+	if w.Status != http.StatusUnauthorized || w.Body != "" || w.Header().Get("WWW-Authenticate") != `Basic realm="ussd"` {
+		t.Errorf("Response was %d %q with headers %v, should be a bare 401 with a WWW-Authenticate header.", w.Status, w.Body, w.Header())
+	}
+	if status != http.StatusUnauthorized {
+		t.Errorf("After Function got status %d, should be %d.", status, http.StatusUnauthorized)
+	}
+
+	r.Header.Set("Authorization", "Basic dXNzZDp1c3Nk")
+	w = NewMockResponseWriter()
+	s.ServeHTTP(w, r)
+	if w.Status != 200 || w.Body != "6" {
+		t.Errorf("Response was %d %q, should be 200 %q.", w.Status, w.Body, "6")
+	}
+}
+
+func TestCompression(t *testing.T) {
+	s := NewServer()
+	s.RegisterService(new(Service1), "")
+	s.SetCompression(true)
+	s.SetCompressionThreshold(5)
+
+	serve := func(a int, acceptEncoding string) *httptest.ResponseRecorder {
+		s.RegisterCodec(MockCodec{a, 1}, "mock")
+		r, _ := http.NewRequest("POST", "", nil)
+		r.Header.Set("Content-Type", "mock")
+		r.Header.Set("Accept-Encoding", acceptEncoding)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	tests := []struct {
+		a              int
+		acceptEncoding string
+		gzipped        bool
+	}{
+		{123456789, "deflate, gzip", true},
+		{123456789, "", false},
+		{123456789, "gzip;q=0", false},
+		{6, "gzip", false},
+	}
+	for _, test := range tests {
+		w := serve(test.a, test.acceptEncoding)
+		body := w.Body.String()
+		if gzipped := w.Header().Get("Content-Encoding") == "gzip"; gzipped != test.gzipped {
+			t.Errorf("%d %q: gzipped was %v, should be %v.", test.a, test.acceptEncoding, gzipped, test.gzipped)
+		} else if gzipped {
+			zr, err := gzip.NewReader(w.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := ioutil.ReadAll(zr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body = string(b)
+		}
+		if body != strconv.Itoa(test.a) || w.Code != 200 {
+			t.Errorf("%d %q: response was %d %q, should be 200 %q.", test.a, test.acceptEncoding, w.Code, body, strconv.Itoa(test.a))
+		}
+		if w.Header().Get("Vary") != "Accept-Encoding" {
+			t.Errorf("%d %q: Vary header was %q.", test.a, test.acceptEncoding, w.Header().Get("Vary"))
+		}
+	}
+}
+
+func TestMethodsWithPrefixAndAnnotation(t *testing.T) {
+	s := NewServer()
+	s.RegisterService(new(Service1), "")
+	s.RegisterService(&HelloService{1}, "Hello")
+	s.RegisterService(&HelloService{2}, "HelloAgain")
+	if err := s.SetSafe("Service1.Multiply", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetSafe("Hello.Multiply", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetOneWay("Service1.Panic", true); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		got      []string
+		expected []string
+	}{
+		{"prefix Service1.", s.MethodsWithPrefix("Service1."), []string{"Service1.Multiply", "Service1.Panic"}},
+		{"prefix Hello.", s.MethodsWithPrefix("Hello."), []string{"Hello.Multiply"}},
+		{"prefix Hello", s.MethodsWithPrefix("Hello"), []string{"Hello.Multiply", "HelloAgain.Multiply"}},
+		{"prefix Nope.", s.MethodsWithPrefix("Nope."), nil},
+		{"safe", s.MethodsWithAnnotation(AnnotationSafe), []string{"Hello.Multiply", "Service1.Multiply"}},
+		{"oneWay", s.MethodsWithAnnotation(AnnotationOneWay), []string{"Service1.Panic"}},
+		{"unknown", s.MethodsWithAnnotation("deprecated"), nil},
+	}
+	for _, test := range tests {
+		if !reflect.DeepEqual(test.got, test.expected) {
+			t.Errorf("%s: got %v, expected %v", test.name, test.got, test.expected)
+		}
+	}
+}
+
+func TestBeforeAfterFuncs(t *testing.T) {
+	s := NewServer()
+	s.RegisterService(new(Service1), "")
+	codec := &MockMethodCodec{A: 2, B: 3}
+	s.RegisterCodec(codec, "mock")
+
+	var before, after *RequestInfo
+	s.RegisterBeforeFunc(func(i *RequestInfo) {
+		before = i
+	})
+	s.RegisterAfterFunc(func(i *RequestInfo) {
+		after = i
+	})
+
+	for _, method := range []string{"Service1.Multiply", "Service1.Divide"} {
+		before, after = nil, nil
+		codec.Method = method
+		r, _ := http.NewRequest("POST", "", nil)
+		r.Header.Set("Content-Type", "mock")
+		s.ServeHTTP(NewMockResponseWriter(), r)
+
+		if before == nil || before.Method != method || before.Request == nil {
+			t.Errorf("%s: Before Function got %+v.", method, before)
+		}
+		if after == nil || after.Method != method || after.Request == nil {
+			t.Fatalf("%s: After Function got %+v.", method, after)
+		}
+		if method == "Service1.Divide" {
+			if fault, ok := after.Error.(Fault); !ok || fault.Code != FaultCodeMethodNotFound || after.MethodInfo.Name() != "" {
+				t.Errorf("%s: After Function got error %v, should be a method not found fault.", method, after.Error)
+			}
+		} else if after.Error != nil || after.MethodInfo.Name() != method {
+			t.Errorf("%s: After Function got error %v for method %q.", method, after.Error, after.MethodInfo.Name())
+		}
+	}
+}
+
+type AnnotatedService struct{}
+
+func (t *AnnotatedService) Multiply(ctx context.Context, req *Service1Request, res *Service1Response) error {
+	res.Result = req.A * req.B
+	Annotate(ctx, "outcome", "approved")
+	return nil
+}
+
+func TestAnnotate(t *testing.T) {
+	s := NewServer()
+	s.RegisterService(new(AnnotatedService), "")
+	s.RegisterCodec(&MockMethodCodec{Method: "AnnotatedService.Multiply", A: 2, B: 3}, "mock")
+
+	var after *RequestInfo
+	s.RegisterAfterFunc(func(i *RequestInfo) {
+		after = i
+	})
+	r, _ := http.NewRequest("POST", "", nil)
+	r.Header.Set("Content-Type", "mock")
+	s.ServeHTTP(NewMockResponseWriter(), r)
+
+	if after == nil {
+		t.Fatal("After Function wasn't called.")
+	}
+	if outcome := after.Annotations["outcome"]; outcome != "approved" {
+		t.Errorf("Expected annotation outcome %q, got %v.", "approved", outcome)
+	}
+
+	// Annotating outside of a call is a no-op.
+	Annotate(context.Background(), "outcome", "ignored")
+}
+
+func TestMetricsObserver(t *testing.T) {
+	s := NewServer()
+	s.RegisterService(new(Service1), "")
+	codec := &MockMethodCodec{A: 2, B: 3}
+	s.RegisterCodec(codec, "mock")
+
+	counts := make(map[string]int)
+	errorCounts := make(map[string]int)
+	durations := make(map[string]time.Duration)
+	s.SetMetricsObserver(func(method string, duration time.Duration, err error) {
+		counts[method]++
+		durations[method] += duration
+		if err != nil {
+			errorCounts[method]++
+		}
+	})
+
+	for _, method := range []string{"Service1.Multiply", "Service1.Multiply", "Service1.Divide", "Nope.Divide"} {
+		codec.Method = method
+		r, _ := http.NewRequest("POST", "", nil)
+		r.Header.Set("Content-Type", "mock")
+		s.ServeHTTP(NewMockResponseWriter(), r)
+	}
+
+	if counts["Service1.Multiply"] != 2 || errorCounts["Service1.Multiply"] != 0 {
+		t.Errorf("Expected 2 successful Service1.Multiply calls, got %d with %d errors.", counts["Service1.Multiply"], errorCounts["Service1.Multiply"])
+	}
+	if counts[UnknownMethodLabel] != 2 || errorCounts[UnknownMethodLabel] != 2 {
+		t.Errorf("Expected 2 failed unknown calls, got %d with %d errors.", counts[UnknownMethodLabel], errorCounts[UnknownMethodLabel])
+	}
+	if len(counts) != 2 {
+		t.Errorf("Expected only the Service1.Multiply and unknown labels, got %v.", counts)
+	}
+	for method, duration := range durations {
+		if duration <= 0 {
+			t.Errorf("Expected a positive duration for %s, got %v.", method, duration)
+		}
+	}
+}
+
+func TestMetricsObserverDecodeFault(t *testing.T) {
+	s := NewServer()
+	s.RegisterService(new(Service1), "")
+	codec := &MockMethodCodec{Method: "Service1.Multiply", ReadErr: errors.New("bad args")}
+	s.RegisterCodec(codec, "mock")
+
+	var observed, after error
+	var observedMethod string
+	s.SetMetricsObserver(func(method string, duration time.Duration, err error) {
+		observedMethod, observed = method, err
+	})
+	s.RegisterAfterFunc(func(i *RequestInfo) {
+		after = i.Error
+	})
+
+	r, _ := http.NewRequest("POST", "", nil)
+	r.Header.Set("Content-Type", "mock")
+	s.ServeHTTP(NewMockResponseWriter(), r)
+
+	for name, err := range map[string]error{"observer": observed, "After Function": after} {
+		if fault, ok := err.(Fault); !ok || fault.Code != FaultCodeInvalidParams {
+			t.Errorf("Expected the %s to get an invalid params fault, got %v.", name, err)
+		}
+	}
+	if observedMethod != "Service1.Multiply" {
+		t.Errorf("Expected the observer to get Service1.Multiply, got %q.", observedMethod)
+	}
+}
+
+func TestMaxServices(t *testing.T) {
+	s := NewServer()
+	s.SetMaxServices(1)
+	if err := s.RegisterService(new(Service1), ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RegisterService(new(HelloService), ""); err == nil {
+		t.Error("Expected an error registering more services than the maximum.")
+	}
+	err := RegisterTyped(s, "Typed.Multiply", func(ctx context.Context, req *Service1Request) (*Service1Response, error) {
+		return &Service1Response{req.A * req.B}, nil
+	})
+	if err == nil {
+		t.Error("Expected an error adding a typed service beyond the maximum.")
+	}
+}
+
+func TestMaxMethodsPerService(t *testing.T) {
+	s := NewServer()
+	s.SetMaxMethodsPerService(1)
+	if err := s.RegisterService(new(Service1), ""); err == nil {
+		t.Error("Expected an error registering a service with more methods than the maximum.")
+	}
+	if err := s.RegisterService(new(HelloService), ""); err != nil {
+		t.Fatal(err)
+	}
+
+	multiply := func(ctx context.Context, req *Service1Request) (*Service1Response, error) {
+		return &Service1Response{req.A * req.B}, nil
+	}
+	if err := RegisterTyped(s, "Typed.A", multiply); err != nil {
+		t.Fatal(err)
+	}
+	if err := RegisterTyped(s, "Typed.B", multiply); err == nil {
+		t.Error("Expected an error adding more typed methods than the maximum.")
+	}
+}
+
+func TestMethodInfoReceiver(t *testing.T) {
+	s := NewServer()
+	s.RegisterService(&HelloService{7}, "")
+	RegisterTyped(s, "Typed.Multiply", func(ctx context.Context, req *Service1Request) (*Service1Response, error) {
+		return &Service1Response{req.A * req.B}, nil
+	})
+	codec := &MockMethodCodec{A: 2, B: 3}
+	s.RegisterCodec(codec, "mock")
+
+	var factor int
+	var receiver interface{}
+	s.RegisterInterceptFunc(func(i *RequestInfo) *http.Request {
+		receiver = i.MethodInfo.Receiver()
+		if hello, ok := receiver.(*HelloService); ok {
+			factor = hello.factor
+		}
+		return nil
+	})
+
+	codec.Method = "HelloService.Multiply"
+	r, _ := http.NewRequest("POST", "", nil)
+	r.Header.Set("Content-Type", "mock")
+	s.ServeHTTP(NewMockResponseWriter(), r)
+	if factor != 7 {
+		t.Errorf("Expected the intercept function to read factor 7 from the receiver, got %d.", factor)
+	}
+
+	codec.Method = "Typed.Multiply"
+	r, _ = http.NewRequest("POST", "", nil)
+	r.Header.Set("Content-Type", "mock")
+	s.ServeHTTP(NewMockResponseWriter(), r)
+	if receiver != nil {
+		t.Errorf("Expected no receiver for a typed method, got %v.", receiver)
+	}
+
+	var unknown *MethodInfo
+	if unknown.Receiver() != nil {
+		t.Error("Expected no receiver for an unknown method.")
+	}
+	if unknown.Name() != "" || unknown.ArgsType() != nil || unknown.ReplyType() != nil || unknown.PassRequest() || unknown.PassContext() {
+		t.Error("Expected zero values from the MethodInfo of an unknown method.")
+	}
+}
+
+func TestExplorer(t *testing.T) {
+	s := NewServer()
+	s.RegisterService(new(Service1), "")
+	s.RegisterService(&HelloService{2}, "Hello")
+
+	r, _ := http.NewRequest("GET", "", nil)
+	w := NewMockResponseWriter()
+	s.ServeHTTP(w, r)
+	if w.Status != 405 {
+		t.Errorf("Expected status 405 with the explorer disabled, got %d.", w.Status)
+	}
+
+	s.EnableExplorer(true)
+	w = NewMockResponseWriter()
+	s.ServeHTTP(w, r)
+	if w.Status != 200 || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") {
+		t.Fatalf("Expected an HTML page, got status %d and content type %q.", w.Status, w.Header().Get("Content-Type"))
+	}
+	for _, expected := range []string{"Service1.Multiply", "Service1.Panic", "Hello.Multiply", "<code>A</code>", "&lt;methodName&gt;Hello.Multiply&lt;/methodName&gt;"} {
+		if !strings.Contains(w.Body, expected) {
+			t.Errorf("Expected the explorer to contain %q.", expected)
+		}
+	}
+}
+
+type PartlyValidService struct{}
+
+func (t *PartlyValidService) Valid(r *http.Request, req *Service1Request, res *Service1Response) error {
+	return nil
+}
+
+func (t *PartlyValidService) Invalid(r *http.Request, req *Service1Request) error {
+	return nil
+}
+
+func (t *PartlyValidService) NoError(r *http.Request, req *Service1Request, res *Service1Response) {
+}
+
+func TestRegisteredMethods(t *testing.T) {
+	s := NewServer()
+	if err := s.RegisterService(new(PartlyValidService), ""); err != nil {
+		t.Fatal(err)
+	}
+	if methods := s.RegisteredMethods("PartlyValidService"); !reflect.DeepEqual(methods, []string{"Valid"}) {
+		t.Errorf("Expected the registered methods [Valid], got %v.", methods)
+	}
+	expected := map[string]string{
+		"Invalid": "takes 2 arguments, should take 3",
+		"NoError": "must return exactly one value, an error",
+	}
+	if rejected := s.RejectedMethods("PartlyValidService"); !reflect.DeepEqual(rejected, expected) {
+		t.Errorf("Expected the rejected methods %v, got %v.", expected, rejected)
+	}
+	if methods := s.RegisteredMethods("Missing"); methods != nil {
+		t.Errorf("Expected no methods for an unknown service, got %v.", methods)
+	}
+}
+
+func TestUnregisterService(t *testing.T) {
+	s := NewServer()
+	s.RegisterService(new(Service1), "")
+	codec := &MockMethodCodec{Method: "Service1.Multiply", A: 2, B: 3}
+	s.RegisterCodec(codec, "mock")
+	serve := func() *MockResponseWriter {
+		r, _ := http.NewRequest("POST", "", nil)
+		r.Header.Set("Content-Type", "mock")
+		w := NewMockResponseWriter()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := serve(); codec.Err != nil || w.Body != "6" {
+		t.Fatalf("Expected the call to succeed, got %q with error %v.", w.Body, codec.Err)
+	}
+	if err := s.UnregisterService("Service1"); err != nil {
+		t.Fatal(err)
+	}
+	serve()
+	if fault, ok := codec.Err.(Fault); !ok || fault.Code != FaultCodeMethodNotFound {
+		t.Errorf("Expected a method not found fault after unregistering, got %v.", codec.Err)
+	}
+	if err := s.UnregisterService("Service1"); err == nil {
+		t.Error("Expected an error unregistering an unknown service.")
+	}
+
+	s.RegisterDefaultService(new(Service1), "Service1")
+	codec.Method = "Multiply"
+	if serve(); codec.Err != nil {
+		t.Fatalf("Expected the default service call to succeed, got %v.", codec.Err)
+	}
+	if err := s.UnregisterService("Service1"); err != nil {
+		t.Fatal(err)
+	}
+	serve()
+	if fault, ok := codec.Err.(Fault); !ok || fault.Code != FaultCodeMethodNotFound {
+		t.Errorf("Expected a method not found fault after unregistering the default service, got %v.", codec.Err)
+	}
+}
@@ -0,0 +1,54 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// TypeValidator is implemented by codecs able to check ahead of time that
+// they can decode args of a type and encode replies of another.
+type TypeValidator interface {
+	ValidateTypes(argsType, replyType reflect.Type) error
+}
+
+// ValidateTypes checks that the args and reply types of every registered
+// method work with every registered codec implementing TypeValidator, so
+// types failing at runtime, e.g. with fields of unsupported kinds, can be
+// caught at startup. The returned error lists all the problems found.
+func (s *Server) ValidateTypes() error {
+	contentTypes := make([]string, 0, len(s.codecs))
+	for contentType := range s.codecs {
+		contentTypes = append(contentTypes, contentType)
+	}
+	sort.Strings(contentTypes)
+	methods := s.services.methodNames()
+	sort.Strings(methods)
+
+	var problems []string
+	for _, method := range methods {
+		_, methodSpec, err := s.services.get(method)
+		if err != nil {
+			continue
+		}
+		for _, contentType := range contentTypes {
+			validator, ok := s.codecs[contentType].(TypeValidator)
+			if !ok {
+				continue
+			}
+			if err := validator.ValidateTypes(methodSpec.argsType, methodSpec.replyType); err != nil {
+				problems = append(problems, fmt.Sprintf("%s (%s): %v", method, contentType, err))
+			}
+		}
+	}
+	if problems != nil {
+		return fmt.Errorf("rpc: invalid types: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
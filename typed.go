@@ -0,0 +1,36 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"net/http"
+)
+
+// RegisterTyped registers fn as a method of the server, with its args and
+// reply types checked at compile time.
+//
+// The name uses a dotted notation as in "Service.Method". Several typed
+// methods can be registered on the same service, which must not have been
+// registered with RegisterService. fn receives the context of the HTTP
+// request, and a nil reply leaves the zero reply.
+func RegisterTyped[Args, Reply any](srv *Server, name string, fn func(context.Context, *Args) (*Reply, error)) error {
+	return srv.services.registerFunc(&typedMethod[Args, Reply]{fn}, name)
+}
+
+// typedMethod adapts a typed function to the method signature expected by
+// the server.
+type typedMethod[Args, Reply any] struct {
+	fn func(context.Context, *Args) (*Reply, error)
+}
+
+func (t *typedMethod[Args, Reply]) Call(r *http.Request, args *Args, reply *Reply) error {
+	res, err := t.fn(r.Context(), args)
+	if res != nil {
+		*reply = *res
+	}
+	return err
+}
@@ -0,0 +1,57 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import "strings"
+
+// SetAllowedUserAgents restricts the server to clients whose User-Agent
+// matches one of the patterns. Other clients receive an unauthorized fault,
+// sent with a 403 Forbidden status. An empty list, the default, allows all
+// clients.
+//
+// A pattern without a "*" matches the User-Agents it prefixes, so
+// "USSDGateway" matches "USSDGateway/2.1". Otherwise "*" matches any run of
+// characters, as in "*Gateway/2.*".
+func (s *Server) SetAllowedUserAgents(patterns []string) {
+	s.userAgents = append([]string(nil), patterns...)
+}
+
+// allowedUserAgent reports whether the User-Agent matches the allowed
+// patterns.
+func (s *Server) allowedUserAgent(userAgent string) bool {
+	if len(s.userAgents) == 0 {
+		return true
+	}
+	for _, pattern := range s.userAgents {
+		if !strings.Contains(pattern, "*") {
+			if strings.HasPrefix(userAgent, pattern) {
+				return true
+			}
+		} else if matchGlob(pattern, userAgent) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchGlob reports whether s matches the pattern, in which "*" matches any
+// run of characters.
+func matchGlob(pattern, s string) bool {
+	parts := strings.Split(pattern, "*")
+	if !strings.HasPrefix(s, parts[0]) {
+		return false
+	}
+	s = s[len(parts[0]):]
+	last := parts[len(parts)-1]
+	for _, part := range parts[1 : len(parts)-1] {
+		idx := strings.Index(s, part)
+		if idx == -1 {
+			return false
+		}
+		s = s[idx+len(part):]
+	}
+	return len(parts) > 1 && strings.HasSuffix(s, last)
+}
@@ -0,0 +1,62 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"errors"
+	"strings"
+)
+
+// Validator is implemented by args validating themselves once decoded.
+//
+// Calls with invalid args get an invalid params fault carrying the
+// message of the error. If the error is, or wraps, a ValidationErrors, the
+// fault detail also lists the invalid fields in its fields member, as an
+// array of structs with the field and message members.
+type Validator interface {
+	Validate() error
+}
+
+// FieldError describes why a field of the args is invalid.
+type FieldError struct {
+	Field   string
+	Message string
+}
+
+// ValidationErrors is an error listing the invalid fields of the args.
+type ValidationErrors []FieldError
+
+// Error satisfies the error interface for ValidationErrors.
+func (e ValidationErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, f := range e {
+		msgs[i] = f.Field + ": " + f.Message
+	}
+	return "invalid params: " + strings.Join(msgs, "; ")
+}
+
+// validateArgs validates the args, if they implement Validator, returning
+// a fault if they are invalid.
+func validateArgs(args interface{}) error {
+	v, ok := args.(Validator)
+	if !ok {
+		return nil
+	}
+	err := v.Validate()
+	if err == nil {
+		return nil
+	}
+	fault := Fault{Code: FaultCodeInvalidParams, Message: err.Error()}
+	var fieldErrs ValidationErrors
+	if errors.As(err, &fieldErrs) {
+		fields := make([]map[string]interface{}, len(fieldErrs))
+		for i, f := range fieldErrs {
+			fields[i] = map[string]interface{}{"field": f.Field, "message": f.Message}
+		}
+		fault.Detail = map[string]interface{}{"fields": fields}
+	}
+	return fault
+}
@@ -0,0 +1,107 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+)
+
+// Directions passed to the wire tap.
+const (
+	WireRequest  = "request"
+	WireResponse = "response"
+)
+
+// SetWireTap registers tap to receive the raw request and response bodies
+// of every call, e.g. to troubleshoot partner integrations. Bodies are
+// truncated to maxBytes; zero means no limit. Pass a nil tap to disable it.
+//
+// The tap is called once the response has been written. It may sample the
+// calls it records, but must not retain body after returning.
+func (s *Server) SetWireTap(tap func(direction string, body []byte, r *http.Request), maxBytes int) {
+	s.wireTap = tap
+	s.wireTapLimit = maxBytes
+}
+
+// SetWireTapOnError restricts the wire tap to failed calls: calls answered
+// with a fault or an HTTP error status. Bodies are still captured for every
+// call, but only passed to the tap when the call fails.
+func (s *Server) SetWireTapOnError(onError bool) {
+	s.wireTapErrors = onError
+}
+
+// tap wraps the request body and the ResponseWriter to capture the raw
+// bytes, and returns a function passing them to the wire tap.
+func (s *Server) tap(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, func(r *http.Request)) {
+	reqBody := &cappedBuffer{limit: s.wireTapLimit}
+	if r.Body != nil {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.TeeReader(r.Body, reqBody), r.Body}
+	}
+	tw := &tapResponseWriter{ResponseWriter: w, body: cappedBuffer{limit: s.wireTapLimit}}
+	return tw, func(r *http.Request) {
+		if s.wireTapErrors && !tw.failed && tw.status < 400 {
+			return
+		}
+		s.wireTap(WireRequest, reqBody.buf.Bytes(), r)
+		s.wireTap(WireResponse, tw.body.buf.Bytes(), r)
+	}
+}
+
+// cappedBuffer keeps up to limit bytes written to it and discards the rest.
+// A zero limit means no limit.
+type cappedBuffer struct {
+	limit int
+	buf   bytes.Buffer
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	if b.limit > 0 && b.buf.Len()+n > b.limit {
+		p = p[:b.limit-b.buf.Len()]
+	}
+	b.buf.Write(p)
+	return n, nil
+}
+
+// tapResponseWriter copies the response body into a cappedBuffer, and
+// records whether the call failed.
+type tapResponseWriter struct {
+	http.ResponseWriter
+	body   cappedBuffer
+	status int
+	failed bool
+}
+
+func (w *tapResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *tapResponseWriter) Write(p []byte) (int, error) {
+	w.body.Write(p)
+	return w.ResponseWriter.Write(p)
+}
+
+// Flush flushes the underlying ResponseWriter, if it is an http.Flusher.
+func (w *tapResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// markFailed flags the call written to w as failed for the wire tap.
+func markFailed(w http.ResponseWriter) {
+	if tw, ok := w.(*tapResponseWriter); ok {
+		tw.failed = true
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright 2013 Ivan Danyliuk
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xml
+
+import (
+	"context"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// Blob is the type of args fields receiving a <base64> value decoded into a
+// writer, instead of into a []byte. The request, base64 text included, is
+// still read into memory as a whole, but its decoded bytes needn't be.
+type Blob struct {
+	// Writer received the decoded bytes. It is the writer returned by the
+	// codec's blob writer function, or else a temporary *os.File rewound
+	// to its start. The codec closes and removes the temporary file once
+	// the response of the call is written, or the HTTP request is done, so
+	// the method must not use it past its return.
+	Writer io.Writer
+	// Size is the number of decoded bytes.
+	Size int64
+}
+
+var typeOfBlob = reflect.TypeOf(Blob{})
+
+// base642Blob decodes the base64 value of the named member into a writer
+// and stores it in the Blob field.
+func (d *decoder) base642Blob(value value, field *reflect.Value, name string) error {
+	var w io.Writer
+	if d.blobWriter != nil {
+		var err error
+		if w, err = d.blobWriter(name); err != nil {
+			return err
+		}
+	} else {
+		f, err := ioutil.TempFile("", "xmlrpc-blob-")
+		if err != nil {
+			return err
+		}
+		d.blobs.add(f)
+		w = f
+	}
+	n, err := io.Copy(w, base64.NewDecoder(base64.StdEncoding, strings.NewReader(value.Base64)))
+	if err != nil {
+		fault := FaultInvalidParams
+		fault.String += ": " + err.Error()
+		return fault
+	}
+	if f, ok := w.(*os.File); ok {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+	}
+	field.Set(reflect.ValueOf(Blob{Writer: w, Size: n}))
+	return nil
+}
+
+// tempBlobs holds the temporary files of the Blob fields decoded for a
+// request.
+type tempBlobs struct {
+	ctx      context.Context // context of the HTTP request
+	mutex    sync.Mutex
+	files    []*os.File
+	released bool
+}
+
+// decodeBlobs runs decode with a copy of the decoder keeping the temporary
+// files of the Blob fields it decodes in blobs. The files of a failed
+// decode are removed right away.
+func (d decoder) decodeBlobs(blobs *tempBlobs, decode func(d *decoder) error) error {
+	decoded := new(tempBlobs)
+	d.blobs = decoded
+	if err := decode(&d); err != nil {
+		decoded.release()
+		return err
+	}
+	blobs.keep(decoded)
+	return nil
+}
+
+// add keeps the file f.
+func (b *tempBlobs) add(f *os.File) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.files = append(b.files, f)
+}
+
+// keep moves the files of a successful decode into b, to be removed once
+// the context of the request is done, if not released before. A nil b
+// leaves the files to the caller.
+func (b *tempBlobs) keep(decoded *tempBlobs) {
+	if b == nil || len(decoded.files) == 0 {
+		return
+	}
+	b.mutex.Lock()
+	watch := len(b.files) == 0
+	b.files = append(b.files, decoded.files...)
+	released := b.released
+	b.mutex.Unlock()
+	switch {
+	case released:
+		b.release()
+	case watch && b.ctx != nil && b.ctx.Done() != nil:
+		go func() {
+			<-b.ctx.Done()
+			b.release()
+		}()
+	}
+}
+
+// release closes and removes the files.
+func (b *tempBlobs) release() {
+	if b == nil {
+		return
+	}
+	b.mutex.Lock()
+	files := b.files
+	b.files, b.released = nil, true
+	b.mutex.Unlock()
+	for _, f := range files {
+		f.Close()
+		os.Remove(f.Name())
+	}
+}
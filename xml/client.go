@@ -15,12 +15,75 @@ func EncodeClientRequest(method string, args interface{}) ([]byte, error) {
 	return []byte(xml), err
 }
 
+// ClientEncoder encodes the bodies of client requests with encoding
+// options. Its zero value encodes like EncodeClientRequest.
+type ClientEncoder struct {
+	encoder encoder
+}
+
+// NewClientEncoder returns a new ClientEncoder.
+func NewClientEncoder() *ClientEncoder {
+	return new(ClientEncoder)
+}
+
+// SetI4 makes the encoder send int values as <i4> rather than <int>, its
+// synonym, for servers only accepting one of them. <int> is the default.
+func (e *ClientEncoder) SetI4(i4 bool) {
+	e.encoder.i4 = i4
+}
+
+// EncodeRequest encodes parameters for a XML-RPC client request.
+func (e *ClientEncoder) EncodeRequest(method string, args interface{}) ([]byte, error) {
+	xml, err := e.encoder.rpcRequest2XML(method, args)
+	return []byte(xml), err
+}
+
 // DecodeClientResponse decodes the response body of a client request into
 // the interface reply.
 func DecodeClientResponse(r io.Reader, reply interface{}) error {
+	return DecodeClientResponseDetail(r, reply, nil)
+}
+
+// DecodeClientResponseDetail works like DecodeClientResponse. When the
+// server replies with a fault, the members beyond faultCode and faultString
+// are decoded into detail, which must be a pointer to a struct or a map, and
+// the returned Fault carries detail in its Detail field.
+func DecodeClientResponseDetail(r io.Reader, reply, detail interface{}) error {
+	return new(ClientDecoder).DecodeResponseDetail(r, reply, detail)
+}
+
+// ClientDecoder decodes the response bodies of client requests with the
+// decoding options of the codec. Its zero value decodes like
+// DecodeClientResponse.
+type ClientDecoder struct {
+	decoder decoder
+}
+
+// NewClientDecoder returns a new ClientDecoder.
+func NewClientDecoder() *ClientDecoder {
+	return new(ClientDecoder)
+}
+
+// SetLenientBools makes the decoder accept an <int>, <i4> or <i8> into a
+// bool field, zero being false and any other value true, for servers
+// sending booleans as integers.
+func (d *ClientDecoder) SetLenientBools(lenient bool) {
+	d.decoder.lenientBools = lenient
+}
+
+// DecodeResponse decodes the response body of a client request into the
+// interface reply.
+func (d *ClientDecoder) DecodeResponse(r io.Reader, reply interface{}) error {
+	return d.DecodeResponseDetail(r, reply, nil)
+}
+
+// DecodeResponseDetail works like DecodeClientResponseDetail.
+func (d *ClientDecoder) DecodeResponseDetail(r io.Reader, reply, detail interface{}) error {
 	rawxml, err := ioutil.ReadAll(r)
 	if err != nil {
 		return FaultSystemError
 	}
-	return xml2RPC(string(rawxml), reply)
+	return d.decoder.decodeBlobs(nil, func(d *decoder) error {
+		return d.xml2RPC(string(rawxml), reply, detail)
+	})
 }
@@ -6,6 +6,7 @@ package xml
 
 import (
 	"fmt"
+	"reflect"
 )
 
 // Default Faults
@@ -21,9 +22,15 @@ var (
 )
 
 // Fault represents XML-RPC Fault.
+//
+// Detail optionally carries extra fault members sent after faultCode and
+// faultString. On the server it may be a struct (or a pointer to one) or a
+// map with string keys; on the client it holds the value passed to
+// DecodeClientResponseDetail.
 type Fault struct {
-	Code   int    `xml:"faultCode"`
-	String string `xml:"faultString"`
+	Code   int         `xml:"faultCode"`
+	String string      `xml:"faultString"`
+	Detail interface{} `xml:"-"`
 }
 
 // Error satisifies error interface for Fault.
@@ -32,14 +39,36 @@ func (f Fault) Error() string {
 }
 
 // Fault2XML is a quick 'marshalling' replacemnt for the Fault case.
-func fault2XML(fault Fault) string {
-	buffer := "<methodResponse><fault>"
-	xml, _ := rpc2XML(fault)
-	buffer += xml
-	buffer += "</fault></methodResponse>"
+func (e *encoder) fault2XML(fault Fault) string {
+	return "<methodResponse><fault>" + e.faultValue2XML(fault) + "</fault></methodResponse>"
+}
+
+// faultValue2XML encodes the struct value of a fault.
+func (e *encoder) faultValue2XML(fault Fault) string {
+	buffer := "<value><struct>"
+	code, _ := e.rpc2XML(fault.Code)
+	buffer += "<member><name>faultCode</name>" + code + "</member>"
+	str, _ := e.rpc2XML(fault.String)
+	buffer += "<member><name>faultString</name>" + str + "</member>"
+	if fault.Detail != nil {
+		detail, _ := e.members2XML(reflect.ValueOf(fault.Detail))
+		buffer += detail
+	}
+	buffer += "</struct></value>"
 	return buffer
 }
 
+// encodeFailure returns the fault replacing a reply that failed to encode
+// with err.
+func (e *encoder) encodeFailure(err error) Fault {
+	if e.encodeFault != nil {
+		return *e.encodeFault
+	}
+	fault := FaultInternalError
+	fault.String += fmt.Sprintf(": %v", err)
+	return fault
+}
+
 type faultValue struct {
 	Value value `xml:"value"`
 }
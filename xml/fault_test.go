@@ -82,3 +82,47 @@ func TestFaults(t *testing.T) {
 		t.Errorf("wrong response: %s", fault.String)
 	}
 }
+
+type FaultDetail struct {
+	Retryable bool   `xml:"retryable"`
+	Detail    string `xml:"detail"`
+}
+
+type FaultDetailTest struct {
+}
+
+func (t *FaultDetailTest) Charge(r *http.Request, req *FaultTestRequest, res *FaultTestResponse) error {
+	return Fault{Code: 503, String: "Billing unavailable", Detail: FaultDetail{true, "upstream timeout"}}
+}
+
+func TestFaultDetail(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "text/xml")
+	s.RegisterService(new(FaultDetailTest), "")
+
+	var res FaultTestResponse
+	var detail FaultDetail
+	err := executeDetail(t, s, "FaultDetailTest.Charge", &FaultTestRequest{4, 2}, &res, &detail)
+	fault, ok := err.(Fault)
+	if !ok {
+		t.Fatal("expected error to be of concrete type Fault, but got", err)
+	}
+	if fault.Code != 503 || fault.String != "Billing unavailable" {
+		t.Errorf("wrong fault: %v", fault)
+	}
+	if !detail.Retryable || detail.Detail != "upstream timeout" {
+		t.Errorf("wrong fault detail: %+v", detail)
+	}
+
+	members := map[string]interface{}{}
+	err = executeDetail(t, s, "FaultDetailTest.Charge", &FaultTestRequest{4, 2}, &res, &members)
+	if _, ok := err.(Fault); !ok {
+		t.Fatal("expected error to be of concrete type Fault, but got", err)
+	}
+	if members["retryable"] != true || members["detail"] != "upstream timeout" {
+		t.Errorf("wrong fault members: %v", members)
+	}
+	if _, ok := members["faultCode"]; ok {
+		t.Errorf("faultCode should not be part of the fault detail")
+	}
+}
@@ -0,0 +1,126 @@
+// Copyright 2013 Ivan Danyliuk
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xml
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/mudphilo/go-xml-rpc"
+	"github.com/rogpeppe/go-charset/charset"
+)
+
+// Calls returns the sub-calls of a system.multicall request, whose single
+// param is an array of structs with the methodName and params members.
+//
+// Only the first of the params of a sub-call is decoded, as for single
+// calls.
+func (c *CodecRequest) Calls() ([]rpc.CodecRequest, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	var ret response
+	decoder := xml.NewDecoder(strings.NewReader(c.request.rawxml))
+	decoder.CharsetReader = charset.NewReader
+	if err := decoder.Decode(&ret); err != nil {
+		return nil, FaultDecode
+	}
+	if len(ret.Params) == 0 {
+		return nil, fmt.Errorf("rpc: system.multicall without an array of calls")
+	}
+	calls := make([]rpc.CodecRequest, 0, len(ret.Params[0].Value.Array))
+	for _, v := range ret.Params[0].Value.Array {
+		call := &multicallRequest{decoder: c.decoder, blobs: c.blobs}
+		for _, m := range v.Struct {
+			switch m.Name {
+			case "methodName":
+				call.method = m.Value.String
+				if call.method == "" {
+					call.method = m.Value.Raw
+				}
+				call.method = strings.TrimSpace(call.method)
+				if method, ok := c.aliases[call.method]; ok {
+					call.method = method
+				}
+			case "params":
+				call.params = m.Value.Array
+			}
+		}
+		calls = append(calls, call)
+	}
+	return calls, nil
+}
+
+// WriteMulticallResponse encodes the replies of the sub-calls of a
+// system.multicall request as an array. The reply of a successful call is
+// wrapped in a single element array, while a failed call is replaced by a
+// struct with the faultCode and faultString members.
+func (c *CodecRequest) WriteMulticallResponse(w http.ResponseWriter, replies []interface{}, errs []error) error {
+	// The sub-calls are done with the Blob fields of their args.
+	defer c.blobs.release()
+	buffer := ""
+	for i, reply := range replies {
+		if errs[i] != nil {
+			buffer += c.encoder.faultValue2XML(error2Fault(errs[i]))
+			continue
+		}
+		value, err := c.encoder.rpcParams2XML(reply, nil)
+		if err != nil {
+			buffer += c.encoder.faultValue2XML(c.encoder.encodeFailure(err))
+			continue
+		}
+		buffer += "<value><array><data>" + value + "</data></array></value>"
+	}
+
+	wrapper := c.encoder.responseWrapper
+	if wrapper == nil {
+		wrapper = paramsWrapper
+	}
+	xmlstr := "<methodResponse>"
+	for _, name := range wrapper {
+		xmlstr += "<" + name + ">"
+	}
+	xmlstr += "<value><array><data>" + buffer + "</data></array></value>"
+	for i := len(wrapper) - 1; i >= 0; i-- {
+		xmlstr += "</" + wrapper[i] + ">"
+	}
+	xmlstr += "</methodResponse>"
+	return c.encoder.write(w, xmlstr)
+}
+
+// multicallRequest is a sub-call of a system.multicall request.
+type multicallRequest struct {
+	method  string
+	params  []value
+	decoder *decoder
+	blobs   *tempBlobs
+}
+
+// Method returns the RPC method of the sub-call.
+func (c *multicallRequest) Method() (string, error) {
+	if c.method == "" {
+		return "", errors.New("rpc: sub-call without a methodName")
+	}
+	return c.method, nil
+}
+
+// ReadRequest fills the args of the sub-call from its first param.
+func (c *multicallRequest) ReadRequest(args interface{}) error {
+	if len(c.params) == 0 {
+		return nil
+	}
+	return c.decoder.decodeBlobs(c.blobs, func(d *decoder) error {
+		return d.value2RPC(c.params[0], args)
+	})
+}
+
+// WriteResponse fails, as the replies of sub-calls are written together by
+// WriteMulticallResponse.
+func (c *multicallRequest) WriteResponse(w http.ResponseWriter, response interface{}, methodErr error) error {
+	return errors.New("rpc: sub-calls are written with their system.multicall")
+}
@@ -5,125 +5,307 @@
 package xml
 
 import (
+	"encoding"
 	"encoding/base64"
-	"encoding/json"
 	"fmt"
-	"log"
+	"math"
+	"math/big"
 	"reflect"
+	"sort"
 	"strings"
 	"time"
 )
 
+// encoder converts Go values into their XML-RPC representation.
+type encoder struct {
+	// fallback converts values of unsupported types into values the
+	// encoder supports natively.
+	fallback func(reflect.Value) (interface{}, error)
+	// stringifyKeys allows maps with keys other than strings.
+	stringifyKeys bool
+	// cdata wraps strings in CDATA sections instead of escaping them.
+	cdata bool
+	// offsets appends the timezone offset to dateTime values.
+	offsets bool
+	// compactInts encodes 64-bit integers fitting in 32 bits as <int>.
+	compactInts bool
+	// i4 encodes 32-bit integers as <i4> rather than <int>.
+	i4 bool
+	// allowNil encodes nil pointers as <nil/>. Otherwise nil pointer
+	// fields are left out of their struct.
+	allowNil bool
+	// view selects the fields tagged with a view option to encode.
+	view string
+	// responseWrapper holds the names of the elements wrapping the value
+	// of responses, outermost first, params and param if nil.
+	responseWrapper []string
+	// encodeFault replaces replies that fail to encode, an internal error
+	// fault if nil.
+	encodeFault *Fault
+	// charset is the charset responses are encoded in and declare, none
+	// and UTF-8 if empty.
+	charset string
+}
+
+// paramsWrapper holds the names of the elements wrapping the value of
+// calls and responses, per the spec.
+var paramsWrapper = []string{"params", "param"}
+
 func rpcRequest2XML(method string, rpc interface{}) (string, error) {
+	return new(encoder).rpcRequest2XML(method, rpc)
+}
+
+func rpcResponse2XML(rpc interface{}) (string, error) {
+	return new(encoder).rpcResponse2XML(rpc)
+}
+
+func (e *encoder) rpcRequest2XML(method string, rpc interface{}) (string, error) {
 	buffer := "<methodCall><methodName>"
 	buffer += method
 	buffer += "</methodName>"
-	params, err := rpcParams2XML(rpc)
+	params, err := e.rpcParams2XML(rpc, paramsWrapper)
 	buffer += params
 	buffer += "</methodCall>"
 	return buffer, err
 }
 
-func getStructTag(f reflect.StructField,tagType string) string {
-
-	parts := strings.Split(string(f.Tag)," ")
-	tagName := ""
-
-	for _, tag := range parts {
-
-		prefix := fmt.Sprintf("%s:",tagType)
-
-		if !strings.HasPrefix(tag,prefix) {
-
-			continue
-		}
-		//json:"name_field"
-		buff := strings.ReplaceAll(tag,prefix,"")
-		buff = strings.ReplaceAll(buff,"\"","")
-		tagName = buff
-		break
+func (e *encoder) rpcResponse2XML(rpc interface{}) (string, error) {
+	wrapper := e.responseWrapper
+	if wrapper == nil {
+		wrapper = paramsWrapper
 	}
-
-	return tagName
-}
-
-func rpcResponse2XML(rpc interface{}) (string, error) {
-
-	js, _ := json.Marshal(rpc)
-	log.Printf("wants to send back a response %s",js)
-
 	buffer := "<methodResponse>"
-	params, err := rpcParams2XML(rpc)
+	params, err := e.rpcParams2XML(rpc, wrapper)
 	buffer += params
 	buffer += "</methodResponse>"
 	return buffer, err
 }
 
-func rpcParams2XML(rpc interface{}) (string, error) {
+// rpcParams2XML encodes rpc as a struct value, wrapped in the elements
+// named by wrapper. rpc points to a struct, or to a value of another type
+// encoded as is.
+func (e *encoder) rpcParams2XML(rpc interface{}, wrapper []string) (string, error) {
 
 	var err error
-	buffer := "<params><param><value><struct>"
-
-	for i := 0; i < reflect.ValueOf(rpc).Elem().NumField(); i++ {
+	buffer := ""
+	for _, name := range wrapper {
+		buffer += "<" + name + ">"
+	}
 
+	v := reflect.ValueOf(rpc).Elem()
+	if v.Kind() != reflect.Struct {
 		var xml string
-		xml, err = rpc2XML(reflect.ValueOf(rpc).Elem().Field(i).Interface())
-		if err != nil {
-
-			log.Printf("error retrieving fileds value %s",err.Error())
-			continue
+		xml, err = e.rpc2XML(v.Interface())
+		buffer += xml
+		for i := len(wrapper) - 1; i >= 0; i-- {
+			buffer += "</" + wrapper[i] + ">"
 		}
+		return buffer, err
+	}
 
-		fieldName := "INVALID_FIELD_NAME"
-
-		fName := getStructTag(reflect.TypeOf(rpc).Elem().Field(i),"xml")
-		if len(fName) > 0 {
+	buffer += "<value><struct>"
+	plan := planFor(v.Type())
+	for i := range plan.fields {
 
-			fieldName = fName
+		f := &plan.fields[i]
+		if !e.inView(f) || e.omitNil(v.Field(f.index)) {
+			continue
+		}
+		var xml string
+		xml, err := e.field2XML(v.Field(f.index), f)
+		if err != nil {
+			return "", err
 		}
 
 		buffer += "<member>"
-		buffer += "<name>"+fieldName+"</name>" + xml
+		buffer += "<name>"+f.name+"</name>" + xml
 		buffer += "</member>"
 	}
 
-	buffer += "</struct></value></param></params>"
+	buffer += "</struct></value>"
+	for i := len(wrapper) - 1; i >= 0; i-- {
+		buffer += "</" + wrapper[i] + ">"
+	}
 	return buffer, err
 }
 
-func rpc2XML(value interface{}) (string, error) {
+func (e *encoder) rpc2XML(value interface{}) (string, error) {
+	var err error
 	out := "<value>"
+	switch b := value.(type) {
+	case *big.Int:
+		if b != nil {
+			return out + bigInt2XML(b) + "</value>", nil
+		}
+	case big.Int:
+		return out + bigInt2XML(&b) + "</value>", nil
+	}
 	switch reflect.ValueOf(value).Kind() {
+	case reflect.Invalid:
 	case reflect.Int:
-		out += fmt.Sprintf("<int>%d</int>", value.(int))
-	case reflect.Float64:
-		out += fmt.Sprintf("<double>%f</double>", value.(float64))
+		out += e.goInt2XML(reflect.ValueOf(value).Int())
+	case reflect.Int8, reflect.Int16, reflect.Int32:
+		out += e.int2XML(reflect.ValueOf(value).Int())
+	case reflect.Int64:
+		out += e.int642XML(reflect.ValueOf(value).Int())
+	case reflect.Uint8, reflect.Uint16:
+		out += e.int2XML(int64(reflect.ValueOf(value).Uint()))
+	case reflect.Uint, reflect.Uint32, reflect.Uint64:
+		u := reflect.ValueOf(value).Uint()
+		if u > math.MaxInt64 {
+			return "", fmt.Errorf("xml: %d overflows <i8>", u)
+		}
+		out += e.int642XML(int64(u))
+	case reflect.Float32, reflect.Float64:
+		out += fmt.Sprintf("<double>%f</double>", reflect.ValueOf(value).Float())
 	case reflect.String:
-		out += string2XML(value.(string))
+		if e.cdata {
+			out += cdata2XML(value.(string))
+		} else {
+			out += string2XML(value.(string))
+		}
 	case reflect.Bool:
 		out += bool2XML(value.(bool))
 	case reflect.Struct:
 		if reflect.TypeOf(value).String() != "time.Time" {
-			out += struct2XML(value)
+			var xml string
+			xml, err = e.struct2XML(value)
+			out += xml
 		} else {
-			out += time2XML(value.(time.Time))
+			out += e.time2XML(value.(time.Time))
 		}
+	case reflect.Map:
+		var xml string
+		xml, err = e.struct2XML(value)
+		out += xml
 	case reflect.Slice, reflect.Array:
 		// FIXME: is it the best way to recognize '[]byte'?
 		if reflect.TypeOf(value).String() != "[]uint8" {
-			out += array2XML(value)
+			var xml string
+			xml, err = e.array2XML(value)
+			out += xml
 		} else {
 			out += base642XML(value.([]byte))
 		}
 	case reflect.Ptr:
-		if reflect.ValueOf(value).IsNil() {
-			out += "<nil/>"
+		v := reflect.ValueOf(value)
+		if !v.IsNil() {
+			return e.rpc2XML(v.Elem().Interface())
+		}
+		if !e.allowNil {
+			return "", fmt.Errorf("xml: nil %s without the <nil/> extension", v.Type())
 		}
+		out += "<nil/>"
+	default:
+		return e.fallback2XML(value)
+	}
+	if err != nil {
+		return "", err
 	}
 	out += "</value>"
 	return out, nil
 }
 
+// inView reports whether the field is encoded in the view of the encoder.
+// Fields without a view option are always encoded.
+func (e *encoder) inView(f *fieldPlan) bool {
+	return !f.hasView || f.view == e.view
+}
+
+// omitNil reports whether the field is a nil pointer, at any level of
+// indirection as in a **string, left out of its struct as the encoder
+// doesn't allow <nil/>.
+func (e *encoder) omitNil(field reflect.Value) bool {
+	if e.allowNil {
+		return false
+	}
+	for field.Kind() == reflect.Ptr {
+		if field.IsNil() {
+			return true
+		}
+		field = field.Elem()
+	}
+	return false
+}
+
+// field2XML encodes a struct field, applying the options of its xmlrpc tag.
+func (e *encoder) field2XML(field reflect.Value, f *fieldPlan) (string, error) {
+	return f.encode(e, field)
+}
+
+// newFieldEncoder returns the encoder of fields of type t with the options
+// of f. Strings, booleans and sized integers are encoded straight from the
+// field, other types through rpc2XML.
+func newFieldEncoder(t reflect.Type, f *fieldPlan) fieldEncoder {
+	if f.options["datetime"] == "unix" {
+		switch t.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			return func(e *encoder, field reflect.Value) (string, error) {
+				return e.rpc2XML(time.Unix(field.Int(), 0))
+			}
+		}
+	}
+	if unit, ok := f.epochUnit(); ok && t == typeOfTime {
+		return func(e *encoder, field reflect.Value) (string, error) {
+			at := field.Interface().(time.Time)
+			n := at.Unix()
+			if unit == time.Millisecond {
+				n = at.UnixMilli()
+			}
+			return "<value>" + e.int642XML(n) + "</value>", nil
+		}
+	}
+	if _, ok := f.options["cdata"]; ok && t.Kind() == reflect.String {
+		return func(e *encoder, field reflect.Value) (string, error) {
+			return "<value>" + cdata2XML(field.String()) + "</value>", nil
+		}
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return func(e *encoder, field reflect.Value) (string, error) {
+			if e.cdata {
+				return "<value>" + cdata2XML(field.String()) + "</value>", nil
+			}
+			return "<value>" + string2XML(field.String()) + "</value>", nil
+		}
+	case reflect.Bool:
+		return func(e *encoder, field reflect.Value) (string, error) {
+			return "<value>" + bool2XML(field.Bool()) + "</value>", nil
+		}
+	case reflect.Int:
+		return func(e *encoder, field reflect.Value) (string, error) {
+			return "<value>" + e.goInt2XML(field.Int()) + "</value>", nil
+		}
+	case reflect.Int8, reflect.Int16, reflect.Int32:
+		return func(e *encoder, field reflect.Value) (string, error) {
+			return "<value>" + e.int2XML(field.Int()) + "</value>", nil
+		}
+	case reflect.Int64:
+		return func(e *encoder, field reflect.Value) (string, error) {
+			return "<value>" + e.int642XML(field.Int()) + "</value>", nil
+		}
+	}
+	return func(e *encoder, field reflect.Value) (string, error) {
+		return e.rpc2XML(field.Interface())
+	}
+}
+
+// fallback2XML encodes a value of a type the encoder doesn't support
+// natively, using the replacement value returned by the fallback encoder.
+func (e *encoder) fallback2XML(value interface{}) (string, error) {
+	if e.fallback == nil {
+		return "", fmt.Errorf("xml: unsupported type %s", reflect.TypeOf(value))
+	}
+	replacement, err := e.fallback(reflect.ValueOf(value))
+	if err != nil {
+		return "", err
+	}
+	if reflect.TypeOf(replacement) == reflect.TypeOf(value) {
+		return "", fmt.Errorf("xml: fallback encoder returned unsupported type %s", reflect.TypeOf(value))
+	}
+	return e.rpc2XML(replacement)
+}
+
 func bool2XML(value bool) string {
 	var b string
 	if value {
@@ -135,42 +317,126 @@ func bool2XML(value bool) string {
 }
 
 func string2XML(value string) string {
+	return fmt.Sprintf("<string>%s</string>", escapeXML(value))
+}
+
+// cdata2XML wraps the string in a CDATA section. Any "]]>" in the string
+// is split across two sections, as it would otherwise end the first one.
+func cdata2XML(value string) string {
+	value = strings.Replace(value, "]]>", "]]]]><![CDATA[>", -1)
+	return fmt.Sprintf("<string><![CDATA[%s]]></string>", value)
+}
+
+func escapeXML(value string) string {
 	value = strings.Replace(value, "&", "&amp;", -1)
 	value = strings.Replace(value, "\"", "&quot;", -1)
 	value = strings.Replace(value, "<", "&lt;", -1)
 	value = strings.Replace(value, ">", "&gt;", -1)
-	return fmt.Sprintf("<string>%s</string>", value)
+	return value
 }
 
-func struct2XML(value interface{}) (out string) {
+func (e *encoder) struct2XML(value interface{}) (out string, err error) {
 	out += "<struct>"
-	for i := 0; i < reflect.TypeOf(value).NumField(); i++ {
-		field := reflect.ValueOf(value).Field(i)
-		field_type := reflect.TypeOf(value).Field(i)
-		var name string
-		if field_type.Tag.Get("xml") != "" {
-			name = field_type.Tag.Get("xml")
-		} else {
-			name = field_type.Name
+	members, err := e.members2XML(reflect.ValueOf(value))
+	out += members
+	out += "</struct>"
+	return
+}
+
+// members2XML encodes the fields of a struct, or the entries of a map with
+// string keys sorted by key, as a sequence of <member> elements.
+func (e *encoder) members2XML(v reflect.Value) (out string, err error) {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return
+		}
+		v = v.Elem()
+	}
+	switch v.Kind() {
+	case reflect.Struct:
+		plan := planFor(v.Type())
+		for i := range plan.fields {
+			f := &plan.fields[i]
+			if !e.inView(f) {
+				continue
+			}
+			if e.omitNil(v.Field(f.index)) {
+				continue
+			}
+			field_value, err := e.field2XML(v.Field(f.index), f)
+			if err != nil {
+				return "", err
+			}
+			field_name := fmt.Sprintf("<name>%s</name>", f.name)
+			out += fmt.Sprintf("<member>%s%s</member>", field_name, field_value)
+		}
+	case reflect.Map:
+		keys := v.MapKeys()
+		names := make([]string, len(keys))
+		for i, key := range keys {
+			if names[i], err = e.mapKey2String(key); err != nil {
+				return "", err
+			}
+		}
+		order := make([]int, len(keys))
+		for i := range order {
+			order[i] = i
+		}
+		sort.Slice(order, func(i, j int) bool {
+			return names[order[i]] < names[order[j]]
+		})
+		for _, i := range order {
+			field_value, err := e.rpc2XML(v.MapIndex(keys[i]).Interface())
+			if err != nil {
+				return "", err
+			}
+			field_name := fmt.Sprintf("<name>%s</name>", escapeXML(names[i]))
+			out += fmt.Sprintf("<member>%s%s</member>", field_name, field_value)
 		}
-		field_value, _ := rpc2XML(field.Interface())
-		field_name := fmt.Sprintf("<name>%s</name>", name)
-		out += fmt.Sprintf("<member>%s%s</member>", field_name, field_value)
 	}
-	out += "</struct>"
 	return
 }
 
-func array2XML(value interface{}) (out string) {
+// mapKey2String returns the member name for a map key. Keys that aren't
+// strings are only supported when the encoder stringifies them, using
+// MarshalText if the key implements encoding.TextMarshaler and fmt.Sprint
+// otherwise.
+func (e *encoder) mapKey2String(key reflect.Value) (string, error) {
+	if key.Kind() == reflect.String {
+		return key.String(), nil
+	}
+	if !e.stringifyKeys {
+		return "", fmt.Errorf("xml: unsupported map key type %s", key.Type())
+	}
+	if m, ok := key.Interface().(encoding.TextMarshaler); ok {
+		text, err := m.MarshalText()
+		return string(text), err
+	}
+	return fmt.Sprint(key.Interface()), nil
+}
+
+func (e *encoder) array2XML(value interface{}) (out string, err error) {
 	out += "<array><data>"
 	for i := 0; i < reflect.ValueOf(value).Len(); i++ {
-		item_xml, _ := rpc2XML(reflect.ValueOf(value).Index(i).Interface())
+		item_xml, err := e.rpc2XML(reflect.ValueOf(value).Index(i).Interface())
+		if err != nil {
+			return "", err
+		}
 		out += item_xml
 	}
 	out += "</data></array>"
 	return
 }
 
+// time2XML encodes the time, with its timezone offset if enabled.
+func (e *encoder) time2XML(t time.Time) string {
+	if !e.offsets {
+		return time2XML(t)
+	}
+	return fmt.Sprintf("<dateTime.iso8601>%s</dateTime.iso8601>",
+		t.Format("20060102T15:04:05Z07:00"))
+}
+
 func time2XML(t time.Time) string {
 	/*
 		// TODO: find out whether we need to deal
@@ -188,6 +454,42 @@ func time2XML(t time.Time) string {
 		t.Hour(), t.Minute(), t.Second())
 }
 
+// int2XML encodes the 32-bit integer as an <int>, or as an <i4> if the
+// encoder uses its synonym.
+func (e *encoder) int2XML(n int64) string {
+	if e.i4 {
+		return fmt.Sprintf("<i4>%d</i4>", n)
+	}
+	return fmt.Sprintf("<int>%d</int>", n)
+}
+
+// goInt2XML encodes an int as an <int>, or as an <i8> if it doesn't fit in
+// 32 bits, as int is 64 bits wide on most platforms.
+func (e *encoder) goInt2XML(n int64) string {
+	if n >= math.MinInt32 && n <= math.MaxInt32 {
+		return e.int2XML(n)
+	}
+	return e.int642XML(n)
+}
+
+// int642XML encodes the integer as an <i8>, or as an <int> if it fits in
+// 32 bits and the encoder uses compact integers.
+func (e *encoder) int642XML(n int64) string {
+	if e.compactInts && n >= math.MinInt32 && n <= math.MaxInt32 {
+		return e.int2XML(n)
+	}
+	return fmt.Sprintf("<i8>%d</i8>", n)
+}
+
+// bigInt2XML encodes the integer as an <i8> if it fits, and as a <string>
+// otherwise.
+func bigInt2XML(b *big.Int) string {
+	if b.IsInt64() {
+		return fmt.Sprintf("<i8>%s</i8>", b.String())
+	}
+	return fmt.Sprintf("<string>%s</string>", b.String())
+}
+
 func base642XML(data []byte) string {
 	str := base64.StdEncoding.EncodeToString(data)
 	return fmt.Sprintf("<base64>%s</base64>", str)
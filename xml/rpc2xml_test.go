@@ -5,6 +5,10 @@
 package xml
 
 import (
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 )
@@ -74,3 +78,355 @@ func TestRpc2XmlNil(t *testing.T) {
 		t.Error("Got", xml)
 	}
 }
+
+type Coordinate complex128
+
+type StructFallbackRpc2Xml struct {
+	Position Coordinate
+}
+
+func TestRPC2XMLFallbackEncoder(t *testing.T) {
+	req := &StructFallbackRpc2Xml{Coordinate(complex(1.5, -2))}
+	if _, err := new(encoder).rpc2XML(req.Position); err == nil {
+		t.Error("Expected an error encoding an unsupported type without a fallback")
+	}
+
+	codec := NewCodec()
+	codec.SetFallbackEncoder(func(v reflect.Value) (interface{}, error) {
+		if c, ok := v.Interface().(Coordinate); ok {
+			return fmt.Sprintf("%g,%g", real(c), imag(c)), nil
+		}
+		return nil, fmt.Errorf("unexpected type %s", v.Type())
+	})
+	xml, err := codec.encoder.rpcResponse2XML(req)
+	if err != nil {
+		t.Error("RPC2XML conversion failed", err)
+	}
+	expected := "<methodResponse><params><param><value><struct><member><name>Position</name><value><string>1.5,-2</string></value></member></struct></value></param></params></methodResponse>"
+	if xml != expected {
+		t.Error("RPC2XML fallback conversion failed")
+		t.Error("Expected", expected)
+		t.Error("Got", xml)
+	}
+}
+
+type StructMapRpc2Xml struct {
+	Codes map[int]string
+}
+
+func TestRPC2XMLStringifyMapKeys(t *testing.T) {
+	req := &StructMapRpc2Xml{map[int]string{10: "ten", 2: "two", 1: "one"}}
+	if _, err := new(encoder).rpcResponse2XML(req); err == nil {
+		t.Error("Expected an error encoding int map keys without stringifying")
+	}
+
+	codec := NewCodec()
+	codec.SetStringifyMapKeys(true)
+	xml, err := codec.encoder.rpcResponse2XML(req)
+	if err != nil {
+		t.Error("RPC2XML conversion failed", err)
+	}
+	expected := "<methodResponse><params><param><value><struct><member><name>Codes</name><value><struct><member><name>1</name><value><string>one</string></value></member><member><name>10</name><value><string>ten</string></value></member><member><name>2</name><value><string>two</string></value></member></struct></value></member></struct></value></param></params></methodResponse>"
+	if xml != expected {
+		t.Error("RPC2XML map conversion failed")
+		t.Error("Expected", expected)
+		t.Error("Got", xml)
+	}
+}
+
+type StructCDATARpc2Xml struct {
+	Menu  string `xmlrpc:"MENU,cdata"`
+	Title string
+}
+
+func TestRPC2XMLCDATA(t *testing.T) {
+	req := &StructCDATARpc2Xml{"<b>Tom & Jerry</b> ]]> end", "a < b & c"}
+
+	xml, err := new(encoder).rpcResponse2XML(req)
+	if err != nil {
+		t.Error("RPC2XML conversion failed", err)
+	}
+	expected := "<methodResponse><params><param><value><struct><member><name>MENU</name><value><string><![CDATA[<b>Tom & Jerry</b> ]]]]><![CDATA[> end]]></string></value></member><member><name>Title</name><value><string>a &lt; b &amp; c</string></value></member></struct></value></param></params></methodResponse>"
+	if xml != expected {
+		t.Error("RPC2XML escaping conversion failed")
+		t.Error("Expected", expected)
+		t.Error("Got", xml)
+	}
+
+	codec := NewCodec()
+	codec.SetCDATA(true)
+	xml, err = codec.encoder.rpcResponse2XML(req)
+	if err != nil {
+		t.Error("RPC2XML conversion failed", err)
+	}
+	expected = "<methodResponse><params><param><value><struct><member><name>MENU</name><value><string><![CDATA[<b>Tom & Jerry</b> ]]]]><![CDATA[> end]]></string></value></member><member><name>Title</name><value><string><![CDATA[a < b & c]]></string></value></member></struct></value></param></params></methodResponse>"
+	if xml != expected {
+		t.Error("RPC2XML CDATA conversion failed")
+		t.Error("Expected", expected)
+		t.Error("Got", xml)
+	}
+
+	// Both forms decode back to the original strings.
+	res := new(StructCDATARpc2Xml)
+	if err := xml2RPC(xml, res); err != nil {
+		t.Error("XML2RPC conversion failed", err)
+	}
+	if !reflect.DeepEqual(res, req) {
+		t.Error("Expected", req)
+		t.Error("Got", res)
+	}
+}
+
+func TestRPC2XMLDateTimeOffsets(t *testing.T) {
+	codec := NewCodec()
+	codec.SetDateTimeOffsets(true)
+	tests := []struct {
+		time     time.Time
+		expected string
+	}{
+		{time.Date(2023, time.November, 2, 10, 20, 30, 0, time.FixedZone("EAT", 3*3600)), "20231102T10:20:30+03:00"},
+		{time.Date(2023, time.November, 2, 10, 20, 30, 0, time.FixedZone("", -(5*3600+30*60))), "20231102T10:20:30-05:30"},
+		{time.Date(2023, time.November, 2, 10, 20, 30, 0, time.UTC), "20231102T10:20:30Z"},
+	}
+	for _, test := range tests {
+		xml, err := codec.encoder.rpc2XML(test.time)
+		if err != nil {
+			t.Error("RPC2XML conversion failed", err)
+		}
+		expected := "<value><dateTime.iso8601>" + test.expected + "</dateTime.iso8601></value>"
+		if xml != expected {
+			t.Error("RPC2XML conversion failed")
+			t.Error("Expected", expected)
+			t.Error("Got", xml)
+		}
+	}
+}
+
+func TestRPC2XMLResponseWrapper(t *testing.T) {
+	req := &StructSpecialCharsRpc2Xml{"ok"}
+	member := "<value><struct><member><name>String1</name><value><string>ok</string></value></member></struct></value>"
+	tests := []struct {
+		wrapper  []string
+		expected string
+	}{
+		{nil, "<params><param>" + member + "</param></params>"},
+		{[]string{"params"}, "<params>" + member + "</params>"},
+		{[]string{"result"}, "<result>" + member + "</result>"},
+		{[]string{}, member},
+	}
+	for _, test := range tests {
+		codec := NewCodec()
+		if test.wrapper != nil {
+			codec.SetResponseWrapper(test.wrapper...)
+		}
+		xml, err := codec.encoder.rpcResponse2XML(req)
+		if err != nil {
+			t.Error("RPC2XML conversion failed", err)
+		}
+		expected := "<methodResponse>" + test.expected + "</methodResponse>"
+		if xml != expected {
+			t.Error("RPC2XML conversion failed")
+			t.Error("Expected", expected)
+			t.Error("Got", xml)
+		}
+	}
+}
+
+type StructI8 struct {
+	Big   int64
+	Count uint64
+	Small int32
+}
+
+type StructInt struct {
+	Small int
+	Big   int
+	Low   int
+}
+
+func TestRPC2XMLIntOverflow(t *testing.T) {
+	in := StructInt{Small: math.MaxInt32, Big: math.MaxInt32 + 1, Low: math.MinInt32 - 1}
+	xml, err := NewCodec().encoder.rpcRequest2XML("Some.Method", &in)
+	if err != nil {
+		t.Fatal("RPC2XML conversion failed", err)
+	}
+	members := "<member><name>Small</name><value><int>2147483647</int></value></member>" +
+		"<member><name>Big</name><value><i8>2147483648</i8></value></member>" +
+		"<member><name>Low</name><value><i8>-2147483649</i8></value></member>"
+	if !strings.Contains(xml, "<struct>"+members+"</struct>") {
+		t.Errorf("Expected members %s, got %s", members, xml)
+	}
+
+	out := new(StructInt)
+	if err := xml2RPC(xml, out); err != nil {
+		t.Fatal("XML2RPC conversion failed", err)
+	}
+	if *out != in {
+		t.Errorf("Expected %+v, got %+v", in, *out)
+	}
+}
+
+type StructUintFloat32 struct {
+	Count uint
+	Ratio float32
+}
+
+func TestRPC2XMLUintFloat32(t *testing.T) {
+	in := StructUintFloat32{Count: 1 << 40, Ratio: 0.25}
+	xml, err := NewCodec().encoder.rpcRequest2XML("Some.Method", &in)
+	if err != nil {
+		t.Fatal("RPC2XML conversion failed", err)
+	}
+	members := "<member><name>Count</name><value><i8>1099511627776</i8></value></member>" +
+		"<member><name>Ratio</name><value><double>0.250000</double></value></member>"
+	if !strings.Contains(xml, "<struct>"+members+"</struct>") {
+		t.Errorf("Expected members %s, got %s", members, xml)
+	}
+
+	out := new(StructUintFloat32)
+	if err := xml2RPC(xml, out); err != nil {
+		t.Fatal("XML2RPC conversion failed", err)
+	}
+	if *out != in {
+		t.Errorf("Expected %+v, got %+v", in, *out)
+	}
+
+	if _, err := NewCodec().encoder.rpc2XML(uint(math.MaxUint64)); err == nil {
+		t.Error("Expected an error encoding a uint overflowing <i8>")
+	}
+}
+
+func TestRPC2XMLI8(t *testing.T) {
+	const member = "<member><name>%s</name><value><%s>%d</%[2]s></value></member>"
+	in := StructI8{Big: 1<<31 + 1, Count: 1 << 40, Small: -7}
+	tests := []struct {
+		compact bool
+		in      StructI8
+		small   string
+	}{
+		{false, in, "i8"},
+		{true, in, "int"},
+	}
+	for _, test := range tests {
+		codec := NewCodec()
+		codec.SetCompactInts(test.compact)
+		xml, err := codec.encoder.rpcRequest2XML("Some.Method", &test.in)
+		if err != nil {
+			t.Fatal("RPC2XML conversion failed", err)
+		}
+		members := fmt.Sprintf(member, "Big", "i8", test.in.Big) +
+			fmt.Sprintf(member, "Count", "i8", test.in.Count) +
+			fmt.Sprintf(member, "Small", "int", test.in.Small)
+		if !strings.Contains(xml, "<struct>"+members+"</struct>") {
+			t.Errorf("compact %v: expected members %s, got %s", test.compact, members, xml)
+		}
+
+		out := new(StructI8)
+		if err := xml2RPC(xml, out); err != nil {
+			t.Fatal("XML2RPC conversion failed", err)
+		}
+		if *out != test.in {
+			t.Errorf("compact %v: expected %+v, got %+v", test.compact, test.in, *out)
+		}
+	}
+
+	// Small values are sent as <int> in compact mode.
+	codec := NewCodec()
+	codec.SetCompactInts(true)
+	if xml, _ := codec.encoder.rpc2XML(int64(42)); xml != "<value><int>42</int></value>" {
+		t.Errorf("Expected <int>, got %s", xml)
+	}
+
+	// <i4> is an alias for <int>, and values overflowing the field fail.
+	out := new(StructI8)
+	call := "<methodCall><methodName>Some.Method</methodName><params><param><value><struct><member><name>Small</name><value><i4>%s</i4></value></member></struct></value></param></params></methodCall>"
+	if err := xml2RPC(fmt.Sprintf(call, "12"), out); err != nil || out.Small != 12 {
+		t.Errorf("Expected 12, got %d (%v)", out.Small, err)
+	}
+	if err := xml2RPC(fmt.Sprintf(call, "4294967296"), out); err == nil {
+		t.Error("Expected an error decoding an overflowing integer")
+	}
+}
+
+type StructPtrRpc2Xml struct {
+	Name  *string
+	Count *int
+}
+
+func TestRPC2XMLAllowNil(t *testing.T) {
+	name := "ussd"
+	tests := []struct {
+		allowNil bool
+		in       StructPtrRpc2Xml
+		members  string
+	}{
+		{false, StructPtrRpc2Xml{&name, nil}, "<member><name>Name</name><value><string>ussd</string></value></member>"},
+		{true, StructPtrRpc2Xml{&name, nil}, "<member><name>Name</name><value><string>ussd</string></value></member><member><name>Count</name><value><nil/></value></member>"},
+		{true, StructPtrRpc2Xml{nil, new(int)}, "<member><name>Name</name><value><nil/></value></member><member><name>Count</name><value><int>0</int></value></member>"},
+	}
+	for _, test := range tests {
+		codec := NewCodec()
+		codec.SetAllowNil(test.allowNil)
+		xml, err := codec.encoder.rpcRequest2XML("Some.Method", &test.in)
+		if err != nil {
+			t.Fatal("RPC2XML conversion failed", err)
+		}
+		if !strings.Contains(xml, "<struct>"+test.members+"</struct>") {
+			t.Errorf("allowNil %v: expected members %s, got %s", test.allowNil, test.members, xml)
+		}
+
+		// Nil pointers stay nil, others point to the decoded value.
+		var out StructPtrRpc2Xml
+		if err := xml2RPC(xml, &out); err != nil {
+			t.Fatal("XML2RPC conversion failed", err)
+		}
+		if !reflect.DeepEqual(out, test.in) {
+			t.Errorf("allowNil %v: expected %v, got %v", test.allowNil, test.in, out)
+		}
+	}
+
+	if _, err := new(encoder).rpc2XML((*int)(nil)); err == nil {
+		t.Error("Expected an error encoding a nil pointer without the extension")
+	}
+}
+
+type StructPtrPtrRpc2Xml struct {
+	Name **string
+}
+
+func TestRPC2XMLNestedPointers(t *testing.T) {
+	name := "ussd"
+	namePtr := &name
+	var nilPtr *string
+	tests := []struct {
+		allowNil bool
+		in       StructPtrPtrRpc2Xml
+		members  string
+		out      StructPtrPtrRpc2Xml
+	}{
+		{false, StructPtrPtrRpc2Xml{&namePtr}, "<member><name>Name</name><value><string>ussd</string></value></member>", StructPtrPtrRpc2Xml{&namePtr}},
+		{false, StructPtrPtrRpc2Xml{&nilPtr}, "", StructPtrPtrRpc2Xml{}},
+		{false, StructPtrPtrRpc2Xml{}, "", StructPtrPtrRpc2Xml{}},
+		{true, StructPtrPtrRpc2Xml{&nilPtr}, "<member><name>Name</name><value><nil/></value></member>", StructPtrPtrRpc2Xml{}},
+		{true, StructPtrPtrRpc2Xml{}, "<member><name>Name</name><value><nil/></value></member>", StructPtrPtrRpc2Xml{}},
+	}
+	for i, test := range tests {
+		codec := NewCodec()
+		codec.SetAllowNil(test.allowNil)
+		xml, err := codec.encoder.rpcRequest2XML("Some.Method", &test.in)
+		if err != nil {
+			t.Fatalf("%d: RPC2XML conversion failed: %v", i, err)
+		}
+		if !strings.Contains(xml, "<struct>"+test.members+"</struct>") {
+			t.Errorf("%d: expected members %s, got %s", i, test.members, xml)
+		}
+
+		var out StructPtrPtrRpc2Xml
+		if err := xml2RPC(xml, &out); err != nil {
+			t.Fatalf("%d: XML2RPC conversion failed: %v", i, err)
+		}
+		if !reflect.DeepEqual(out, test.out) {
+			t.Errorf("%d: expected %v, got %v", i, test.out, out)
+		}
+	}
+}
@@ -5,11 +5,22 @@
 package xml
 
 import (
+	"bytes"
+	"context"
 	"encoding/xml"
+	"errors"
 	"fmt"
 	"github.com/mudphilo/go-xml-rpc"
+	"io"
 	"io/ioutil"
+	"mime"
 	"net/http"
+	"reflect"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/rogpeppe/go-charset/charset"
 )
 
 // ----------------------------------------------------------------------------
@@ -25,7 +36,12 @@ func NewCodec() *Codec {
 
 // Codec creates a CodecRequest to process each request.
 type Codec struct {
-	aliases map[string]string
+	aliases           map[string]string
+	strictMethodNames bool
+	strictTrailing    bool
+	strictBOM         bool
+	encoder           encoder
+	decoder           decoder
 }
 
 // RegisterAlias creates a method alias
@@ -33,23 +49,335 @@ func (c *Codec) RegisterAlias(alias, method string) {
 	c.aliases[alias] = method
 }
 
-// NewRequest returns a CodecRequest.
+// SetStrictMethodNames makes the codec reject method names containing
+// whitespace. Leading and trailing whitespace is always trimmed.
+func (c *Codec) SetStrictMethodNames(strict bool) {
+	c.strictMethodNames = strict
+}
+
+// SetStrictTrailingData makes the codec reject requests with anything but
+// whitespace, comments or processing instructions after the closing
+// methodCall tag. By default trailing data is ignored.
+func (c *Codec) SetStrictTrailingData(strict bool) {
+	c.strictTrailing = strict
+}
+
+// SetStrictBOM makes the codec reject requests starting with a UTF-8 byte
+// order mark, as prepended by some Windows clients. By default it is
+// stripped before parsing.
+func (c *Codec) SetStrictBOM(strict bool) {
+	c.strictBOM = strict
+}
+
+// SetFallbackEncoder registers fn to encode values of types the codec
+// doesn't support natively. fn returns a replacement value of a supported
+// type, e.g. a string, which is encoded in place of the original value.
+func (c *Codec) SetFallbackEncoder(fn func(reflect.Value) (interface{}, error)) {
+	c.encoder.fallback = fn
+}
+
+// SetStringifyMapKeys allows encoding maps whose keys aren't strings as a
+// <struct>. Keys are converted with MarshalText if they implement
+// encoding.TextMarshaler and with fmt.Sprint otherwise, and members are
+// sorted by the converted key.
+func (c *Codec) SetStringifyMapKeys(stringify bool) {
+	c.encoder.stringifyKeys = stringify
+}
+
+// SetCDATA makes the codec wrap string values in CDATA sections instead of
+// escaping them. Single fields can opt in with the cdata option of the
+// xmlrpc tag, as in `xmlrpc:"BODY,cdata"`.
+func (c *Codec) SetCDATA(cdata bool) {
+	c.encoder.cdata = cdata
+}
+
+// SetDateTimeOffsets makes the codec append the timezone offset to
+// dateTime values, as in 20231102T10:20:30+03:00, or Z for UTC. By default
+// the offset is left out and the time is sent in its own location.
+//
+// Offsets are always accepted when decoding, and kept in the decoded time.
+func (c *Codec) SetDateTimeOffsets(offsets bool) {
+	c.encoder.offsets = offsets
+}
+
+// SetCompactInts makes the codec encode int64, uint32 and uint64 values
+// fitting in 32 bits as <int> rather than with the <i8> extension, for
+// strict legacy peers. Larger values are still sent as <i8>.
+func (c *Codec) SetCompactInts(compact bool) {
+	c.encoder.compactInts = compact
+}
+
+// SetAllowNil makes the codec encode nil pointers as <nil/>, an extension
+// not all peers understand. By default nil pointer fields are left out of
+// their struct, and other nil pointers fail to encode. <nil/> is always
+// accepted when decoding, and leaves pointer fields nil.
+func (c *Codec) SetAllowNil(allow bool) {
+	c.encoder.allowNil = allow
+}
+
+// SetCharset sets the charset responses are encoded in, as declared in
+// their XML declaration and Content-Type header, as in "ISO-8859-1".
+// Characters the charset can't represent are written as character
+// references. By default responses are UTF-8 without an XML declaration.
+func (c *Codec) SetCharset(name string) error {
+	if !strings.EqualFold(name, "utf-8") {
+		if _, err := charset.TranslatorTo(name); err != nil {
+			return fmt.Errorf("rpc: unsupported charset %q", name)
+		}
+	}
+	c.encoder.charset = name
+	return nil
+}
+
+// SetResponseWrapper sets the names of the elements wrapping the value of
+// responses, outermost first, for peers expecting a framing other than the
+// spec's <params><param>. With no names the value is placed right inside
+// <methodResponse>. Calls and faults are not affected.
+func (c *Codec) SetResponseWrapper(names ...string) {
+	c.encoder.responseWrapper = append([]string{}, names...)
+}
+
+// SetEncodeFault sets the fault sent in place of replies that fail to
+// encode, e.g. because of a field of an unsupported type. By default an
+// internal error fault carrying the encoding error is sent.
+func (c *Codec) SetEncodeFault(fault Fault) {
+	c.encoder.encodeFault = &fault
+}
+
+// RegisterInterfaceType registers factory to create the concrete values of
+// structs decoded into interface fields, for structs whose type member
+// equals discriminator. factory usually returns a pointer to a struct,
+// which is stored in the field if it satisfies the interface, or else the
+// struct itself. Structs of unregistered types decode into a
+// map[string]interface{}.
+func (c *Codec) RegisterInterfaceType(discriminator string, factory func() interface{}) {
+	if c.decoder.types == nil {
+		c.decoder.types = make(map[string]func() interface{})
+	}
+	c.decoder.types[discriminator] = factory
+}
+
+// SetWholeDoubles makes the codec accept a <double> into a signed or
+// unsigned integer field when it has no fractional part, as sent by clients
+// bridging from JSON. Doubles with a fractional part, or overflowing the
+// field, are rejected with an invalid params fault.
+func (c *Codec) SetWholeDoubles(lenient bool) {
+	c.decoder.wholeDoubles = lenient
+}
+
+// SetLenientBools makes the codec accept an <int>, <i4> or <i8> into a
+// bool field, zero being false and any other value true, for peers sending
+// booleans as integers.
+func (c *Codec) SetLenientBools(lenient bool) {
+	c.decoder.lenientBools = lenient
+}
+
+// SetStrictTypes makes the codec reject values of types it doesn't know,
+// as in <bigdecimal>1.5</bigdecimal>, with an invalid params fault. By
+// default their text is decoded as a string. A fallback decoder registered
+// with SetFallbackDecoder takes precedence.
+func (c *Codec) SetStrictTypes(strict bool) {
+	c.decoder.strictTypes = strict
+}
+
+// SetFallbackDecoder registers fn to decode values of types the codec
+// doesn't know, given the element name and its text. The returned value
+// must be of the type of the field, and a nil value leaves it unset.
+func (c *Codec) SetFallbackDecoder(fn func(element, text string) (interface{}, error)) {
+	c.decoder.fallback = fn
+}
+
+// SetBlobWriter registers fn to return the writer receiving the decoded
+// bytes of a <base64> member decoded into a Blob field, given the member
+// name. The base64 text is decoded into the writer, so the decoded bytes
+// needn't be held in memory, although the request is still read into
+// memory as a whole. Without a function, blobs are written to temporary
+// files, removed once the response is written or the HTTP request is done;
+// async methods, running after both, need a function.
+func (c *Codec) SetBlobWriter(fn func(member string) (io.Writer, error)) {
+	c.decoder.blobWriter = fn
+}
+
+// SetTypeMember sets the name of the member holding the discriminator of
+// structs decoded into interface fields, "type" by default.
+func (c *Codec) SetTypeMember(name string) {
+	c.decoder.typeMember = name
+}
+
+// ValidateTypes checks that the codec can decode args of argsType and
+// encode replies of replyType, by walking the types the fields of their
+// structs are made of, then encoding the zero value of the reply. It
+// implements rpc.TypeValidator.
+func (c *Codec) ValidateTypes(argsType, replyType reflect.Type) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("xml: %v", r)
+		}
+	}()
+	if err := checkType(argsType, c.decoder.checkDecodable); err != nil {
+		return fmt.Errorf("args: %v", err)
+	}
+	if err := checkType(replyType, c.encoder.checkEncodable); err != nil {
+		return fmt.Errorf("reply: %v", err)
+	}
+	if _, err := c.encoder.rpcResponse2XML(reflect.New(replyType).Interface()); err != nil {
+		return fmt.Errorf("reply: %v", err)
+	}
+	return nil
+}
+
+// decodeFault returns the parse error fault for a request that can't be
+// decoded.
+func decodeFault(err error) Fault {
+	fault := FaultDecode
+	fault.String += ": " + err.Error()
+	return fault
+}
+
+// NewRequest returns a CodecRequest. Requests that can't be decoded carry a
+// parse error fault, returned by Method.
 func (c *Codec) NewRequest(r *http.Request) rpc.CodecRequest {
 	rawxml, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		return &CodecRequest{err: err}
+		return &CodecRequest{err: decodeFault(err), encoder: &c.encoder}
 	}
 	defer r.Body.Close()
 
+	if bytes.HasPrefix(rawxml, utf8BOM) {
+		if c.strictBOM {
+			return &CodecRequest{err: decodeFault(errors.New("rpc: request starts with a byte order mark")), encoder: &c.encoder}
+		}
+		rawxml = rawxml[len(utf8BOM):]
+	}
+
+	if _, params, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err == nil {
+		if name := params["charset"]; name != "" && !strings.EqualFold(name, "utf-8") {
+			if rawxml, err = toUTF8(rawxml, name); err != nil {
+				return &CodecRequest{err: decodeFault(err), encoder: &c.encoder}
+			}
+		}
+	}
+
 	var request ServerRequest
-	if err := xml.Unmarshal(rawxml, &request); err != nil {
-		return &CodecRequest{err: err}
+	decoder := xml.NewDecoder(bytes.NewReader(rawxml))
+	decoder.CharsetReader = charset.NewReader
+	if err := decoder.Decode(&request); err != nil {
+		return &CodecRequest{err: decodeFault(err), encoder: &c.encoder}
+	}
+	if c.strictTrailing {
+		if err := trailingData(rawxml); err != nil {
+			return &CodecRequest{err: decodeFault(err), encoder: &c.encoder}
+		}
 	}
 	request.rawxml = string(rawxml)
+	request.Method = strings.TrimSpace(request.Method)
+	if c.strictMethodNames && strings.IndexFunc(request.Method, unicode.IsSpace) != -1 {
+		return &CodecRequest{err: decodeFault(fmt.Errorf("rpc: method name contains whitespace: %q", request.Method)), encoder: &c.encoder}
+	}
 	if method, ok := c.aliases[request.Method]; ok {
 		request.Method = method
 	}
-	return &CodecRequest{request: &request}
+	e := &c.encoder
+	if view, ok := View(r.Context()); ok {
+		viewEncoder := c.encoder
+		viewEncoder.view = view
+		e = &viewEncoder
+	}
+	return &CodecRequest{request: &request, encoder: e, decoder: &c.decoder, aliases: c.aliases, ctx: r.Context(), blobs: &tempBlobs{ctx: r.Context()}}
+}
+
+// encodingDecl matches the XML declaration of a document up to its
+// encoding attribute, which is captured apart.
+var encodingDecl = regexp.MustCompile(`^(\s*<\?xml[^>]*?)(\s+encoding\s*=\s*("[^"]*"|'[^']*'))`)
+
+// toUTF8 transcodes the document from the named charset, as declared in
+// the Content-Type header, to UTF-8. The encoding declared by the document
+// itself, overridden by the header, is dropped.
+func toUTF8(rawxml []byte, name string) ([]byte, error) {
+	r, err := charset.NewReader(name, bytes.NewReader(rawxml))
+	if err != nil {
+		return nil, fmt.Errorf("rpc: unsupported charset %q", name)
+	}
+	if rawxml, err = ioutil.ReadAll(r); err != nil {
+		return nil, err
+	}
+	return encodingDecl.ReplaceAll(rawxml, []byte("$1")), nil
+}
+
+// WarningsHeader is the HTTP header carrying the warnings of replies that
+// aren't structs, one per header value.
+const WarningsHeader = "X-Rpc-Warning"
+
+// addWarnings adds the warnings added with rpc.Warn to the encoded
+// response, as an array of strings in a "warnings" member when the reply
+// is a struct, or else in WarningsHeader.
+func (c *CodecRequest) addWarnings(w http.ResponseWriter, xmlstr string, warnings []string) string {
+	if len(warnings) == 0 {
+		return xmlstr
+	}
+	// The reply is a struct if the first value of the response is.
+	start := strings.Index(xmlstr, "<value>")
+	isStruct := start != -1 && strings.HasPrefix(xmlstr[start+len("<value>"):], "<struct>")
+	if i := strings.LastIndex(xmlstr, "</struct>"); isStruct && i != -1 {
+		if member, err := c.encoder.rpc2XML(warnings); err == nil {
+			return xmlstr[:i] + "<member><name>warnings</name>" + member + "</member>" + xmlstr[i:]
+		}
+	}
+	for _, warning := range warnings {
+		w.Header().Add(WarningsHeader, warning)
+	}
+	return xmlstr
+}
+
+// fromUTF8 transcodes the document to the named charset, writing the
+// characters the charset can't represent as character references.
+func fromUTF8(xmlstr, name string) ([]byte, error) {
+	if strings.EqualFold(name, "utf-8") {
+		return []byte(xmlstr), nil
+	}
+	tr, err := charset.TranslatorTo(name)
+	if err != nil {
+		return nil, fmt.Errorf("rpc: unsupported charset %q", name)
+	}
+	var b bytes.Buffer
+	for _, r := range xmlstr {
+		_, out, err := tr.Translate([]byte(string(r)), true)
+		if err != nil {
+			return nil, err
+		}
+		// Unknown characters are translated to a question mark.
+		if r != '?' && string(out) == "?" {
+			fmt.Fprintf(&b, "&#%d;", r)
+			continue
+		}
+		b.Write(out)
+	}
+	return b.Bytes(), nil
+}
+
+// utf8BOM is the UTF-8 encoded byte order mark.
+var utf8BOM = []byte("\xef\xbb\xbf")
+
+// contextKey is the type of the keys for values the codec reads from the
+// request context.
+type contextKey int
+
+const (
+	viewKey contextKey = iota
+)
+
+// WithView returns a copy of ctx carrying the view of the caller, e.g.
+// "admin". Fields tagged with a view option, as in `xmlrpc:"COST,view=admin"`,
+// are only encoded in responses to requests whose context carries the same
+// view. Middleware sets it on the request before it reaches the server.
+func WithView(ctx context.Context, view string) context.Context {
+	return context.WithValue(ctx, viewKey, view)
+}
+
+// View returns the view carried by ctx, if any.
+func View(ctx context.Context) (string, bool) {
+	view, ok := ctx.Value(viewKey).(string)
+	return view, ok
 }
 
 // ----------------------------------------------------------------------------
@@ -66,6 +394,11 @@ type ServerRequest struct {
 type CodecRequest struct {
 	request *ServerRequest
 	err     error
+	encoder *encoder
+	decoder *decoder
+	aliases map[string]string
+	ctx     context.Context // context of the HTTP request, for its warnings
+	blobs   *tempBlobs      // temporary files of the decoded Blob fields
 }
 
 // Method returns the RPC method for the current request.
@@ -78,13 +411,50 @@ func (c *CodecRequest) Method() (string, error) {
 	return "", c.err
 }
 
+// Params returns the raw params of the request, from the params element
+// to the end of the document, which key coalesced calls.
+func (c *CodecRequest) Params() []byte {
+	if c.request == nil {
+		return nil
+	}
+	raw := c.request.rawxml
+	if i := strings.Index(raw, "<params"); i != -1 {
+		raw = raw[i:]
+	}
+	return []byte(raw)
+}
+
 // ReadRequest fills the request object for the RPC method.
 //
 // args is the pointer to the Service.Args structure
-// it gets populated from temporary XML structure
+// it gets populated from temporary XML structure. Args that fail to decode
+// return the fault, which WriteResponse then encodes.
 func (c *CodecRequest) ReadRequest(args interface{}) error {
-	c.err = xml2RPC(c.request.rawxml, args)
-	return nil
+	c.err = c.decoder.decodeBlobs(c.blobs, func(d *decoder) error {
+		return d.xml2RPC(c.request.rawxml, args, nil)
+	})
+	return c.err
+}
+
+// error2Fault converts the error returned by a method into a fault. Faults
+// wrapped by other errors keep their code.
+func error2Fault(err error) Fault {
+	var (
+		fault    Fault
+		rpcFault rpc.Fault
+	)
+	switch {
+	case errors.As(err, &fault):
+	case errors.As(err, &rpcFault):
+		fault = Fault{Code: rpcFault.Code, String: rpcFault.Message}
+		if rpcFault.Detail != nil {
+			fault.Detail = rpcFault.Detail
+		}
+	default:
+		fault = FaultApplicationError
+		fault.String += fmt.Sprintf(": %v", err)
+	}
+	return fault
 }
 
 // WriteResponse encodes the response and writes it to the ResponseWriter.
@@ -92,22 +462,43 @@ func (c *CodecRequest) ReadRequest(args interface{}) error {
 // response is the pointer to the Service.Response structure
 // it gets encoded into the XML-RPC xml string
 func (c *CodecRequest) WriteResponse(w http.ResponseWriter, response interface{}, methodErr error) error {
+	// The method is done with the Blob fields of its args.
+	defer c.blobs.release()
 	var xmlstr string
-	if c.err != nil {
-		var fault Fault
-		switch c.err.(type) {
-		case Fault:
-			fault = c.err.(Fault)
-		default:
-			fault = FaultApplicationError
-			fault.String += fmt.Sprintf(": %v", c.err)
-		}
-		xmlstr = fault2XML(fault)
-	} else {
-		xmlstr, _ = rpcResponse2XML(response)
+	err := c.err
+	if err == nil {
+		err = methodErr
+	}
+	if err != nil {
+		xmlstr = c.encoder.fault2XML(error2Fault(err))
+	} else if xmlstr, err = c.encoder.rpcResponse2XML(response); err != nil {
+		// The response is only written once fully encoded, so a reply
+		// that fails to encode is replaced as a whole.
+		xmlstr = c.encoder.fault2XML(c.encoder.encodeFailure(err))
+	} else if c.ctx != nil {
+		xmlstr = c.addWarnings(w, xmlstr, rpc.Warnings(c.ctx))
 	}
+	return c.encoder.write(w, xmlstr)
+}
+
+// WriteFault encodes the fault as the response to a request the server
+// rejected before reading it. It implements rpc.FaultWriter.
+func (c *Codec) WriteFault(w http.ResponseWriter, fault rpc.Fault) error {
+	return c.encoder.write(w, c.encoder.fault2XML(error2Fault(fault)))
+}
 
-	w.Header().Set("Content-Type", "text/xml; charset=utf-8")
-	w.Write([]byte(xmlstr))
+// write writes the XML document, encoded in the charset of the encoder.
+func (e *encoder) write(w http.ResponseWriter, xmlstr string) error {
+	if e.charset == "" {
+		w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+		w.Write([]byte(xmlstr))
+		return nil
+	}
+	body, err := fromUTF8(`<?xml version="1.0" encoding="`+e.charset+`"?>`+xmlstr, e.charset)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "text/xml; charset="+strings.ToLower(e.charset))
+	w.Write(body)
 	return nil
 }
@@ -0,0 +1,141 @@
+// Copyright 2013 Ivan Danyliuk
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xml
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Transform rewrites the decoded value of a string field tagged with the
+// option it's registered for, given the argument of the option, as in
+// "E164:KE" for `xmlrpc:"MOBILE_NUMBER,msisdn=E164:KE"`.
+type Transform func(arg, value string) (string, error)
+
+// builtinTransforms are the transforms available without registration.
+var builtinTransforms = map[string]Transform{
+	"msisdn": NormalizeMSISDN,
+}
+
+// RegisterTransform registers fn to transform string fields whose xmlrpc
+// tag carries the option name, taking precedence over the built-in msisdn
+// transform. A failing transform rejects the call with an invalid params
+// fault.
+func (c *Codec) RegisterTransform(name string, fn Transform) {
+	if c.decoder.transforms == nil {
+		c.decoder.transforms = make(map[string]Transform)
+	}
+	c.decoder.transforms[name] = fn
+}
+
+// transform applies the transforms matching the options of the string
+// field f, in the order of the option names.
+func (d *decoder) transform(field *reflect.Value, f *fieldPlan) error {
+	if field.Kind() != reflect.String || len(f.options) == 0 {
+		return nil
+	}
+	names := make([]string, 0, len(f.options))
+	for name := range f.options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fn, ok := d.transforms[name]
+		if !ok {
+			fn, ok = builtinTransforms[name]
+		}
+		if !ok {
+			continue
+		}
+		s, err := fn(f.options[name], field.String())
+		if err != nil {
+			fault := FaultInvalidParams
+			fault.String += fmt.Sprintf(": %s: %v", f.name, err)
+			return fault
+		}
+		field.SetString(s)
+	}
+	return nil
+}
+
+// callingCodes maps ISO 3166 country codes to their calling codes, for the
+// default country of NormalizeMSISDN.
+var callingCodes = map[string]string{
+	"KE": "254",
+	"UG": "256",
+	"TZ": "255",
+	"RW": "250",
+	"BI": "257",
+	"SS": "211",
+	"ET": "251",
+	"SO": "252",
+	"NG": "234",
+	"GH": "233",
+	"ZA": "27",
+	"ZM": "260",
+	"MW": "265",
+	"US": "1",
+	"GB": "44",
+	"IN": "91",
+}
+
+// NormalizeMSISDN normalizes the phone number to the format of arg, which
+// is E164 followed by the ISO code of the default country, as in
+// "E164:KE". Spaces, dashes, dots and parentheses are dropped, an
+// international prefix of 00 becomes +, and numbers without a country code
+// get the one of the default country, a leading trunk 0 being dropped:
+// "0712 345 678", "712345678", "254712345678" and "+254712345678" all
+// become "+254712345678" with "E164:KE". An empty number stays empty.
+func NormalizeMSISDN(arg, number string) (string, error) {
+	format, country := arg, ""
+	if idx := strings.Index(arg, ":"); idx != -1 {
+		format, country = arg[:idx], arg[idx+1:]
+	}
+	if !strings.EqualFold(format, "E164") {
+		return "", fmt.Errorf("unsupported phone number format %q", format)
+	}
+	code, ok := callingCodes[strings.ToUpper(country)]
+	if !ok {
+		return "", fmt.Errorf("unknown country %q", country)
+	}
+
+	digits := strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '-', '.', '(', ')':
+			return -1
+		}
+		return r
+	}, strings.TrimSpace(number))
+	if digits == "" {
+		return "", nil
+	}
+	international := false
+	switch {
+	case strings.HasPrefix(digits, "+"):
+		digits, international = digits[1:], true
+	case strings.HasPrefix(digits, "00"):
+		digits, international = digits[2:], true
+	}
+	for _, r := range digits {
+		if r < '0' || r > '9' {
+			return "", fmt.Errorf("invalid phone number %q", number)
+		}
+	}
+	switch {
+	case international:
+	case strings.HasPrefix(digits, "0"):
+		digits = code + strings.TrimLeft(digits, "0")
+	case !strings.HasPrefix(digits, code) || len(digits) < len(code)+7:
+		digits = code + digits
+	}
+	// E.164 numbers have at most 15 digits, and no fewer than 8 in
+	// practice.
+	if len(digits) < 8 || len(digits) > 15 {
+		return "", fmt.Errorf("invalid phone number %q", number)
+	}
+	return "+" + digits, nil
+}
@@ -0,0 +1,84 @@
+// Copyright 2013 Ivan Danyliuk
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xml
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNormalizeMSISDN(t *testing.T) {
+	tests := []struct {
+		arg, number, expected string
+	}{
+		{"E164:KE", "+254712345678", "+254712345678"},
+		{"E164:KE", "254712345678", "+254712345678"},
+		{"E164:KE", "0712345678", "+254712345678"},
+		{"E164:KE", "712345678", "+254712345678"},
+		{"E164:KE", "0712 345-678", "+254712345678"},
+		{"E164:KE", "00254712345678", "+254712345678"},
+		{"E164:KE", "+256 772 123456", "+256772123456"},
+		{"E164:UG", "0772123456", "+256772123456"},
+		{"e164:ke", " (0712) 345.678 ", "+254712345678"},
+		{"E164:KE", "", ""},
+	}
+	for _, test := range tests {
+		got, err := NormalizeMSISDN(test.arg, test.number)
+		if err != nil || got != test.expected {
+			t.Errorf("NormalizeMSISDN(%q, %q) = %q, %v, expected %q", test.arg, test.number, got, err, test.expected)
+		}
+	}
+
+	for _, test := range []struct{ arg, number string }{
+		{"E164:KE", "07123abc"},
+		{"E164:KE", "+1234"},
+		{"E164:KE", "+2547123456789012"},
+		{"E164:XX", "0712345678"},
+		{"NATIONAL:KE", "0712345678"},
+	} {
+		if got, err := NormalizeMSISDN(test.arg, test.number); err == nil {
+			t.Errorf("NormalizeMSISDN(%q, %q) = %q, expected an error", test.arg, test.number, got)
+		}
+	}
+}
+
+type StructMSISDNXml2Rpc struct {
+	MobileNumber string `xmlrpc:"MOBILE_NUMBER,msisdn=E164:KE"`
+	Raw          string `xmlrpc:"RAW"`
+}
+
+func TestMSISDNTransform(t *testing.T) {
+	call := func(mobile string) string {
+		return "<methodCall><methodName>Some.Method</methodName><params><param><value><struct>" +
+			"<member><name>MOBILE_NUMBER</name><value><string>" + mobile + "</string></value></member>" +
+			"<member><name>RAW</name><value><string>0712345678</string></value></member>" +
+			"</struct></value></param></params></methodCall>"
+	}
+	req := new(StructMSISDNXml2Rpc)
+	if err := xml2RPC(call("0712 345 678"), req); err != nil {
+		t.Fatal("XML2RPC conversion failed", err)
+	}
+	if req.MobileNumber != "+254712345678" || req.Raw != "0712345678" {
+		t.Errorf("Expected the normalized MOBILE_NUMBER only, got %+v", *req)
+	}
+
+	err := xml2RPC(call("not a number"), new(StructMSISDNXml2Rpc))
+	if fault, ok := err.(Fault); !ok || fault.Code != FaultInvalidParams.Code || !strings.Contains(fault.String, "MOBILE_NUMBER") {
+		t.Errorf("Expected an invalid params fault for MOBILE_NUMBER, got %v", err)
+	}
+
+	// Registered transforms take precedence over the built-in one.
+	codec := NewCodec()
+	codec.RegisterTransform("msisdn", func(arg, value string) (string, error) {
+		return arg + "/" + value, nil
+	})
+	req = new(StructMSISDNXml2Rpc)
+	if err := codec.decoder.xml2RPC(call("0712345678"), req, nil); err != nil {
+		t.Fatal("XML2RPC conversion failed", err)
+	}
+	if req.MobileNumber != "E164:KE/0712345678" {
+		t.Errorf("Expected the registered transform to run, got %q", req.MobileNumber)
+	}
+}
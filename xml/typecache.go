@@ -0,0 +1,211 @@
+// Copyright 2013 Ivan Danyliuk
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xml
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fieldPlan describes how a single struct field maps to a struct member.
+type fieldPlan struct {
+	index   int               // index of the field in the struct
+	name    string            // member name used on the wire
+	options map[string]string // options of the xmlrpc tag
+	view    string            // view the field is encoded in, if hasView
+	hasView bool
+	encode  fieldEncoder // encodes the field, chosen for its type and options
+	decode  fieldDecoder // decodes a member into the field, likewise
+}
+
+// fieldEncoder encodes a struct field as a <value>.
+type fieldEncoder func(e *encoder, field reflect.Value) (string, error)
+
+// fieldDecoder decodes the value of a member into the struct field f.
+type fieldDecoder func(d *decoder, value value, field *reflect.Value, f *fieldPlan) error
+
+var typeOfTime = reflect.TypeOf(time.Time{})
+
+// epochUnit returns the unit of the epoch option, which makes a time.Time
+// field an integer Unix time in seconds with `xmlrpc:"AT,epoch=s"` or in
+// milliseconds with `xmlrpc:"AT,epoch=ms"`.
+func (f *fieldPlan) epochUnit() (time.Duration, bool) {
+	switch f.options["epoch"] {
+	case "s":
+		return time.Second, true
+	case "ms":
+		return time.Millisecond, true
+	}
+	return 0, false
+}
+
+// structPlan is the precomputed member layout of a struct type, shared by
+// the encoder and the decoder, along with the functions converting each
+// field.
+type structPlan struct {
+	fields []fieldPlan
+	byName map[string]*fieldPlan
+}
+
+// structPlans caches a *structPlan per reflect.Type.
+var structPlans sync.Map
+
+// planFor returns the cached plan for the struct type t, computing it on
+// first use.
+func planFor(t reflect.Type) *structPlan {
+	if p, ok := structPlans.Load(t); ok {
+		return p.(*structPlan)
+	}
+	p, _ := structPlans.LoadOrStore(t, newStructPlan(t))
+	return p.(*structPlan)
+}
+
+// newStructPlan resolves the member names of the exported fields of t,
+// leaving out embedded interfaces.
+//
+// The member name is taken from the xmlrpc tag, then from the xml tag,
+// falling back to the field name, so structs shared with encoding/xml can
+// name their members apart. Fields named "-" are skipped. Options after a
+// comma in the xml tag are ignored, while the xmlrpc tag carries comma
+// separated options of the form key=value, as in
+// `xmlrpc:"CREATED,datetime=unix"`.
+func newStructPlan(t reflect.Type) *structPlan {
+	p := &structPlan{byName: make(map[string]*fieldPlan)}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		// Embedded interfaces only promote methods, they carry no data.
+		if f.Anonymous && f.Type.Kind() == reflect.Interface {
+			continue
+		}
+		parts := strings.Split(f.Tag.Get("xmlrpc"), ",")
+		name := parts[0]
+		if name == "" {
+			name = f.Tag.Get("xml")
+			if idx := strings.Index(name, ","); idx != -1 {
+				name = name[:idx]
+			}
+		}
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		options := make(map[string]string)
+		for _, option := range parts[1:] {
+			if idx := strings.Index(option, "="); idx != -1 {
+				options[option[:idx]] = option[idx+1:]
+			} else if option != "" {
+				options[option] = ""
+			}
+		}
+		fp := fieldPlan{index: i, name: name, options: options}
+		fp.view, fp.hasView = options["view"]
+		fp.encode = newFieldEncoder(f.Type, &fp)
+		fp.decode = newFieldDecoder(f.Type, &fp)
+		p.fields = append(p.fields, fp)
+	}
+	for i := range p.fields {
+		p.byName[p.fields[i].name] = &p.fields[i]
+	}
+	// Go field names are accepted as well, unless shadowed by a tag.
+	for i := range p.fields {
+		name := t.Field(p.fields[i].index).Name
+		if _, ok := p.byName[name]; !ok {
+			p.byName[name] = &p.fields[i]
+		}
+	}
+	return p
+}
+
+// lookup returns the field for the member name. Lowercased names are
+// matched against the uppercased Go field name, as Go fields must be
+// exported.
+func (p *structPlan) lookup(name string) (*fieldPlan, bool) {
+	if f, ok := p.byName[name]; ok {
+		return f, true
+	}
+	f, ok := p.byName[uppercaseFirst(name)]
+	return f, ok
+}
+
+// checkType walks t, through pointers, arrays, slices, channels, map
+// values and the fields of the plans of structs, calling check for each
+// type met. It returns the first error of check, naming the field path it
+// was met at. The struct types the codec converts as a whole aren't walked
+// into.
+func checkType(t reflect.Type, check func(t reflect.Type) error) error {
+	return walkType(t, "", check, make(map[reflect.Type]bool))
+}
+
+func walkType(t reflect.Type, path string, check func(t reflect.Type) error, seen map[reflect.Type]bool) error {
+	if seen[t] {
+		return nil
+	}
+	seen[t] = true
+	if err := check(t); err != nil {
+		if path != "" {
+			return fmt.Errorf("%v in field %s", err, path)
+		}
+		return err
+	}
+	switch t.Kind() {
+	case reflect.Ptr, reflect.Array, reflect.Slice, reflect.Chan, reflect.Map:
+		return walkType(t.Elem(), path, check, seen)
+	case reflect.Struct:
+		if t == typeOfTime || t == typeOfBigInt || t == typeOfBlob {
+			return nil
+		}
+		plan := planFor(t)
+		for i := range plan.fields {
+			f := t.Field(plan.fields[i].index)
+			name := f.Name
+			if path != "" {
+				name = path + "." + name
+			}
+			if err := walkType(f.Type, name, check, seen); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkDecodable returns an error if the decoder can't decode into values
+// of type t, not counting the types t is made of.
+func (d *decoder) checkDecodable(t reflect.Type) error {
+	switch t.Kind() {
+	case reflect.Complex64, reflect.Complex128, reflect.Func, reflect.UnsafePointer, reflect.Uintptr:
+		return fmt.Errorf("xml: unsupported type %s", t)
+	case reflect.Map:
+		if t.Key().Kind() != reflect.String {
+			return fmt.Errorf("xml: unsupported map key type %s", t.Key())
+		}
+	}
+	return nil
+}
+
+// checkEncodable returns an error if the encoder can't encode values of
+// type t, not counting the types t is made of. Types left to the fallback
+// encoder are accepted.
+func (e *encoder) checkEncodable(t reflect.Type) error {
+	switch t.Kind() {
+	case reflect.Uintptr, reflect.Complex64, reflect.Complex128, reflect.Chan, reflect.Func, reflect.UnsafePointer:
+		if e.fallback == nil {
+			return fmt.Errorf("xml: unsupported type %s", t)
+		}
+	case reflect.Map:
+		if t.Key().Kind() != reflect.String && !e.stringifyKeys {
+			return fmt.Errorf("xml: unsupported map key type %s", t.Key())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+// Copyright 2013 Ivan Danyliuk
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xml
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+type StructPlanTagged struct {
+	Name     string `xml:"NAME"`
+	Age      int    `xml:"AGE,omitempty"`
+	Untagged bool
+	hidden   int
+}
+
+func TestStructPlan(t *testing.T) {
+	p := planFor(reflect.TypeOf(StructPlanTagged{}))
+	if p != planFor(reflect.TypeOf(StructPlanTagged{})) {
+		t.Error("expected the plan to be cached")
+	}
+
+	var names []string
+	for _, f := range p.fields {
+		names = append(names, f.name)
+	}
+	expected := []string{"NAME", "AGE", "Untagged"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected member names %v, got %v", expected, names)
+	}
+
+	for name, index := range map[string]int{"NAME": 0, "Name": 0, "AGE": 1, "untagged": 2} {
+		f, ok := p.lookup(name)
+		if !ok || f.index != index {
+			t.Errorf("expected %q to resolve to field %d", name, index)
+		}
+	}
+	if _, ok := p.lookup("hidden"); ok {
+		t.Error("unexported fields should not be resolved")
+	}
+}
+
+func BenchmarkStructPlanCached(b *testing.B) {
+	typ := reflect.TypeOf(StructXml2Rpc{})
+	for i := 0; i < b.N; i++ {
+		planFor(typ)
+	}
+}
+
+func BenchmarkStructPlanUncached(b *testing.B) {
+	typ := reflect.TypeOf(StructXml2Rpc{})
+	for i := 0; i < b.N; i++ {
+		newStructPlan(typ)
+	}
+}
+
+// benchmarkStruct is encoded and decoded by the benchmarks of the plan
+// cache.
+var benchmarkStruct = StructXml2Rpc{
+	Int:    123,
+	Float:  3.14,
+	Str:    "Hello, World!",
+	Bool:   true,
+	Sub:    SubStructXml2Rpc{42, "I'm Bar", []int{1, 2, 3}},
+	Time:   time.Date(2012, 7, 17, 14, 8, 55, 0, time.Local),
+	Base64: []byte("you can't read this!"),
+}
+
+// resetPlans empties the plan cache, for benchmarks without it.
+func resetPlans() {
+	structPlans.Range(func(key, _ interface{}) bool {
+		structPlans.Delete(key)
+		return true
+	})
+}
+
+func benchmarkEncode(b *testing.B, cached bool) {
+	e := new(encoder)
+	for i := 0; i < b.N; i++ {
+		if !cached {
+			resetPlans()
+		}
+		if _, err := e.rpcRequest2XML("Some.Method", &benchmarkStruct); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func benchmarkDecode(b *testing.B, cached bool) {
+	xml, err := rpcRequest2XML("Some.Method", &benchmarkStruct)
+	if err != nil {
+		b.Fatal(err)
+	}
+	d := new(decoder)
+	for i := 0; i < b.N; i++ {
+		if !cached {
+			resetPlans()
+		}
+		if err := d.xml2RPC(xml, new(StructXml2Rpc), nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkEncodeCached(b *testing.B)   { benchmarkEncode(b, true) }
+func BenchmarkEncodeUncached(b *testing.B) { benchmarkEncode(b, false) }
+func BenchmarkDecodeCached(b *testing.B)   { benchmarkDecode(b, true) }
+func BenchmarkDecodeUncached(b *testing.B) { benchmarkDecode(b, false) }
@@ -9,9 +9,12 @@ import (
 	"encoding/base64"
 	"encoding/xml"
 	"fmt"
-	"log"
+	"io"
+	"math"
+	"math/big"
 	"reflect"
 	"strconv"
+	"strings"
 	"time"
 	"unicode"
 	"unicode/utf8"
@@ -23,15 +26,10 @@ import (
 // Types used for unmarshalling
 type response struct {
 	Name   xml.Name   `xml:"methodResponse"`
-	Params []param    `xml:"params>param>value>struct"`
+	Params []param    `xml:"params>param"`
 	Fault  faultValue `xml:"fault,omitempty"`
 }
 
-type request struct {
-	Name   xml.Name   `xml:"methodCall"`
-	Params []param    `xml:"params>param>value>struct"`
-}
-
 type MethodCall struct {
 	XMLName    xml.Name `xml:"methodCall"`
 	Text       string   `xml:",chardata"`
@@ -62,11 +60,54 @@ type value struct {
 	String   string   `xml:"string"`
 	Int      string   `xml:"int"`
 	Int4     string   `xml:"i4"`
+	Int8     string   `xml:"i8"`
 	Double   string   `xml:"double"`
 	Boolean  string   `xml:"boolean"`
 	DateTime string   `xml:"dateTime.iso8601"`
 	Base64   string   `xml:"base64"`
 	Raw      string   `xml:",innerxml"` // the value can be defualt string
+	Other    *element `xml:",any"`      // an element of an unknown type
+}
+
+// element is an element of a type the decoder doesn't know, as in
+// <bigdecimal>1.5</bigdecimal>.
+type element struct {
+	XMLName xml.Name
+	Text    string `xml:",chardata"`
+}
+
+// intText returns the trimmed text of an <int>, <i4> or <i8> value, or an
+// empty string if the value is none of them.
+func (v value) intText() string {
+	for _, text := range []string{v.Int, v.Int4, v.Int8} {
+		if text = strings.TrimSpace(text); text != "" {
+			return text
+		}
+	}
+	return ""
+}
+
+// isBase64 reports whether the value is a <base64>, including an empty
+// one.
+func (v value) isBase64() bool {
+	return v.Base64 != "" || strings.HasPrefix(strings.TrimSpace(v.Raw), "<base64")
+}
+
+// isStruct reports whether the value is a <struct>, including an empty
+// one.
+func (v value) isStruct() bool {
+	return len(v.Struct) != 0 || strings.HasPrefix(strings.TrimSpace(v.Raw), "<struct")
+}
+
+// isArray reports whether the value is an <array>, including an empty
+// one.
+func (v value) isArray() bool {
+	return len(v.Array) != 0 || strings.HasPrefix(strings.TrimSpace(v.Raw), "<array")
+}
+
+// isNil reports whether the value is a <nil/>.
+func (v value) isNil() bool {
+	return v.Other != nil && v.Other.XMLName.Local == "nil"
 }
 
 type member struct {
@@ -74,15 +115,49 @@ type member struct {
 	Value value  `xml:"value"`
 }
 
-func xml2RPC1(xmlraw string, rpc interface{}) error {
+// decoder converts XML-RPC documents into Go values. Its zero value is
+// ready to use.
+type decoder struct {
+	// typeMember is the name of the member holding the discriminator of
+	// structs decoded into interfaces, "type" if empty.
+	typeMember string
+	// types maps discriminators to factories of the concrete types.
+	types map[string]func() interface{}
+	// wholeDoubles accepts doubles without a fractional part into int
+	// fields.
+	wholeDoubles bool
+	// lenientBools accepts integers into bool fields, zero being false.
+	lenientBools bool
+	// blobWriter returns the writer receiving the bytes of a Blob field,
+	// given its member name.
+	blobWriter func(name string) (io.Writer, error)
+	// blobs keeps the temporary files of the Blob fields being decoded,
+	// set by decodeBlobs.
+	blobs *tempBlobs
+	// strictTypes rejects values of unknown types instead of decoding
+	// their text as a string.
+	strictTypes bool
+	// fallback decodes values of unknown types, given the element name and
+	// its text.
+	fallback func(element, text string) (interface{}, error)
+	// transforms rewrite string fields tagged with their option names.
+	transforms map[string]Transform
+}
 
-	//log.Printf("wants to unmarshal %s",xmlraw)
+func xml2RPC(xmlraw string, rpc interface{}) error {
+	return decoder{}.decodeBlobs(nil, func(d *decoder) error {
+		return d.xml2RPC(xmlraw, rpc, nil)
+	})
+}
 
-	//jsn, _ := json.Marshal(rpc)
-	//log.Printf("wants to unmarshal %s",string(jsn))
+// xml2RPC decodes the params of a call or response into rpc. If the
+// document carries a fault and detail is not nil, the extra fault members
+// are decoded into detail.
+func (d *decoder) xml2RPC(xmlraw string, rpc, detail interface{}) error {
 
-	// Unmarshal raw XML into the temporal structure
-	var ret request
+	// Unmarshal raw XML into the temporal structure. Both methodCall and
+	// methodResponse documents share the params layout.
+	var ret response
 	decoder := xml.NewDecoder(bytes.NewReader([]byte(xmlraw)))
 	decoder.CharsetReader = charset.NewReader
 	err := decoder.Decode(&ret)
@@ -91,30 +166,47 @@ func xml2RPC1(xmlraw string, rpc interface{}) error {
 		return FaultDecode
 	}
 
-	//if !ret.Fault.IsEmpty() {
-	//	return getFaultResponse(ret.Fault)
-	//}
-
-	xmlS, _ := xml.Marshal(ret)
-	log.Printf("\n\n\n\n ======\n\n %s \n\n\n ========= \n",string(xmlS))
+	if !ret.Fault.IsEmpty() {
+		fault := getFaultResponse(ret.Fault)
+		if detail != nil {
+			if err := d.faultDetail2RPC(ret.Fault, detail); err != nil {
+				return err
+			}
+			fault.Detail = detail
+		}
+		return fault
+	}
 
-	// Structures should have equal number of fields
-	log.Printf("reflect.TypeOf(rpc).Elem().NumField() %d",reflect.TypeOf(rpc).Elem().NumField())
-	log.Printf("len(ret.Params) %d ",len(ret.Params))
+	// A call without params, or with an empty <params/>, leaves the
+	// passed rpc variable at its zero value.
+	if len(ret.Params) == 0 {
+		return nil
+	}
+	return d.value2RPC(ret.Params[0].Value, rpc)
+}
 
-	if reflect.TypeOf(rpc).Elem().NumField() != len(ret.Params) {
+// value2RPC decodes the value of the first param into rpc.
+func (d *decoder) value2RPC(value value, rpc interface{}) error {
 
-		//return FaultWrongArgumentsNumber
+	// Values other than structs, such as arrays, are decoded as is.
+	v := reflect.ValueOf(rpc).Elem()
+	if v.Kind() != reflect.Struct {
+		return d.value2Field(value, &v)
 	}
 
-	// Now, convert temporal structure into the
-	// passed rpc variable, according to it's structure
+	// Convert temporal structure into the passed rpc variable, matching
+	// members to fields by name. Members without a field, as for skipped
+	// fields, are ignored.
+	plan := planFor(v.Type())
+	for _, param := range value.Struct {
 
-	for i, param := range ret.Params {
+		f, ok := plan.lookup(param.Name)
+		if !ok {
+			continue
+		}
+		field := v.Field(f.index)
+		if err := d.member2Field(param.Value, &field, f); err != nil {
 
-		field := reflect.ValueOf(rpc).Elem().Field(i)
-		err = value2Field(param.Value, &field)
-		if err != nil {
 			return err
 		}
 	}
@@ -122,33 +214,32 @@ func xml2RPC1(xmlraw string, rpc interface{}) error {
 	return nil
 }
 
-func xml2RPC(xmlraw string, rpc interface{}) error {
-
-	// Unmarshal raw XML into the temporal structure
-	var ret MethodCall
-	decoder := xml.NewDecoder(bytes.NewReader([]byte(xmlraw)))
+// trailingData returns an error if anything but whitespace, comments or
+// processing instructions follows the root element of the document.
+func trailingData(rawxml []byte) error {
+	decoder := xml.NewDecoder(bytes.NewReader(rawxml))
 	decoder.CharsetReader = charset.NewReader
-	err := decoder.Decode(&ret)
-	if err != nil {
-
-		return FaultDecode
+	if err := decoder.Decode(new(struct{})); err != nil {
+		return err
 	}
-
-	// Structures should have equal number of fields
-	// Now, convert temporal structure into the
-	// passed rpc variable, according to it's structure
-
-	for i, param := range ret.Params.Param.Value.Struct.Member {
-
-		field := reflect.ValueOf(rpc).Elem().Field(i)
-		err = value2Field(param.Value, &field)
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return nil
+		}
 		if err != nil {
-
-			return err
+			return fmt.Errorf("rpc: trailing data after the root element: %v", err)
+		}
+		switch token := token.(type) {
+		case xml.Comment, xml.ProcInst:
+		case xml.CharData:
+			if len(bytes.TrimSpace(token)) != 0 {
+				return fmt.Errorf("rpc: trailing data after the root element: %q", token)
+			}
+		default:
+			return fmt.Errorf("rpc: trailing element after the root element")
 		}
 	}
-
-	return nil
 }
 
 // getFaultResponse converts faultValue to Fault.
@@ -173,12 +264,326 @@ func getFaultResponse(fault faultValue) Fault {
 	return Fault{Code: code, String: str}
 }
 
-func value2Field(value value, field *reflect.Value) error {
+// faultDetail2RPC decodes the fault members other than faultCode and
+// faultString into detail, which must be a pointer to a struct or a map
+// with string keys.
+func (d *decoder) faultDetail2RPC(fault faultValue, detail interface{}) error {
+	v := reflect.Indirect(reflect.ValueOf(detail))
+	switch v.Kind() {
+	case reflect.Struct:
+		plan := planFor(v.Type())
+		for _, m := range fault.Value.Struct {
+			if m.Name == "faultCode" || m.Name == "faultString" {
+				continue
+			}
+			fp, ok := plan.lookup(m.Name)
+			if !ok {
+				continue
+			}
+			f := v.Field(fp.index)
+			if err := d.member2Field(m.Value, &f, fp); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return FaultApplicationError
+		}
+		if v.IsNil() {
+			if !v.CanSet() {
+				return FaultApplicationError
+			}
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+		for _, m := range fault.Value.Struct {
+			if m.Name == "faultCode" || m.Name == "faultString" {
+				continue
+			}
+			item := reflect.New(v.Type().Elem()).Elem()
+			if err := d.value2Field(m.Value, &item); err != nil {
+				return err
+			}
+			v.SetMapIndex(reflect.ValueOf(m.Name).Convert(v.Type().Key()), item)
+		}
+	default:
+		return FaultApplicationError
+	}
+	return nil
+}
+
+// struct2Map decodes the members of a struct into a map field with string
+// keys. Members of a map[string]interface{} get the natural Go type of
+// their XML-RPC type, as with value2Interface. An empty struct gives an
+// empty, non-nil map.
+func (d *decoder) struct2Map(members []member, field *reflect.Value) error {
+	t := field.Type()
+	if t.Key().Kind() != reflect.String {
+		fault := FaultInvalidParams
+		fault.String += fmt.Sprintf(": map keys must be strings, not %s", t.Key())
+		return fault
+	}
+	m := reflect.MakeMapWithSize(t, len(members))
+	for _, member := range members {
+		item := reflect.New(t.Elem()).Elem()
+		if err := d.value2Field(member.Value, &item); err != nil {
+			return err
+		}
+		m.SetMapIndex(reflect.ValueOf(member.Name).Convert(t.Key()), item)
+	}
+	field.Set(m)
+	return nil
+}
+
+// value2Interface converts value into the natural Go type for its XML-RPC
+// type. Structs become map[string]interface{} and arrays []interface{}.
+func value2Interface(value value) (interface{}, error) {
+
+	switch {
+
+	case value.Int != "":
+		return strconv.Atoi(value.Int)
+
+	case value.Int4 != "":
+		return strconv.Atoi(value.Int4)
+
+	case value.Int8 != "":
+		return strconv.Atoi(value.Int8)
+
+	case value.Double != "":
+		return strconv.ParseFloat(value.Double, 64)
+
+	case value.String != "":
+		return value.String, nil
+
+	case value.Boolean != "":
+		return xml2Bool(value.Boolean), nil
+
+	case value.DateTime != "":
+		return xml2DateTime(value.DateTime)
+
+	case value.isBase64():
+		return xml2Base64(value.Base64)
+
+	case value.isStruct():
+		m := make(map[string]interface{}, len(value.Struct))
+		for _, member := range value.Struct {
+			item, err := value2Interface(member.Value)
+			if err != nil {
+				return nil, err
+			}
+			m[member.Name] = item
+		}
+		return m, nil
+
+	case value.isArray():
+		a := make([]interface{}, len(value.Array))
+		for i, v := range value.Array {
+			item, err := value2Interface(v)
+			if err != nil {
+				return nil, err
+			}
+			a[i] = item
+		}
+		return a, nil
+	}
+
+	if value.Raw == "<nil/>" {
+		return nil, nil
+	}
+	return value.Raw, nil
+}
+
+// newType returns a new value of the type registered for the
+// discriminator of a struct value, if any.
+func (d *decoder) newType(value value) (interface{}, bool) {
+	if len(d.types) == 0 || len(value.Struct) == 0 {
+		return nil, false
+	}
+	typeMember := d.typeMember
+	if typeMember == "" {
+		typeMember = "type"
+	}
+	for _, m := range value.Struct {
+		if m.Name != typeMember {
+			continue
+		}
+		discriminator := m.Value.String
+		if discriminator == "" {
+			discriminator = m.Value.Raw
+		}
+		if factory, ok := d.types[discriminator]; ok {
+			return factory(), true
+		}
+		break
+	}
+	return nil, false
+}
+
+// value2Type decodes a struct value into obj, a value returned by a
+// registered factory, and stores it into the interface field.
+func (d *decoder) value2Type(value value, field *reflect.Value, obj interface{}) error {
+	v := reflect.ValueOf(obj)
+	target := reflect.Indirect(v)
+	if err := d.value2Field(value, &target); err != nil {
+		return err
+	}
+	switch {
+	case v.Type().AssignableTo(field.Type()):
+		field.Set(v)
+	case target.Type().AssignableTo(field.Type()):
+		field.Set(target)
+	default:
+		fault := FaultInvalidParams
+		fault.String += fmt.Sprintf(": fields type mismatch: %s != %s", v.Type(), field.Type())
+		return fault
+	}
+	return nil
+}
+
+// member2Field decodes the value of a struct member into its field,
+// applying the options of the field's xmlrpc tag.
+func (d *decoder) member2Field(value value, field *reflect.Value, f *fieldPlan) error {
+	return f.decode(d, value, field, f)
+}
+
+// newFieldDecoder returns the decoder of members into fields of type t with
+// the options of f. Values the options don't apply to are decoded by
+// value2Field, followed by the transforms of string fields with options.
+func newFieldDecoder(t reflect.Type, f *fieldPlan) fieldDecoder {
+	decode := func(d *decoder, value value, field *reflect.Value, f *fieldPlan) error {
+		return d.value2Field(value, field)
+	}
+	if t.Kind() == reflect.String && len(f.options) > 0 {
+		decode = func(d *decoder, value value, field *reflect.Value, f *fieldPlan) error {
+			if err := d.value2Field(value, field); err != nil {
+				return err
+			}
+			return d.transform(field, f)
+		}
+	}
+	if t == typeOfBlob {
+		return func(d *decoder, value value, field *reflect.Value, f *fieldPlan) error {
+			if value.Base64 != "" {
+				return d.base642Blob(value, field, f.name)
+			}
+			return decode(d, value, field, f)
+		}
+	}
+	if f.options["datetime"] == "unix" {
+		switch t.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			return func(d *decoder, value value, field *reflect.Value, f *fieldPlan) error {
+				if value.DateTime == "" {
+					return decode(d, value, field, f)
+				}
+				if !field.CanSet() {
+					return FaultApplicationError
+				}
+				t, err := xml2DateTime(value.DateTime)
+				if err != nil {
+					return err
+				}
+				field.SetInt(t.Unix())
+				return nil
+			}
+		}
+	}
+	if unit, ok := f.epochUnit(); ok && t == typeOfTime {
+		return func(d *decoder, value value, field *reflect.Value, f *fieldPlan) error {
+			text := value.intText()
+			if text == "" {
+				return decode(d, value, field, f)
+			}
+			if !field.CanSet() {
+				return FaultApplicationError
+			}
+			n, err := strconv.ParseInt(text, 10, 64)
+			if err != nil {
+				fault := FaultInvalidParams
+				fault.String += fmt.Sprintf(": invalid epoch %q for %s", text, f.name)
+				return fault
+			}
+			at := time.Unix(n, 0)
+			if unit == time.Millisecond {
+				at = time.UnixMilli(n)
+			}
+			field.Set(reflect.ValueOf(at))
+			return nil
+		}
+	}
+	return decode
+}
+
+func (d *decoder) value2Field(value value, field *reflect.Value) error {
 
 	if !field.CanSet() {
 		return FaultApplicationError
 	}
 
+	if value.Other != nil && !value.isNil() {
+		return d.unknown2Field(*value.Other, field)
+	}
+
+	if field.Type() == typeOfBigInt || field.Type() == reflect.PtrTo(typeOfBigInt) {
+		return bigInt2Field(value, field)
+	}
+
+	if field.Kind() == reflect.Ptr {
+		if value.isNil() {
+			field.Set(reflect.Zero(field.Type()))
+			return nil
+		}
+		ptr := reflect.New(field.Type().Elem())
+		elem := ptr.Elem()
+		if err := d.value2Field(value, &elem); err != nil {
+			return err
+		}
+		field.Set(ptr)
+		return nil
+	}
+
+	if field.Kind() == reflect.Chan {
+		return d.array2Chan(value, field)
+	}
+
+	if d.lenientBools && field.Kind() == reflect.Bool {
+		if text := value.Int + value.Int4 + value.Int8; text != "" {
+			n, err := strconv.Atoi(strings.TrimSpace(text))
+			if err != nil {
+				fault := FaultInvalidParams
+				fault.String += fmt.Sprintf(": invalid integer %q", text)
+				return fault
+			}
+			field.SetBool(n != 0)
+			return nil
+		}
+	}
+
+	if text := value.Int + value.Int4 + value.Int8; text != "" {
+		switch field.Kind() {
+		case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			return int2Field(text, field)
+		}
+	}
+
+	if field.Kind() == reflect.Interface {
+		if obj, ok := d.newType(value); ok {
+			return d.value2Type(value, field, obj)
+		}
+		val, err := value2Interface(value)
+		if err != nil || val == nil {
+			return err
+		}
+		if !reflect.TypeOf(val).AssignableTo(field.Type()) {
+			fault := FaultInvalidParams
+			fault.String += fmt.Sprintf(": fields type mismatch: %s != %s", reflect.TypeOf(val), field.Type())
+			return fault
+		}
+		field.Set(reflect.ValueOf(val))
+		return nil
+	}
+
 	var (
 		err error
 		val interface{}
@@ -192,8 +597,20 @@ func value2Field(value value, field *reflect.Value) error {
 	case value.Int4 != "":
 		val, _ = strconv.Atoi(value.Int4)
 
+	case value.Int8 != "":
+		val, _ = strconv.Atoi(value.Int8)
+
 	case value.Double != "":
 		val, _ = strconv.ParseFloat(value.Double, 64)
+		if d.wholeDoubles && isIntKind(field.Kind()) {
+			f := val.(float64)
+			if f != math.Trunc(f) {
+				fault := FaultInvalidParams
+				fault.String += fmt.Sprintf(": double %s is not a whole number", value.Double)
+				return fault
+			}
+			return int2Field(strconv.FormatFloat(f, 'f', -1, 64), field)
+		}
 
 	case value.String != "":
 		val = value.String
@@ -204,9 +621,12 @@ func value2Field(value value, field *reflect.Value) error {
 	case value.DateTime != "":
 		val, err = xml2DateTime(value.DateTime)
 
-	case value.Base64 != "":
+	case value.isBase64():
 		val, err = xml2Base64(value.Base64)
 
+	case field.Kind() == reflect.Map && value.isStruct():
+		return d.struct2Map(value.Struct, field)
+
 	case len(value.Struct) != 0:
 
 		if field.Kind() != reflect.Struct {
@@ -217,26 +637,40 @@ func value2Field(value value, field *reflect.Value) error {
 
 		}
 
+		plan := planFor(field.Type())
 		s := value.Struct
 		for i := 0; i < len(s); i++ {
-			// Uppercase first letter for field name to deal with
-			// methods in lowercase, which cannot be used
-			field_name := uppercaseFirst(s[i].Name)
-			f := field.FieldByName(field_name)
-			err = value2Field(s[i].Value, &f)
+			// Members are matched by their tag-resolved name, lowercased
+			// names fall back to the uppercased Go field name
+			fp, ok := plan.lookup(s[i].Name)
+			if !ok {
+				continue
+			}
+			f := field.Field(fp.index)
+			if err = d.member2Field(s[i].Value, &f, fp); err != nil {
+				return err
+			}
 		}
 
-	case len(value.Array) != 0:
+	case value.isArray():
+		if field.Kind() != reflect.Slice {
+			fault := FaultInvalidParams
+			fault.String += fmt.Sprintf(": array fields mismatch: %s != %s", field.Kind(), reflect.Slice.String())
+			return fault
+		}
+		// An empty array decodes to an empty, non-nil slice.
 		a := value.Array
-		f := *field
-		slice := reflect.MakeSlice(reflect.TypeOf(f.Interface()),
-			len(a), len(a))
+		slice := reflect.MakeSlice(field.Type(), len(a), len(a))
 		for i := 0; i < len(a); i++ {
 			item := slice.Index(i)
-			err = value2Field(a[i], &item)
+			if err := d.value2Field(a[i], &item); err != nil {
+				return err
+			}
+		}
+		if field.Len() != 0 {
+			slice = reflect.AppendSlice(*field, slice)
 		}
-		f = reflect.AppendSlice(f, slice)
-		val = f.Interface()
+		val = slice.Interface()
 	case len(value.Array) == 0:
 		val = val
 
@@ -249,6 +683,9 @@ func value2Field(value value, field *reflect.Value) error {
 	}
 
 	if val != nil {
+		if v, ok := convertNumber(reflect.ValueOf(val), field.Type()); ok {
+			val = v.Interface()
+		}
 		if reflect.TypeOf(val) != reflect.TypeOf(field.Interface()) {
 			fault := FaultInvalidParams
 			fault.String += fmt.Sprintf(": fields type mismatch: %s != %s",
@@ -263,6 +700,175 @@ func value2Field(value value, field *reflect.Value) error {
 	return err
 }
 
+// isIntKind reports whether k is a signed or unsigned integer kind.
+func isIntKind(k reflect.Kind) bool {
+	switch k {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return true
+	}
+	return false
+}
+
+// int2Field decodes the text of an <int>, <i4> or <i8> into a sized or
+// unsigned integer field, rejecting values overflowing the field.
+func int2Field(text string, field *reflect.Value) error {
+	text = strings.TrimSpace(text)
+	var err error
+	switch field.Kind() {
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		var n uint64
+		if n, err = strconv.ParseUint(text, 10, field.Type().Bits()); err == nil {
+			field.SetUint(n)
+		}
+	default:
+		var n int64
+		if n, err = strconv.ParseInt(text, 10, field.Type().Bits()); err == nil {
+			field.SetInt(n)
+		}
+	}
+	if err != nil {
+		fault := FaultInvalidParams
+		fault.String += fmt.Sprintf(": invalid integer %q for %s", text, field.Type())
+		return fault
+	}
+	return nil
+}
+
+// convertNumber converts the number v to the numeric type t, as in an
+// <int> decoded into a float64 field, when no information is lost: integers
+// must fit in t, and within the range floating point types represent
+// exactly, 2^24 for float32 and 2^53 for float64, and floats must fit in
+// float32. Floats are never converted to integers. ok
+// is false for values that can't be converted safely, and for non numeric
+// types.
+func convertNumber(v reflect.Value, t reflect.Type) (converted reflect.Value, ok bool) {
+	if v.Type() == t {
+		return v, false
+	}
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n := v.Int()
+		switch t.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			ok = !reflect.Zero(t).OverflowInt(n)
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			ok = n >= 0 && !reflect.Zero(t).OverflowUint(uint64(n))
+		case reflect.Float32:
+			ok = -1<<24 <= n && n <= 1<<24
+		case reflect.Float64:
+			ok = -1<<53 <= n && n <= 1<<53
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n := v.Uint()
+		switch t.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			ok = n <= math.MaxInt64 && !reflect.Zero(t).OverflowInt(int64(n))
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			ok = !reflect.Zero(t).OverflowUint(n)
+		case reflect.Float32:
+			ok = n <= 1<<24
+		case reflect.Float64:
+			ok = n <= 1<<53
+		}
+	case reflect.Float32, reflect.Float64:
+		switch t.Kind() {
+		case reflect.Float32, reflect.Float64:
+			ok = !reflect.Zero(t).OverflowFloat(v.Float())
+		}
+	}
+	if !ok {
+		return v, false
+	}
+	return v.Convert(t), true
+}
+
+// unknown2Field decodes a value of an unknown type into field, with the
+// fallback decoder if any. Otherwise the value is rejected in strict mode,
+// and its text decoded as a string in lenient mode.
+func (d *decoder) unknown2Field(e element, field *reflect.Value) error {
+	var val interface{} = e.Text
+	if d.fallback != nil {
+		var err error
+		if val, err = d.fallback(e.XMLName.Local, e.Text); err != nil {
+			return err
+		}
+		if val == nil {
+			return nil
+		}
+	} else if d.strictTypes {
+		fault := FaultInvalidParams
+		fault.String += fmt.Sprintf(": unknown value type <%s>", e.XMLName.Local)
+		return fault
+	}
+	v := reflect.ValueOf(val)
+	if converted, ok := convertNumber(v, field.Type()); ok {
+		v = converted
+	}
+	if v.Type() != field.Type() && !(field.Kind() == reflect.Interface && v.Type().AssignableTo(field.Type())) {
+		fault := FaultInvalidParams
+		fault.String += fmt.Sprintf(": fields type mismatch: %s != %s", v.Type(), field.Type())
+		return fault
+	}
+	field.Set(v)
+	return nil
+}
+
+// array2Chan decodes an array into a channel field, which receives the
+// elements in order and is then closed.
+//
+// The whole call is decoded before the method runs, so the channel is
+// buffered to hold every element and is already closed when the method
+// receives it: the method can range over it, or hand it to another
+// goroutine, without ever blocking the decoder. A value other than an array
+// decodes into a closed empty channel.
+func (d *decoder) array2Chan(value value, field *reflect.Value) error {
+	elemType := field.Type().Elem()
+	ch := reflect.MakeChan(reflect.ChanOf(reflect.BothDir, elemType), len(value.Array))
+	for _, v := range value.Array {
+		item := reflect.New(elemType).Elem()
+		if err := d.value2Field(v, &item); err != nil {
+			return err
+		}
+		ch.Send(item)
+	}
+	ch.Close()
+	field.Set(ch)
+	return nil
+}
+
+var typeOfBigInt = reflect.TypeOf(big.Int{})
+
+// bigInt2Field decodes an integer or a string value into a big.Int or
+// *big.Int field.
+func bigInt2Field(value value, field *reflect.Value) error {
+	var text string
+	switch {
+	case value.Int != "":
+		text = value.Int
+	case value.Int4 != "":
+		text = value.Int4
+	case value.Int8 != "":
+		text = value.Int8
+	case value.String != "":
+		text = value.String
+	default:
+		return nil
+	}
+	b, ok := new(big.Int).SetString(strings.TrimSpace(text), 10)
+	if !ok {
+		fault := FaultInvalidParams
+		fault.String += fmt.Sprintf(": invalid integer %q", text)
+		return fault
+	}
+	if field.Kind() == reflect.Ptr {
+		field.Set(reflect.ValueOf(b))
+	} else {
+		field.Set(reflect.ValueOf(b).Elem())
+	}
+	return nil
+}
+
 func xml2Bool(value string) bool {
 
 	var b bool
@@ -275,7 +881,30 @@ func xml2Bool(value string) bool {
 	return b
 }
 
+// dateTimeLayouts are the accepted dateTime layouts besides the plain
+// XML-RPC one, both with a timezone offset and in the xs:dateTime form. An
+// offset is kept in the decoded time, values without one are local.
+var dateTimeLayouts = []string{
+	"20060102T15:04:05Z07:00",
+	"2006-01-02T15:04:05Z07:00",
+	"2006-01-02T15:04:05",
+}
+
+// zeroDateTime is the encoding of the zero time.Time, decoded back into
+// the zero time.Time regardless of the local timezone.
+const zeroDateTime = "00010101T00:00:00"
+
 func xml2DateTime(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if value == zeroDateTime {
+		return time.Time{}, nil
+	}
+	for _, layout := range dateTimeLayouts {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+
 	var (
 		year, month, day     int
 		hour, minute, second int
@@ -287,8 +916,10 @@ func xml2DateTime(value string) (time.Time, error) {
 	return t, err
 }
 
+// xml2Base64 decodes a base64 value. An empty value decodes into an empty,
+// non-nil slice.
 func xml2Base64(value string) ([]byte, error) {
-	return base64.StdEncoding.DecodeString(value)
+	return base64.StdEncoding.DecodeString(strings.TrimSpace(value))
 }
 
 func uppercaseFirst(in string) (out string) {
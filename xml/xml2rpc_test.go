@@ -5,7 +5,10 @@
 package xml
 
 import (
+	"math/big"
 	"reflect"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
@@ -155,3 +158,443 @@ Requiredattribute'user'notfound:
 		}
 	}
 }
+
+type StructUnixTimeXml2Rpc struct {
+	Created int64 `xmlrpc:"CREATED,datetime=unix"`
+}
+
+func TestXML2RPCUnixDateTime(t *testing.T) {
+	created := time.Date(2021, time.March, 4, 5, 6, 7, 0, time.Local).Unix()
+	xml, err := rpcRequest2XML("Some.Method", &StructUnixTimeXml2Rpc{created})
+	if err != nil {
+		t.Error("RPC2XML conversion failed", err)
+	}
+	expected := "<methodCall><methodName>Some.Method</methodName><params><param><value><struct><member><name>CREATED</name><value><dateTime.iso8601>20210304T05:06:07</dateTime.iso8601></value></member></struct></value></param></params></methodCall>"
+	if xml != expected {
+		t.Error("RPC2XML conversion failed")
+		t.Error("Expected", expected)
+		t.Error("Got", xml)
+	}
+
+	req := new(StructUnixTimeXml2Rpc)
+	if err := xml2RPC(xml, req); err != nil {
+		t.Error("XML2RPC conversion failed", err)
+	}
+	if req.Created != created {
+		t.Errorf("Expected %d, got %d", created, req.Created)
+	}
+}
+
+type StructEpochXml2Rpc struct {
+	Seconds time.Time `xmlrpc:"SECONDS,epoch=s"`
+	Millis  time.Time `xmlrpc:"MILLIS,epoch=ms"`
+}
+
+func TestXML2RPCEpoch(t *testing.T) {
+	at := time.Date(2021, time.March, 4, 5, 6, 7, 890e6, time.UTC)
+	xml, err := rpcRequest2XML("Some.Method", &StructEpochXml2Rpc{at.Truncate(time.Second), at})
+	if err != nil {
+		t.Error("RPC2XML conversion failed", err)
+	}
+	expected := "<methodCall><methodName>Some.Method</methodName><params><param><value><struct><member><name>SECONDS</name><value><i8>1614834367</i8></value></member><member><name>MILLIS</name><value><i8>1614834367890</i8></value></member></struct></value></param></params></methodCall>"
+	if xml != expected {
+		t.Error("RPC2XML conversion failed")
+		t.Error("Expected", expected)
+		t.Error("Got", xml)
+	}
+
+	// Plain <int> values decode as well.
+	xml = "<methodCall><methodName>Some.Method</methodName><params><param><value><struct><member><name>SECONDS</name><value><int>1614834367</int></value></member><member><name>MILLIS</name><value><i8>1614834367890</i8></value></member></struct></value></param></params></methodCall>"
+	req := new(StructEpochXml2Rpc)
+	if err := xml2RPC(xml, req); err != nil {
+		t.Error("XML2RPC conversion failed", err)
+	}
+	if !req.Seconds.Equal(at.Truncate(time.Second)) {
+		t.Errorf("Expected %v, got %v", at.Truncate(time.Second), req.Seconds)
+	}
+	if !req.Millis.Equal(at) {
+		t.Errorf("Expected %v, got %v", at, req.Millis)
+	}
+}
+
+type StructTagsXml2Rpc struct {
+	Both     string `xmlrpc:"RPC_NAME" xml:"xml_name"`
+	XMLOnly  string `xml:"XML_ONLY,attr"`
+	Plain    string
+	Skipped  string `xmlrpc:"-" xml:"skipped"`
+	Internal string `xml:"-"`
+}
+
+func TestXML2RPCTags(t *testing.T) {
+	xml, err := rpcRequest2XML("Some.Method", &StructTagsXml2Rpc{"a", "b", "c", "d", "e"})
+	if err != nil {
+		t.Error("RPC2XML conversion failed", err)
+	}
+	expected := "<methodCall><methodName>Some.Method</methodName><params><param><value><struct><member><name>RPC_NAME</name><value><string>a</string></value></member><member><name>XML_ONLY</name><value><string>b</string></value></member><member><name>Plain</name><value><string>c</string></value></member></struct></value></param></params></methodCall>"
+	if xml != expected {
+		t.Error("RPC2XML conversion failed")
+		t.Error("Expected", expected)
+		t.Error("Got", xml)
+	}
+
+	xml = "<methodCall><methodName>Some.Method</methodName><params><param><value><struct><member><name>RPC_NAME</name><value><string>a</string></value></member><member><name>xml_name</name><value><string>x</string></value></member><member><name>skipped</name><value><string>d</string></value></member></struct></value></param></params></methodCall>"
+	req := new(StructTagsXml2Rpc)
+	if err := xml2RPC(xml, req); err != nil {
+		t.Error("XML2RPC conversion failed", err)
+	}
+	if expected := (StructTagsXml2Rpc{Both: "a"}); *req != expected {
+		t.Errorf("Expected %+v, got %+v", expected, *req)
+	}
+}
+
+func TestXML2RPCUnmappedMembers(t *testing.T) {
+	// More members than fields, as skipped fields are sent by clients
+	// sharing the struct.
+	xml := "<methodCall><methodName>Some.Method</methodName><params><param><value><struct>" +
+		"<member><name>RPC_NAME</name><value><string>a</string></value></member>" +
+		"<member><name>XML_ONLY</name><value><string>b</string></value></member>" +
+		"<member><name>Plain</name><value><string>c</string></value></member>" +
+		"<member><name>Skipped</name><value><string>d</string></value></member>" +
+		"<member><name>Internal</name><value><string>e</string></value></member>" +
+		"<member><name>Unknown</name><value><int>1</int></value></member>" +
+		"</struct></value></param></params></methodCall>"
+	req := new(StructTagsXml2Rpc)
+	if err := xml2RPC(xml, req); err != nil {
+		t.Error("XML2RPC conversion failed", err)
+	}
+	if expected := (StructTagsXml2Rpc{Both: "a", XMLOnly: "b", Plain: "c"}); *req != expected {
+		t.Errorf("Expected %+v, got %+v", expected, *req)
+	}
+}
+
+type StructArraysXml2Rpc struct {
+	Ints   []int
+	Names  []string
+	Items  []StructSpecialCharsXml2Rpc
+	Nested [][]StructSpecialCharsXml2Rpc
+	Empty  []string
+}
+
+func TestXML2RPCArraysRoundTrip(t *testing.T) {
+	in := &StructArraysXml2Rpc{
+		Ints:   []int{1, 2, 3},
+		Names:  []string{"a", "b"},
+		Items:  []StructSpecialCharsXml2Rpc{{"x"}, {"y"}},
+		Nested: [][]StructSpecialCharsXml2Rpc{{{"p"}, {"q"}}, {}},
+		Empty:  []string{},
+	}
+	xml, err := rpcResponse2XML(in)
+	if err != nil {
+		t.Fatal("RPC2XML conversion failed", err)
+	}
+	for _, expected := range []string{
+		"<name>Ints</name><value><array><data><value><int>1</int></value><value><int>2</int></value><value><int>3</int></value></data></array></value>",
+		"<name>Names</name><value><array><data><value><string>a</string></value><value><string>b</string></value></data></array></value>",
+		"<name>Items</name><value><array><data><value><struct>",
+		"<name>Nested</name><value><array><data><value><array><data><value><struct>",
+		"<name>Empty</name><value><array><data></data></array></value>",
+	} {
+		if !strings.Contains(xml, expected) {
+			t.Errorf("Expected %s in %s", expected, xml)
+		}
+	}
+
+	out := new(StructArraysXml2Rpc)
+	if err := xml2RPC(xml, out); err != nil {
+		t.Fatal("XML2RPC conversion failed", err)
+	}
+	if !reflect.DeepEqual(out, in) {
+		t.Errorf("Expected %+v, got %+v", in, out)
+	}
+	if out.Empty == nil || out.Nested[1] == nil {
+		t.Error("Expected empty arrays to decode to non-nil slices")
+	}
+}
+
+type StructCDATAXml2Rpc struct {
+	Menu  string
+	Any   interface{}
+	Inner StructSpecialCharsXml2Rpc
+}
+
+func TestXML2RPCCDATA(t *testing.T) {
+	req := new(StructCDATAXml2Rpc)
+	err := xml2RPC("<methodCall><methodName>Some.Method</methodName><params><param><value><struct>"+
+		"<member><name>Menu</name><value><string><![CDATA[<b>menu</b>]]></string></value></member>"+
+		"<member><name>Any</name><value><string>1. <![CDATA[<i>Balance</i>]]> &amp; more</string></value></member>"+
+		"<member><name>Inner</name><value><struct><member><name>String1</name><value><string><![CDATA[a & b]]></string></value></member></struct></value></member>"+
+		"</struct></value></param></params></methodCall>", req)
+	if err != nil {
+		t.Error("XML2RPC conversion failed", err)
+	}
+	expected_req := &StructCDATAXml2Rpc{"<b>menu</b>", "1. <i>Balance</i> & more", StructSpecialCharsXml2Rpc{"a & b"}}
+	if !reflect.DeepEqual(req, expected_req) {
+		t.Error("XML2RPC conversion failed")
+		t.Error("Expected", expected_req)
+		t.Error("Got", req)
+	}
+}
+
+type StructTimeXml2Rpc struct {
+	Time time.Time
+}
+
+func TestXML2RPCDateTimeOffsets(t *testing.T) {
+	tests := []struct {
+		value  string
+		offset int
+	}{
+		{"2023-11-02T10:20:30+03:00", 3 * 3600},
+		{"20231102T10:20:30-05:30", -(5*3600 + 30*60)},
+		{"2023-11-02T10:20:30Z", 0},
+	}
+	for _, test := range tests {
+		req := new(StructTimeXml2Rpc)
+		err := xml2RPC("<methodCall><methodName>Some.Method</methodName><params><param><value><struct><member><name>Time</name><value><dateTime.iso8601>"+
+			test.value+"</dateTime.iso8601></value></member></struct></value></param></params></methodCall>", req)
+		if err != nil {
+			t.Error("XML2RPC conversion failed", err)
+		}
+		if _, offset := req.Time.Zone(); offset != test.offset {
+			t.Errorf("%s: offset was %d, should be %d", test.value, offset, test.offset)
+		}
+		if req.Time.Hour() != 10 || req.Time.Minute() != 20 || req.Time.Second() != 30 {
+			t.Errorf("%s: wrong time %v", test.value, req.Time)
+		}
+	}
+}
+
+type StructBigIntXml2Rpc struct {
+	ID    *big.Int
+	Small *big.Int
+}
+
+func TestXML2RPCBigInt(t *testing.T) {
+	id, _ := new(big.Int).SetString("92233720368547758070", 10)
+	xml, err := rpcRequest2XML("Some.Method", &StructBigIntXml2Rpc{id, big.NewInt(42)})
+	if err != nil {
+		t.Error("RPC2XML conversion failed", err)
+	}
+	expected := "<methodCall><methodName>Some.Method</methodName><params><param><value><struct><member><name>ID</name><value><string>92233720368547758070</string></value></member><member><name>Small</name><value><i8>42</i8></value></member></struct></value></param></params></methodCall>"
+	if xml != expected {
+		t.Error("RPC2XML conversion failed")
+		t.Error("Expected", expected)
+		t.Error("Got", xml)
+	}
+
+	req := new(StructBigIntXml2Rpc)
+	if err := xml2RPC(xml, req); err != nil {
+		t.Error("XML2RPC conversion failed", err)
+	}
+	if req.ID == nil || req.ID.Cmp(id) != 0 || req.Small == nil || req.Small.Int64() != 42 {
+		t.Errorf("Expected %v and 42, got %v and %v", id, req.ID, req.Small)
+	}
+}
+
+type StructIntXml2Rpc struct {
+	Count int
+}
+
+type StructSizedIntXml2Rpc struct {
+	Count uint8
+}
+
+func TestXML2RPCWholeDoubles(t *testing.T) {
+	call := func(double string) string {
+		return "<methodCall><methodName>Some.Method</methodName><params><param><value><struct><member><name>Count</name><value><double>" +
+			double + "</double></value></member></struct></value></param></params></methodCall>"
+	}
+	d := &decoder{wholeDoubles: true}
+
+	req := new(StructIntXml2Rpc)
+	if err := d.xml2RPC(call("5.0"), req, nil); err != nil {
+		t.Error("XML2RPC conversion failed", err)
+	}
+	if req.Count != 5 {
+		t.Errorf("Expected 5, got %d", req.Count)
+	}
+
+	err := d.xml2RPC(call("5.5"), new(StructIntXml2Rpc), nil)
+	if fault, ok := err.(Fault); !ok || fault.Code != FaultInvalidParams.Code {
+		t.Errorf("Expected an invalid params fault, got %v", err)
+	}
+
+	// Sized and unsigned fields get the same check, and overflow faults.
+	sized := new(StructSizedIntXml2Rpc)
+	if err := d.xml2RPC(call("200.0"), sized, nil); err != nil || sized.Count != 200 {
+		t.Errorf("Expected 200, got %d, %v", sized.Count, err)
+	}
+	for _, double := range []string{"2.5", "256.0", "-1.0"} {
+		err := d.xml2RPC(call(double), new(StructSizedIntXml2Rpc), nil)
+		if fault, ok := err.(Fault); !ok || fault.Code != FaultInvalidParams.Code {
+			t.Errorf("Expected an invalid params fault for %s, got %v", double, err)
+		}
+	}
+
+	// Doubles are rejected by default.
+	if err := xml2RPC(call("5.0"), new(StructIntXml2Rpc)); err == nil {
+		t.Error("Expected an error decoding a double into an int by default")
+	}
+}
+
+type StructUnknownTypeXml2Rpc struct {
+	Amount string
+	Note   interface{}
+}
+
+func TestXML2RPCUnknownType(t *testing.T) {
+	call := "<methodCall><methodName>Some.Method</methodName><params><param><value><struct>" +
+		"<member><name>Amount</name><value><bigdecimal>12.50</bigdecimal></value></member>" +
+		"<member><name>Note</name><value><nil/></value></member>" +
+		"</struct></value></param></params></methodCall>"
+
+	// Lenient by default.
+	req := new(StructUnknownTypeXml2Rpc)
+	if err := xml2RPC(call, req); err != nil {
+		t.Error("XML2RPC conversion failed", err)
+	}
+	if req.Amount != "12.50" || req.Note != nil {
+		t.Errorf("Expected 12.50 and nil, got %q and %v", req.Amount, req.Note)
+	}
+
+	d := &decoder{strictTypes: true}
+	err := d.xml2RPC(call, new(StructUnknownTypeXml2Rpc), nil)
+	if fault, ok := err.(Fault); !ok || fault.Code != FaultInvalidParams.Code {
+		t.Errorf("Expected an invalid params fault, got %v", err)
+	}
+
+	var elements []string
+	d.fallback = func(element, text string) (interface{}, error) {
+		elements = append(elements, element)
+		return "$" + text, nil
+	}
+	req = new(StructUnknownTypeXml2Rpc)
+	if err := d.xml2RPC(call, req, nil); err != nil {
+		t.Error("XML2RPC conversion failed", err)
+	}
+	if req.Amount != "$12.50" || len(elements) != 1 || elements[0] != "bigdecimal" {
+		t.Errorf("Expected $12.50 from the bigdecimal fallback, got %q from %v", req.Amount, elements)
+	}
+
+	d.fallback = func(element, text string) (interface{}, error) {
+		return 12.5, nil
+	}
+	err = d.xml2RPC(call, new(StructUnknownTypeXml2Rpc), nil)
+	if fault, ok := err.(Fault); !ok || fault.Code != FaultInvalidParams.Code {
+		t.Errorf("Expected an invalid params fault for a mismatched type, got %v", err)
+	}
+}
+
+type StructBase64Xml2Rpc struct {
+	Signature []byte
+	Empty     []byte
+}
+
+func TestXML2RPCBase64RoundTrip(t *testing.T) {
+	in := &StructBase64Xml2Rpc{Signature: []byte{0, 1, 0, 255, 'G', 'I', 'F', 0}, Empty: []byte{}}
+	xml, err := rpcRequest2XML("Some.Method", in)
+	if err != nil {
+		t.Error("RPC2XML conversion failed", err)
+	}
+	expected := "<methodCall><methodName>Some.Method</methodName><params><param><value><struct><member><name>Signature</name><value><base64>AAEA/0dJRgA=</base64></value></member><member><name>Empty</name><value><base64></base64></value></member></struct></value></param></params></methodCall>"
+	if xml != expected {
+		t.Error("RPC2XML conversion failed")
+		t.Error("Expected", expected)
+		t.Error("Got", xml)
+	}
+
+	out := new(StructBase64Xml2Rpc)
+	if err := xml2RPC(xml, out); err != nil {
+		t.Error("XML2RPC conversion failed", err)
+	}
+	if !reflect.DeepEqual(out, in) || out.Empty == nil {
+		t.Errorf("Expected %v, got %v", in, out)
+	}
+}
+
+func TestXML2RPCDateTimeRoundTrip(t *testing.T) {
+	call := func(value string) string {
+		return "<methodCall><methodName>Some.Method</methodName><params><param><value><struct><member><name>Time</name><value><dateTime.iso8601>" +
+			value + "</dateTime.iso8601></value></member></struct></value></param></params></methodCall>"
+	}
+	tests := []struct {
+		time time.Time
+		wire string
+	}{
+		{time.Date(2023, 11, 2, 10, 20, 30, 0, time.Local), "20231102T10:20:30"},
+		{time.Time{}, "00010101T00:00:00"},
+	}
+	for _, test := range tests {
+		xml, err := rpcRequest2XML("Some.Method", &StructTimeXml2Rpc{test.time})
+		if err != nil {
+			t.Error("RPC2XML conversion failed", err)
+		}
+		if xml != call(test.wire) {
+			t.Errorf("Expected %s, got %s", call(test.wire), xml)
+		}
+		req := new(StructTimeXml2Rpc)
+		if err := xml2RPC(xml, req); err != nil {
+			t.Error("XML2RPC conversion failed", err)
+		}
+		if !req.Time.Equal(test.time) || req.Time.IsZero() != test.time.IsZero() {
+			t.Errorf("%s: expected %v, got %v", test.wire, test.time, req.Time)
+		}
+	}
+
+	// The RFC3339 form is accepted as well.
+	req := new(StructTimeXml2Rpc)
+	if err := xml2RPC(call("2023-11-02T10:20:30.5Z"), req); err != nil {
+		t.Error("XML2RPC conversion failed", err)
+	}
+	if expected := time.Date(2023, 11, 2, 10, 20, 30, 5e8, time.UTC); !req.Time.Equal(expected) {
+		t.Errorf("Expected %v, got %v", expected, req.Time)
+	}
+}
+
+type StructConvertXml2Rpc struct {
+	Amount float64
+	Total  int64
+}
+
+func TestXML2RPCConvertNumbers(t *testing.T) {
+	call := "<methodCall><methodName>Some.Method</methodName><params><param><value><struct>" +
+		"<member><name>Amount</name><value><int>250</int></value></member>" +
+		"<member><name>Total</name><value><counter>7</counter></value></member>" +
+		"</struct></value></param></params></methodCall>"
+	d := &decoder{fallback: func(element, text string) (interface{}, error) {
+		n, err := strconv.ParseInt(text, 10, 32)
+		return int32(n), err
+	}}
+	req := new(StructConvertXml2Rpc)
+	if err := d.xml2RPC(call, req, nil); err != nil {
+		t.Fatal("XML2RPC conversion failed", err)
+	}
+	if req.Amount != 250 || req.Total != 7 {
+		t.Errorf("Expected 250 and 7, got %v and %v", req.Amount, req.Total)
+	}
+
+	tests := []struct {
+		value interface{}
+		typ   reflect.Type
+		ok    bool
+	}{
+		{int32(-5), reflect.TypeOf(int64(0)), true},
+		{int(1 << 53), reflect.TypeOf(float64(0)), true},
+		{int(1<<53 + 1), reflect.TypeOf(float64(0)), false},
+		{int(1 << 25), reflect.TypeOf(float32(0)), false},
+		{int64(300), reflect.TypeOf(int8(0)), false},
+		{int(-1), reflect.TypeOf(uint(0)), false},
+		{1.5, reflect.TypeOf(int(0)), false},
+		{1e300, reflect.TypeOf(float32(0)), false},
+		{"5", reflect.TypeOf(int(0)), false},
+	}
+	for _, test := range tests {
+		v, ok := convertNumber(reflect.ValueOf(test.value), test.typ)
+		if ok != test.ok {
+			t.Errorf("%T %v to %s: expected ok %v, got %v", test.value, test.value, test.typ, test.ok, ok)
+		}
+		if ok && v.Type() != test.typ {
+			t.Errorf("%T %v: expected a %s, got a %s", test.value, test.value, test.typ, v.Type())
+		}
+	}
+}
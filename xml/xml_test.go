@@ -6,9 +6,18 @@ package xml
 
 import (
 	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"reflect"
 	"strconv"
+	"strings"
 	"testing"
 
 	"github.com/mudphilo/go-xml-rpc"
@@ -127,6 +136,22 @@ func execute(t *testing.T, s *rpc.Server, method string, req, res interface{}) e
 	return DecodeClientResponse(w.Body, res)
 }
 
+func executeDetail(t *testing.T, s *rpc.Server, method string, req, res, detail interface{}) error {
+	if !s.HasMethod(method) {
+		t.Fatal("Expected to be registered:", method)
+	}
+
+	buf, _ := EncodeClientRequest(method, req)
+	body := bytes.NewBuffer(buf)
+	r, _ := http.NewRequest("POST", "http://localhost:8080/", body)
+	r.Header.Set("Content-Type", "text/xml")
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+
+	return DecodeClientResponseDetail(w.Body, res, detail)
+}
+
 func TestRPC2XMLConverter(t *testing.T) {
 	req := &Service1Request{4, 2}
 	xml, err := rpcRequest2XML("Some.Method", req)
@@ -220,3 +245,1358 @@ func TestServices(t *testing.T) {
 		t.Errorf("Wrong response: %v.", res3.Info)
 	}
 }
+
+func executeRaw(t *testing.T, s *rpc.Server, body string) *httptest.ResponseRecorder {
+	r, _ := http.NewRequest("POST", "http://localhost:8080/", bytes.NewBufferString(body))
+	r.Header.Set("Content-Type", "text/xml")
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	return w
+}
+
+type EmptyParamsService struct {
+	args Service1Request
+}
+
+func (t *EmptyParamsService) Multiply(r *http.Request, req *Service1Request, res *Service1Response) error {
+	t.args = *req
+	res.Result = req.A * req.B
+	return nil
+}
+
+func TestServiceEmptyParams(t *testing.T) {
+	bodies := map[string]string{
+		"absent": "<methodCall><methodName>EmptyParamsService.Multiply</methodName></methodCall>",
+		"empty":  "<methodCall><methodName>EmptyParamsService.Multiply</methodName><params/></methodCall>",
+	}
+	for name, body := range bodies {
+		service := &EmptyParamsService{args: Service1Request{1, 1}}
+		s := rpc.NewServer()
+		s.RegisterCodec(NewCodec(), "text/xml")
+		s.RegisterService(service, "")
+
+		w := executeRaw(t, s, body)
+		if w.Code != 200 {
+			t.Errorf("%s params: expected status 200, got %d", name, w.Code)
+		}
+		if service.args != (Service1Request{}) {
+			t.Errorf("%s params: expected zero value args, got %+v", name, service.args)
+		}
+		var res Service1Response
+		if err := DecodeClientResponse(w.Body, &res); err != nil {
+			t.Errorf("%s params: expected err to be nil, but got: %v", name, err)
+		}
+	}
+}
+
+func TestServiceDecodeFault(t *testing.T) {
+	service := &EmptyParamsService{args: Service1Request{1, 1}}
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "text/xml")
+	s.RegisterService(service, "")
+
+	w := executeRaw(t, s, "<methodCall><methodName>EmptyParamsService.Multiply</methodName><params><param><value><struct>"+
+		"<member><name>A</name><value><string>two</string></value></member>"+
+		"</struct></value></param></params></methodCall>")
+	if w.Code != 200 {
+		t.Errorf("Expected status 200, got %d", w.Code)
+	}
+	if service.args != (Service1Request{1, 1}) {
+		t.Errorf("Expected the method not to be called, got args %+v", service.args)
+	}
+	var res Service1Response
+	err := DecodeClientResponse(w.Body, &res)
+	if fault, ok := err.(Fault); !ok || fault.Code != FaultInvalidParams.Code {
+		t.Errorf("Expected an invalid params fault, got %v", err)
+	}
+}
+
+func TestMethodNameWhitespace(t *testing.T) {
+	codec := NewCodec()
+	s := rpc.NewServer()
+	s.RegisterCodec(codec, "text/xml")
+	s.RegisterService(new(Service1), "")
+
+	padded := "<methodCall><methodName>\n  Service1.Multiply\t</methodName><params><param><value><struct><member><name>A</name><value><int>4</int></value></member><member><name>B</name><value><int>2</int></value></member></struct></value></param></params></methodCall>"
+	w := executeRaw(t, s, padded)
+	var res Service1Response
+	if err := DecodeClientResponse(w.Body, &res); err != nil {
+		t.Error("Expected err to be nil, but got:", err)
+	}
+	if res.Result != 8 {
+		t.Errorf("Wrong response: %v.", res.Result)
+	}
+
+	spaced := "<methodCall><methodName>Service1. Multiply</methodName></methodCall>"
+	w = executeRaw(t, s, spaced)
+	if w.Code != 200 || !strings.Contains(w.Body.String(), strconv.Itoa(rpc.FaultCodeMethodNotFound)) {
+		t.Errorf("Expected a lookup failure, got %d: %s", w.Code, w.Body.String())
+	}
+
+	codec.SetStrictMethodNames(true)
+	w = executeRaw(t, s, spaced)
+	err := DecodeClientResponse(bytes.NewReader(w.Body.Bytes()), &res)
+	if fault, ok := err.(Fault); w.Code != 200 || !ok || fault.Code != FaultDecode.Code || !strings.Contains(fault.String, "method name contains whitespace") {
+		t.Errorf("Expected the method name to be rejected, got %d: %s", w.Code, w.Body.String())
+	}
+	w = executeRaw(t, s, padded)
+	if w.Code != 200 {
+		t.Errorf("Expected padded method names to be accepted in strict mode, got %d", w.Code)
+	}
+}
+
+type HugeResponse struct {
+	Items []int
+}
+
+type HugeService struct{}
+
+func (t *HugeService) List(r *http.Request, req *Service1Request, res *HugeResponse) error {
+	res.Items = make([]int, req.A)
+	return nil
+}
+
+func TestMaxResponseBytes(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "text/xml")
+	s.RegisterService(new(HugeService), "")
+	s.SetMaxResponseBytes(1024)
+
+	var res HugeResponse
+	if err := execute(t, s, "HugeService.List", &Service1Request{A: 10}, &res); err != nil {
+		t.Error("Expected err to be nil, but got:", err)
+	}
+	if len(res.Items) != 10 {
+		t.Errorf("Wrong response: %v.", res.Items)
+	}
+
+	err := execute(t, s, "HugeService.List", &Service1Request{A: 2000}, &res)
+	fault, ok := err.(Fault)
+	if !ok || fault.Code != rpc.FaultCodeApplication || fault.String != "Response Too Large" {
+		t.Errorf("Expected a response too large fault, got %v", err)
+	}
+}
+
+type Payment interface {
+	Amount() int
+}
+
+type CardPayment struct {
+	Type   string
+	Cents  int
+	Number string
+}
+
+func (p *CardPayment) Amount() int { return p.Cents }
+
+type MobilePayment struct {
+	Cents int
+	Phone string
+}
+
+func (p *MobilePayment) Amount() int { return p.Cents }
+
+type PaymentRequest struct {
+	Payment Payment
+}
+
+type PaymentResponse struct {
+	Kind   string
+	Amount int
+}
+
+type PaymentService struct{}
+
+func (t *PaymentService) Pay(r *http.Request, req *PaymentRequest, res *PaymentResponse) error {
+	switch p := req.Payment.(type) {
+	case *CardPayment:
+		res.Kind = "card " + p.Number
+	case *MobilePayment:
+		res.Kind = "mobile " + p.Phone
+	}
+	if req.Payment != nil {
+		res.Amount = req.Payment.Amount()
+	}
+	return nil
+}
+
+func TestRegisterInterfaceType(t *testing.T) {
+	codec := NewCodec()
+	codec.RegisterInterfaceType("card", func() interface{} { return new(CardPayment) })
+	codec.RegisterInterfaceType("mobile", func() interface{} { return new(MobilePayment) })
+	s := rpc.NewServer()
+	s.RegisterCodec(codec, "text/xml")
+	s.RegisterService(new(PaymentService), "")
+
+	tests := []struct {
+		payment string
+		res     PaymentResponse
+	}{
+		{"<member><name>type</name><value><string>card</string></value></member><member><name>Cents</name><value><int>500</int></value></member><member><name>Number</name><value><string>4111</string></value></member>", PaymentResponse{"card 4111", 500}},
+		{"<member><name>type</name><value><string>mobile</string></value></member><member><name>Cents</name><value><int>250</int></value></member><member><name>Phone</name><value><string>254700000000</string></value></member>", PaymentResponse{"mobile 254700000000", 250}},
+	}
+	for _, test := range tests {
+		body := "<methodCall><methodName>PaymentService.Pay</methodName><params><param><value><struct><member><name>Payment</name><value><struct>" +
+			test.payment + "</struct></value></member></struct></value></param></params></methodCall>"
+		w := executeRaw(t, s, body)
+		var res PaymentResponse
+		if err := DecodeClientResponse(w.Body, &res); err != nil {
+			t.Error("Expected err to be nil, but got:", err)
+		}
+		if res != test.res {
+			t.Errorf("Wrong response: %+v, expected %+v.", res, test.res)
+		}
+	}
+}
+
+func TestMethodHandler(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "text/xml")
+	s.RegisterService(new(Service1), "")
+	mux := http.NewServeMux()
+	mux.Handle("/multiply", s.MethodHandler("Service1.Multiply"))
+
+	serve := func(body string) *httptest.ResponseRecorder {
+		r, _ := http.NewRequest("POST", "http://localhost:8080/multiply", bytes.NewBufferString(body))
+		r.Header.Set("Content-Type", "text/xml")
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w
+	}
+
+	params := "<params><param><value><struct><member><name>A</name><value><int>4</int></value></member><member><name>B</name><value><int>5</int></value></member></struct></value></param></params>"
+	w := serve("<methodCall>" + params + "</methodCall>")
+	var res Service1Response
+	if err := DecodeClientResponse(w.Body, &res); err != nil {
+		t.Error("Expected err to be nil, but got:", err)
+	}
+	if res.Result != 20 {
+		t.Errorf("Wrong response: %v.", res.Result)
+	}
+
+	w = serve("<methodCall><methodName>Service1.Divide</methodName>" + params + "</methodCall>")
+	err := DecodeClientResponse(w.Body, &res)
+	if fault, ok := err.(Fault); w.Code != 200 || !ok || fault.Code != rpc.FaultCodeMethodNotFound {
+		t.Errorf("Expected a mismatched method name to get a method not found fault, got %d: %v", w.Code, err)
+	}
+}
+
+func TestTrailingData(t *testing.T) {
+	codec := NewCodec()
+	s := rpc.NewServer()
+	s.RegisterCodec(codec, "text/xml")
+	s.RegisterService(new(Service1), "")
+
+	call := "<methodCall><methodName>Service1.Multiply</methodName><params><param><value><struct><member><name>A</name><value><int>4</int></value></member><member><name>B</name><value><int>2</int></value></member></struct></value></param></params></methodCall>"
+	tests := []struct {
+		trailing string
+		strictOK bool
+	}{
+		{"\n  <!-- done -->\n", true},
+		{"garbage", false},
+		{"<methodCall><methodName>Service1.Multiply</methodName></methodCall>", false},
+	}
+	for _, strict := range []bool{false, true} {
+		codec.SetStrictTrailingData(strict)
+		for _, test := range tests {
+			w := executeRaw(t, s, call+test.trailing)
+			var res Service1Response
+			err := DecodeClientResponse(w.Body, &res)
+			if ok := w.Code == 200 && err == nil && res.Result == 8; ok != (!strict || test.strictOK) {
+				t.Errorf("strict %v, trailing %q: got %d: %s", strict, test.trailing, w.Code, w.Body.String())
+			}
+		}
+	}
+}
+
+type ProductResponse struct {
+	Name string
+	Cost int `xmlrpc:"Cost,view=admin"`
+}
+
+type ProductService struct{}
+
+func (t *ProductService) Get(r *http.Request, req *Service1Request, res *ProductResponse) error {
+	res.Name = "Airtime"
+	res.Cost = 42
+	return nil
+}
+
+func TestView(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "text/xml")
+	s.RegisterService(new(ProductService), "")
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Role") == "admin" {
+			r = r.WithContext(WithView(r.Context(), "admin"))
+		}
+		s.ServeHTTP(w, r)
+	})
+
+	for _, role := range []string{"", "admin"} {
+		r, _ := http.NewRequest("POST", "http://localhost:8080/", strings.NewReader("<methodCall><methodName>ProductService.Get</methodName></methodCall>"))
+		r.Header.Set("Content-Type", "text/xml")
+		r.Header.Set("X-Role", role)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		body := w.Body.String()
+		if !strings.Contains(body, "<name>Name</name>") {
+			t.Errorf("role %q: expected the public field, got %s", role, body)
+		}
+		if admin := strings.Contains(body, "<name>Cost</name>"); admin != (role == "admin") {
+			t.Errorf("role %q: admin field present was %v, got %s", role, admin, body)
+		}
+	}
+}
+
+func TestHealth(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "text/xml")
+	s.RegisterService(new(Service1), "")
+	if err := s.EnableHealth(true); err != nil {
+		t.Fatal(err)
+	}
+
+	var ping rpc.PingReply
+	if err := execute(t, s, "Health.Ping", &rpc.HealthArgs{}, &ping); err != nil {
+		t.Error("Expected err to be nil, but got:", err)
+	}
+	if ping.Result != "pong" {
+		t.Errorf("Wrong response: %v.", ping.Result)
+	}
+
+	var status rpc.StatusReply
+	if err := execute(t, s, "Health.Status", &rpc.HealthArgs{}, &status); err != nil {
+		t.Error("Expected err to be nil, but got:", err)
+	}
+	// Service1.Multiply, Health.Ping and Health.Status.
+	if status.Methods != 3 || status.InFlight != 1 || status.Uptime < 0 {
+		t.Errorf("Wrong response: %+v.", status)
+	}
+
+	// Enabling is idempotent, and the service can be registered again
+	// once removed.
+	if err := s.EnableHealth(true); err != nil {
+		t.Error("Expected err to be nil, but got:", err)
+	}
+	s.EnableHealth(false)
+	if err := s.EnableHealth(true); err != nil {
+		t.Error("Expected err to be nil, but got:", err)
+	}
+}
+
+func TestNotReadyFault(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "text/xml")
+	s.RegisterService(new(Service1), "")
+	s.SetReady(false)
+
+	// The fault is encoded without reading the call.
+	w := executeRaw(t, s, "not a call")
+	var res Service1Response
+	err := DecodeClientResponse(w.Body, &res)
+	if fault, ok := err.(Fault); w.Code != http.StatusServiceUnavailable || !ok || fault.Code != rpc.FaultCodeNotReady {
+		t.Errorf("Expected a not ready fault with status 503, got %d %v", w.Code, err)
+	}
+}
+
+func TestHealthNameTaken(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "text/xml")
+	s.RegisterService(new(Service1), rpc.HealthServiceName)
+
+	if err := s.EnableHealth(true); err == nil {
+		t.Error("Expected an error enabling health over a registered service")
+	}
+	// Disabling must leave the service of the caller in place.
+	s.EnableHealth(false)
+	var res Service1Response
+	if err := execute(t, s, "Health.Multiply", &Service1Request{4, 2}, &res); err != nil {
+		t.Error("Expected err to be nil, but got:", err)
+	}
+	if res.Result != 8 {
+		t.Errorf("Wrong response: %v.", res.Result)
+	}
+}
+
+type SameTypeService struct {
+	args Service1Request
+}
+
+func (t *SameTypeService) Scale(r *http.Request, req *Service1Request, res *Service1Request) error {
+	res.A = req.A * 10
+	res.B = req.B * 10
+	t.args = *req
+	return nil
+}
+
+func TestSameTypeArgsReply(t *testing.T) {
+	service := new(SameTypeService)
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "text/xml")
+	s.RegisterService(service, "")
+
+	for i := 1; i <= 2; i++ {
+		var res Service1Request
+		if err := execute(t, s, "SameTypeService.Scale", &Service1Request{i, i + 1}, &res); err != nil {
+			t.Error("Expected err to be nil, but got:", err)
+		}
+		if service.args != (Service1Request{i, i + 1}) {
+			t.Errorf("Args were changed by the reply: %+v.", service.args)
+		}
+		if res != (Service1Request{i * 10, (i + 1) * 10}) {
+			t.Errorf("Wrong response: %+v.", res)
+		}
+	}
+}
+
+type StreamRequest struct {
+	Items <-chan int
+}
+
+type StreamService struct{}
+
+func (t *StreamService) Sum(r *http.Request, req *StreamRequest, res *Service1Response) error {
+	sums := make(chan int)
+	go func() {
+		sum := 0
+		for item := range req.Items {
+			sum += item
+		}
+		sums <- sum
+	}()
+	res.Result = <-sums
+	return nil
+}
+
+func TestArrayIntoChannel(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "text/xml")
+	s.RegisterService(new(StreamService), "")
+
+	const n = 5000
+	var body strings.Builder
+	body.WriteString("<methodCall><methodName>StreamService.Sum</methodName><params><param><value><struct><member><name>Items</name><value><array><data>")
+	for i := 1; i <= n; i++ {
+		body.WriteString("<value><int>" + strconv.Itoa(i) + "</int></value>")
+	}
+	body.WriteString("</data></array></value></member></struct></value></param></params></methodCall>")
+
+	w := executeRaw(t, s, body.String())
+	var res Service1Response
+	if err := DecodeClientResponse(w.Body, &res); err != nil {
+		t.Error("Expected err to be nil, but got:", err)
+	}
+	if res.Result != n*(n+1)/2 {
+		t.Errorf("Wrong response: %v.", res.Result)
+	}
+
+	// An empty array gives a closed channel rather than a nil one.
+	w = executeRaw(t, s, "<methodCall><methodName>StreamService.Sum</methodName><params><param><value><struct><member><name>Items</name><value><array><data></data></array></value></member></struct></value></param></params></methodCall>")
+	res = Service1Response{-1}
+	if err := DecodeClientResponse(w.Body, &res); err != nil || res.Result != 0 {
+		t.Errorf("Expected an empty sum, got %v (error: %v).", res.Result, err)
+	}
+}
+
+type UploadRequest struct {
+	Name  string
+	Data  Blob
+	Count int
+}
+
+type UploadService struct {
+	data []byte
+	file string
+}
+
+func (t *UploadService) Put(r *http.Request, req *UploadRequest, res *Service1Response) error {
+	switch w := req.Data.Writer.(type) {
+	case *bytes.Buffer:
+		t.data = w.Bytes()
+	case *os.File:
+		t.file = w.Name()
+		data, err := ioutil.ReadAll(w)
+		if err != nil {
+			return err
+		}
+		t.data = data
+	}
+	res.Result = int(req.Data.Size)
+	return nil
+}
+
+func TestBlobWriter(t *testing.T) {
+	payload := make([]byte, 1<<20)
+	for i := range payload {
+		payload[i] = byte(i * 7)
+	}
+	body := "<methodCall><methodName>UploadService.Put</methodName><params><param><value><struct>" +
+		"<member><name>Name</name><value><string>firmware.bin</string></value></member>" +
+		"<member><name>Data</name><value><base64>" + base64.StdEncoding.EncodeToString(payload) + "</base64></value></member>" +
+		"</struct></value></param></params></methodCall>"
+
+	for _, withWriter := range []bool{true, false} {
+		service := new(UploadService)
+		codec := NewCodec()
+		var members []string
+		if withWriter {
+			codec.SetBlobWriter(func(member string) (io.Writer, error) {
+				members = append(members, member)
+				return new(bytes.Buffer), nil
+			})
+		}
+		s := rpc.NewServer()
+		s.RegisterCodec(codec, "text/xml")
+		s.RegisterService(service, "")
+
+		w := executeRaw(t, s, body)
+		var res Service1Response
+		if err := DecodeClientResponse(w.Body, &res); err != nil {
+			t.Error("Expected err to be nil, but got:", err)
+		}
+		if res.Result != len(payload) || !bytes.Equal(service.data, payload) {
+			t.Errorf("writer %v: got %d bytes, expected %d.", withWriter, len(service.data), len(payload))
+		}
+		if withWriter && (len(members) != 1 || members[0] != "Data") {
+			t.Errorf("Blob writer called for %v, expected [Data].", members)
+		}
+		// The temporary file is removed once the response is written.
+		if !withWriter {
+			if _, err := os.Stat(service.file); !os.IsNotExist(err) {
+				t.Errorf("Expected %q to be removed, got %v.", service.file, err)
+			}
+		}
+	}
+}
+
+func TestBlobTempFileCleanup(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("TMPDIR", dir)
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "text/xml")
+	s.RegisterService(new(UploadService), "")
+
+	data := "<member><name>Data</name><value><base64>" + base64.StdEncoding.EncodeToString([]byte("firmware")) + "</base64></value></member>"
+	for _, members := range []string{
+		// The base64 text is corrupt.
+		"<member><name>Data</name><value><base64>Zm9v!!!!</base64></value></member>",
+		// A member after the blob fails to decode.
+		data + "<member><name>Count</name><value><string>many</string></value></member>",
+	} {
+		w := executeRaw(t, s, "<methodCall><methodName>UploadService.Put</methodName><params><param><value><struct>"+members+"</struct></value></param></params></methodCall>")
+		var res Service1Response
+		if err := DecodeClientResponse(w.Body, &res); err == nil {
+			t.Errorf("%s: expected a fault", members)
+		}
+		if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+			t.Errorf("%s: expected no temporary file left, got %d.", members, len(files))
+		}
+	}
+}
+
+type LookupService struct{}
+
+func (t *LookupService) Find(r *http.Request, req *Service1Request, res *Service1Response) error {
+	return rpc.NewFault(404, "not found")
+}
+
+func (t *LookupService) Fetch(r *http.Request, req *Service1Request, res *Service1Response) error {
+	return fmt.Errorf("fetch %d: %w", req.A, rpc.WrapFault(503, errors.New("backend down")))
+}
+
+func TestNewFault(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "text/xml")
+	s.RegisterService(new(LookupService), "")
+
+	var res Service1Response
+	err := execute(t, s, "LookupService.Find", &Service1Request{}, &res)
+	if fault, ok := err.(Fault); !ok || fault.Code != 404 || fault.String != "not found" {
+		t.Errorf("Expected a 404 not found fault, got %v", err)
+	}
+
+	err = execute(t, s, "LookupService.Fetch", &Service1Request{A: 7}, &res)
+	if fault, ok := err.(Fault); !ok || fault.Code != 503 || fault.String != "backend down" {
+		t.Errorf("Expected a 503 backend down fault, got %v", err)
+	}
+}
+
+type BrokenResponse struct {
+	Result int
+	Done   chan bool
+}
+
+type BrokenService struct{}
+
+func (t *BrokenService) Get(r *http.Request, req *Service1Request, res *BrokenResponse) error {
+	res.Result = 42
+	res.Done = make(chan bool)
+	return nil
+}
+
+func TestEncodeFault(t *testing.T) {
+	codec := NewCodec()
+	s := rpc.NewServer()
+	s.RegisterCodec(codec, "text/xml")
+	s.RegisterService(new(BrokenService), "")
+
+	var res BrokenResponse
+	err := execute(t, s, "BrokenService.Get", &Service1Request{}, &res)
+	fault, ok := err.(Fault)
+	if !ok || fault.Code != FaultInternalError.Code || !strings.Contains(fault.String, "unsupported type chan bool") {
+		t.Errorf("Expected an internal error fault, got %v", err)
+	}
+	if res.Result != 0 {
+		t.Errorf("Expected no partial response, got %d", res.Result)
+	}
+
+	codec.SetEncodeFault(Fault{Code: -32000, String: "Reply Unavailable"})
+	err = execute(t, s, "BrokenService.Get", &Service1Request{}, &res)
+	if fault, ok := err.(Fault); !ok || fault.Code != -32000 || fault.String != "Reply Unavailable" {
+		t.Errorf("Expected the configured fault, got %v", err)
+	}
+}
+
+// BrokenFirstResponse has its unsupported field before a valid one.
+type BrokenFirstResponse struct {
+	Done   chan bool
+	Result int
+}
+
+type BrokenFirstService struct{}
+
+func (t *BrokenFirstService) Get(r *http.Request, req *Service1Request, res *BrokenFirstResponse) error {
+	res.Done = make(chan bool)
+	res.Result = 42
+	return nil
+}
+
+func TestEncodeFaultFirstField(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "text/xml")
+	s.RegisterService(new(BrokenFirstService), "")
+
+	var res BrokenFirstResponse
+	err := execute(t, s, "BrokenFirstService.Get", &Service1Request{}, &res)
+	fault, ok := err.(Fault)
+	if !ok || fault.Code != FaultInternalError.Code || !strings.Contains(fault.String, "unsupported type chan bool") {
+		t.Errorf("Expected an internal error fault, got %v", err)
+	}
+	if res.Result != 0 {
+		t.Errorf("Expected no partial response, got %d", res.Result)
+	}
+}
+
+type StatusResponse struct {
+	Active bool
+}
+
+func TestClientLenientBools(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/xml")
+		io.WriteString(w, "<methodResponse><params><param><value><struct><member><name>Active</name><value><int>1</int></value></member></struct></value></param></params></methodResponse>")
+	}))
+	defer upstream.Close()
+
+	call := func(d *ClientDecoder) (StatusResponse, error) {
+		var res StatusResponse
+		buf, _ := EncodeClientRequest("Account.Status", &Service1Request{})
+		resp, err := http.Post(upstream.URL, "text/xml", bytes.NewReader(buf))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		return res, d.DecodeResponse(resp.Body, &res)
+	}
+
+	if _, err := call(NewClientDecoder()); err == nil {
+		t.Error("Expected an error decoding an int into a bool by default")
+	}
+
+	d := NewClientDecoder()
+	d.SetLenientBools(true)
+	res, err := call(d)
+	if err != nil {
+		t.Error("Expected err to be nil, but got:", err)
+	}
+	if !res.Active {
+		t.Error("Expected <int>1</int> to decode as true")
+	}
+}
+
+func TestClientI4(t *testing.T) {
+	var body string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		body = string(b)
+		s := rpc.NewServer()
+		s.RegisterCodec(NewCodec(), "text/xml")
+		s.RegisterService(new(Service1), "")
+		r.Body = ioutil.NopCloser(bytes.NewReader(b))
+		s.ServeHTTP(w, r)
+	}))
+	defer upstream.Close()
+
+	for _, i4 := range []bool{false, true} {
+		e := NewClientEncoder()
+		e.SetI4(i4)
+		buf, err := e.EncodeRequest("Service1.Multiply", &Service1Request{4, 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.Post(upstream.URL, "text/xml", bytes.NewReader(buf))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var res Service1Response
+		err = DecodeClientResponse(resp.Body, &res)
+		resp.Body.Close()
+
+		expected, tag := "<value><int>4</int></value>", "<int>"
+		if i4 {
+			expected, tag = "<value><i4>4</i4></value>", "<i4>"
+		}
+		if !strings.Contains(body, expected) || strings.Count(body, tag) != 2 {
+			t.Errorf("i4 %v: expected %s in %s", i4, expected, body)
+		}
+		if err != nil || res.Result != 8 {
+			t.Errorf("i4 %v: expected 8, got %d (%v)", i4, res.Result, err)
+		}
+	}
+}
+
+func TestListMethods(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "text/xml")
+	s.RegisterService(new(Service1), "")
+	if s.HasMethod("system.listMethods") {
+		t.Error("Expected introspection to be disabled by default")
+	}
+	s.EnableIntrospection(true)
+	s.RegisterService(new(LookupService), "")
+
+	var methods []string
+	if err := execute(t, s, "system.listMethods", &struct{}{}, &methods); err != nil {
+		t.Error("Expected err to be nil, but got:", err)
+	}
+	expected := []string{"LookupService.Fetch", "LookupService.Find", "Service1.Multiply", "system.listMethods", "system.methodSignature"}
+	if !reflect.DeepEqual(methods, expected) {
+		t.Errorf("Listed %q, expected %q.", methods, expected)
+	}
+}
+
+func TestMethodSignature(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "text/xml")
+	s.RegisterService(new(Service1), "")
+	s.EnableIntrospection(true)
+
+	call := func(method string) ([][]string, error) {
+		var signatures [][]string
+		w := executeRaw(t, s, "<methodCall><methodName>system.methodSignature</methodName><params><param><value><string>"+
+			method+"</string></value></param></params></methodCall>")
+		if w.Code != http.StatusOK {
+			t.Errorf("Status was %d, should be 200.", w.Code)
+		}
+		return signatures, DecodeClientResponse(w.Body, &signatures)
+	}
+
+	signatures, err := call("Service1.Multiply")
+	if err != nil {
+		t.Error("Expected err to be nil, but got:", err)
+	}
+	expected := [][]string{{"struct", "struct"}}
+	if !reflect.DeepEqual(signatures, expected) {
+		t.Errorf("Signatures were %q, expected %q.", signatures, expected)
+	}
+
+	_, err = call("Service1.Missing")
+	if fault, ok := err.(Fault); !ok || fault.Code != rpc.FaultCodeMethodNotFound {
+		t.Errorf("Expected a method not found fault, got %v", err)
+	}
+}
+
+func TestMulticall(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "text/xml")
+	s.RegisterService(new(Service1), "")
+	s.RegisterService(new(LookupService), "")
+
+	call := func(method, params string) string {
+		return "<value><struct><member><name>methodName</name><value><string>" + method + "</string></value></member>" +
+			"<member><name>params</name><value><array><data>" + params + "</data></array></value></member></struct></value>"
+	}
+	multiply := "<value><struct><member><name>A</name><value><int>4</int></value></member><member><name>B</name><value><int>2</int></value></member></struct></value>"
+	w := executeRaw(t, s, "<methodCall><methodName>system.multicall</methodName><params><param><value><array><data>"+
+		call("Service1.Multiply", multiply)+
+		call("LookupService.Find", "")+
+		call("NoSuch.Method", "")+
+		call("system.multicall", "")+
+		call("Service1.Multiply", multiply)+
+		"</data></array></value></param></params></methodCall>")
+
+	var results []interface{}
+	if err := DecodeClientResponse(w.Body, &results); err != nil {
+		t.Fatal("Expected err to be nil, but got:", err)
+	}
+	if len(results) != 5 {
+		t.Fatalf("Got %d results, expected 5: %v", len(results), results)
+	}
+	for _, i := range []int{0, 4} {
+		reply, ok := results[i].([]interface{})
+		if !ok || len(reply) != 1 || !reflect.DeepEqual(reply[0], map[string]interface{}{"Result": 8}) {
+			t.Errorf("Result %d was %v, expected [map[Result:8]].", i, results[i])
+		}
+	}
+	for i, code := range map[int]int{1: 404, 2: rpc.FaultCodeMethodNotFound, 3: rpc.FaultCodeInvalidRequest} {
+		fault, ok := results[i].(map[string]interface{})
+		if !ok || fault["faultCode"] != code || fault["faultString"] == "" {
+			t.Errorf("Result %d was %v, expected a fault with code %d.", i, results[i], code)
+		}
+	}
+
+	// Batches over the cap are rejected as a whole.
+	s.SetMaxMulticall(1)
+	w = executeRaw(t, s, "<methodCall><methodName>system.multicall</methodName><params><param><value><array><data>"+
+		call("Service1.Multiply", multiply)+call("Service1.Multiply", multiply)+
+		"</data></array></value></param></params></methodCall>")
+	err := DecodeClientResponse(w.Body, &results)
+	if fault, ok := err.(Fault); !ok || fault.Code != rpc.FaultCodeInvalidRequest {
+		t.Errorf("Expected an invalid request fault, got %v", err)
+	}
+	s.SetMaxMulticall(0)
+
+	// Sub-calls whose params fail to decode get an invalid params fault,
+	// as single calls do.
+	w = executeRaw(t, s, "<methodCall><methodName>system.multicall</methodName><params><param><value><array><data>"+
+		call("Service1.Multiply", "<value><struct><member><name>A</name><value><string>four</string></value></member></struct></value>")+
+		"</data></array></value></param></params></methodCall>")
+	results = nil
+	if err := DecodeClientResponse(w.Body, &results); err != nil {
+		t.Fatal("Expected err to be nil, but got:", err)
+	}
+	if fault, ok := results[0].(map[string]interface{}); len(results) != 1 || !ok || fault["faultCode"] != rpc.FaultCodeInvalidParams {
+		t.Errorf("Expected an invalid params fault, got %v", results)
+	}
+
+	// An oversized response is replaced with a fault.
+	s.SetMaxResponseBytes(200)
+	w = executeRaw(t, s, "<methodCall><methodName>system.multicall</methodName><params><param><value><array><data>"+
+		call("Service1.Multiply", multiply)+call("Service1.Multiply", multiply)+call("Service1.Multiply", multiply)+
+		"</data></array></value></param></params></methodCall>")
+	err = DecodeClientResponse(w.Body, &results)
+	if fault, ok := err.(Fault); w.Code != http.StatusOK || !ok || fault.Code != rpc.FaultCodeApplication {
+		t.Errorf("Expected an application error fault with status 200, got %d %v", w.Code, err)
+	}
+}
+
+type SignupRequest struct {
+	MSISDN string
+	Age    int
+}
+
+func (r *SignupRequest) Validate() error {
+	var errs rpc.ValidationErrors
+	if !strings.HasPrefix(r.MSISDN, "254") {
+		errs = append(errs, rpc.FieldError{Field: "MSISDN", Message: "must start with 254"})
+	}
+	if r.Age < 18 {
+		errs = append(errs, rpc.FieldError{Field: "Age", Message: "must be at least 18"})
+	}
+	if errs != nil {
+		return errs
+	}
+	return nil
+}
+
+type SignupService struct {
+	called bool
+}
+
+func (t *SignupService) Register(r *http.Request, req *SignupRequest, res *Service1Response) error {
+	t.called = true
+	return nil
+}
+
+func TestValidationErrors(t *testing.T) {
+	service := new(SignupService)
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "text/xml")
+	s.RegisterService(service, "")
+
+	var (
+		res    Service1Response
+		detail map[string]interface{}
+	)
+	err := executeDetail(t, s, "SignupService.Register", &SignupRequest{MSISDN: "0700", Age: 16}, &res, &detail)
+	if fault, ok := err.(Fault); !ok || fault.Code != rpc.FaultCodeInvalidParams {
+		t.Fatalf("Expected an invalid params fault, got %v", err)
+	}
+	expected := []interface{}{
+		map[string]interface{}{"field": "MSISDN", "message": "must start with 254"},
+		map[string]interface{}{"field": "Age", "message": "must be at least 18"},
+	}
+	if !reflect.DeepEqual(detail["fields"], expected) {
+		t.Errorf("Fields were %v, expected %v.", detail["fields"], expected)
+	}
+	if service.called {
+		t.Error("Expected the method not to be called with invalid args")
+	}
+
+	if err := execute(t, s, "SignupService.Register", &SignupRequest{MSISDN: "254700000000", Age: 30}, &res); err != nil {
+		t.Error("Expected err to be nil, but got:", err)
+	}
+}
+
+func TestValidateTypes(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "text/xml")
+	s.RegisterService(new(Service1), "")
+	if err := s.ValidateTypes(); err != nil {
+		t.Error("Expected err to be nil, but got:", err)
+	}
+
+	s.RegisterService(new(BrokenService), "")
+	err := s.ValidateTypes()
+	if err == nil || !strings.Contains(err.Error(), "BrokenService.Get (text/xml): reply: xml: unsupported type chan bool") {
+		t.Errorf("Expected the unsupported reply field to be reported, got %v", err)
+	}
+
+	// Unsupported types are found within the fields of args and replies,
+	// though no call decodes or encodes them.
+	for _, test := range []struct {
+		service  interface{}
+		expected string
+	}{
+		{new(ComplexArgsService), "ComplexArgsService.Put (text/xml): args: xml: unsupported type complex128 in field Point.Phase"},
+		{new(FuncReplyService), "FuncReplyService.Get (text/xml): reply: xml: unsupported type func() in field Items.Callback"},
+		{new(MapArgsService), "MapArgsService.Put (text/xml): args: xml: unsupported map key type int in field Counts"},
+	} {
+		s := rpc.NewServer()
+		s.RegisterCodec(NewCodec(), "text/xml")
+		s.RegisterService(test.service, "")
+		if err := s.ValidateTypes(); err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("Expected %q, got %v", test.expected, err)
+		}
+	}
+}
+
+type ComplexArgs struct {
+	Point *struct {
+		X, Y  int
+		Phase complex128
+	}
+}
+
+type ComplexArgsService struct{}
+
+func (t *ComplexArgsService) Put(r *http.Request, req *ComplexArgs, res *Service1Response) error {
+	return nil
+}
+
+type FuncReply struct {
+	Items []struct {
+		Name     string
+		Callback func()
+	}
+}
+
+type FuncReplyService struct{}
+
+func (t *FuncReplyService) Get(r *http.Request, req *Service1Request, res *FuncReply) error {
+	return nil
+}
+
+type MapArgs struct {
+	Counts map[int]string
+}
+
+type MapArgsService struct{}
+
+func (t *MapArgsService) Put(r *http.Request, req *MapArgs, res *Service1Response) error {
+	return nil
+}
+
+func TestFaultResponse(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "text/xml")
+	s.RegisterService(new(LookupService), "")
+
+	fault := func(code int, message string) string {
+		return "<methodResponse><fault><value><struct>" +
+			"<member><name>faultCode</name><value><int>" + strconv.Itoa(code) + "</int></value></member>" +
+			"<member><name>faultString</name><value><string>" + message + "</string></value></member>" +
+			"</struct></value></fault></methodResponse>"
+	}
+	tests := []struct {
+		method, expected string
+	}{
+		{"LookupService.Find", fault(404, "not found")},
+		{"LookupService.Missing", fault(rpc.FaultCodeMethodNotFound, "rpc: can't find method &quot;LookupService.Missing&quot;")},
+	}
+	for _, test := range tests {
+		w := executeRaw(t, s, "<methodCall><methodName>"+test.method+"</methodName></methodCall>")
+		if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/xml") {
+			t.Errorf("%s: got status %d and content type %q, expected 200 and text/xml.", test.method, w.Code, w.Header().Get("Content-Type"))
+		}
+		if body := w.Body.String(); body != test.expected {
+			t.Errorf("%s: got %s, expected %s", test.method, body, test.expected)
+		}
+	}
+}
+
+var ErrSessionExpired = errors.New("session expired")
+
+type SessionService struct{}
+
+func (t *SessionService) Continue(r *http.Request, req *Service1Request, res *Service1Response) error {
+	return fmt.Errorf("continue: %w", ErrSessionExpired)
+}
+
+func (t *SessionService) Fail(r *http.Request, req *Service1Request, res *Service1Response) error {
+	return errors.New("boom")
+}
+
+func TestErrorMapper(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "text/xml")
+	s.RegisterService(new(SessionService), "")
+	s.SetErrorMapper(func(err error) (int, string) {
+		if errors.Is(err, ErrSessionExpired) {
+			return 480, "Session Expired"
+		}
+		return 0, ""
+	})
+
+	fault := func(code int, message string) string {
+		return "<methodResponse><fault><value><struct>" +
+			"<member><name>faultCode</name><value><int>" + strconv.Itoa(code) + "</int></value></member>" +
+			"<member><name>faultString</name><value><string>" + message + "</string></value></member>" +
+			"</struct></value></fault></methodResponse>"
+	}
+	tests := []struct {
+		method, expected string
+	}{
+		{"SessionService.Continue", fault(480, "Session Expired")},
+		{"SessionService.Fail", fault(FaultApplicationError.Code, "Application Error: boom")},
+	}
+	for _, test := range tests {
+		w := executeRaw(t, s, "<methodCall><methodName>"+test.method+"</methodName></methodCall>")
+		if body := w.Body.String(); body != test.expected {
+			t.Errorf("%s: got %s, expected %s", test.method, body, test.expected)
+		}
+	}
+}
+
+func TestPayloadSizes(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "text/xml")
+	s.RegisterService(new(Service1), "")
+
+	var info *rpc.RequestInfo
+	s.RegisterAfterFunc(func(i *rpc.RequestInfo) {
+		info = i
+	})
+
+	body := "<methodCall><methodName>Service1.Multiply</methodName><params><param><value><struct><member><name>A</name><value><int>4</int></value></member><member><name>B</name><value><int>2</int></value></member></struct></value></param></params></methodCall>"
+	w := executeRaw(t, s, body)
+	if info == nil {
+		t.Fatal("After Function was not called")
+	}
+	if info.RequestBytes != int64(len(body)) {
+		t.Errorf("RequestBytes was %d, should be %d", info.RequestBytes, len(body))
+	}
+	if info.ResponseBytes != int64(w.Body.Len()) {
+		t.Errorf("ResponseBytes was %d, should be %d", info.ResponseBytes, w.Body.Len())
+	}
+}
+
+func TestRequestBOM(t *testing.T) {
+	s := rpc.NewServer()
+	codec := NewCodec()
+	s.RegisterCodec(codec, "text/xml")
+	s.RegisterService(new(Service1), "")
+
+	body := "\xef\xbb\xbf<?xml version=\"1.0\"?><methodCall><methodName>Service1.Multiply</methodName><params><param><value><struct><member><name>A</name><value><int>4</int></value></member><member><name>B</name><value><int>2</int></value></member></struct></value></param></params></methodCall>"
+	var res Service1Response
+	w := executeRaw(t, s, body)
+	if err := DecodeClientResponse(w.Body, &res); err != nil || res.Result != 8 {
+		t.Errorf("Expected 8, got %d (%v)", res.Result, err)
+	}
+
+	codec.SetStrictBOM(true)
+	w = executeRaw(t, s, body)
+	err := DecodeClientResponse(bytes.NewReader(w.Body.Bytes()), &res)
+	if fault, ok := err.(Fault); w.Code != 200 || !ok || fault.Code != FaultDecode.Code || !strings.Contains(fault.String, "byte order mark") {
+		t.Errorf("Expected a parse error fault rejecting the byte order mark, got %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestGzipResponse(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "text/xml")
+	s.RegisterService(new(Service1), "")
+	s.SetCompression(true)
+	s.SetCompressionThreshold(1)
+
+	buf, _ := EncodeClientRequest("Service1.Multiply", &Service1Request{4, 2})
+	r, _ := http.NewRequest("POST", "http://localhost:8080/", bytes.NewBuffer(buf))
+	r.Header.Set("Content-Type", "text/xml")
+	r.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+
+	if w.Header().Get("Content-Encoding") != "gzip" || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/xml") {
+		t.Fatalf("Expected a gzipped text/xml response, got headers %v", w.Header())
+	}
+	zr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var res Service1Response
+	if err := DecodeClientResponse(zr, &res); err != nil || res.Result != 8 {
+		t.Errorf("Expected 8, got %d (%v)", res.Result, err)
+	}
+}
+
+type EchoArgs struct {
+	Text string
+}
+
+type EchoService struct{}
+
+func (t *EchoService) Echo(r *http.Request, req *EchoArgs, res *EchoArgs) error {
+	res.Text = req.Text
+	return nil
+}
+
+func TestRequestCharset(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "text/xml")
+	s.RegisterService(new(EchoService), "")
+
+	call := func(decl, text string) string {
+		return decl + "<methodCall><methodName>EchoService.Echo</methodName><params><param><value><struct><member><name>Text</name><value><string>" +
+			text + "</string></value></member></struct></value></param></params></methodCall>"
+	}
+	tests := []struct {
+		contentType string
+		body        string
+	}{
+		{"text/xml; charset=utf-8", call("", "Öñä")},
+		{"Text/XML; charset=\"UTF-8\"", call("", "Öñä")},
+		{"text/xml; charset=iso-8859-1", call("", "\xd6\xf1\xe4")},
+		{"text/xml; charset=ISO-8859-1", call(`<?xml version="1.0" encoding="ISO-8859-1"?>`, "\xd6\xf1\xe4")},
+		{"text/xml", call(`<?xml version="1.0" encoding="ISO-8859-1"?>`, "\xd6\xf1\xe4")},
+	}
+	for _, test := range tests {
+		r, _ := http.NewRequest("POST", "http://localhost:8080/", strings.NewReader(test.body))
+		r.Header.Set("Content-Type", test.contentType)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+
+		var res EchoArgs
+		if err := DecodeClientResponse(w.Body, &res); err != nil || res.Text != "Öñä" {
+			t.Errorf("%s: expected %q, got %q (%v)", test.contentType, "Öñä", res.Text, err)
+		}
+	}
+}
+
+func TestResponseCharset(t *testing.T) {
+	codec := NewCodec()
+	if err := codec.SetCharset("NO-SUCH-CHARSET"); err == nil {
+		t.Error("Expected an error setting an unsupported charset")
+	}
+	if err := codec.SetCharset("ISO-8859-1"); err != nil {
+		t.Fatal(err)
+	}
+	s := rpc.NewServer()
+	s.RegisterCodec(codec, "text/xml")
+	s.RegisterService(new(EchoService), "")
+
+	body := "<methodCall><methodName>EchoService.Echo</methodName><params><param><value><struct><member><name>Text</name><value><string>Öñä€</string></value></member></struct></value></param></params></methodCall>"
+	w := executeRaw(t, s, body)
+	if ct := w.Header().Get("Content-Type"); ct != "text/xml; charset=iso-8859-1" {
+		t.Errorf("Expected the iso-8859-1 content type, got %q", ct)
+	}
+	raw := w.Body.String()
+	if decl := `<?xml version="1.0" encoding="ISO-8859-1"?>`; !strings.HasPrefix(raw, decl) {
+		t.Errorf("Expected the response to start with %s, got %s", decl, raw)
+	}
+	// The euro sign isn't part of ISO-8859-1.
+	if !strings.Contains(raw, "<string>\xd6\xf1\xe4&#8364;</string>") {
+		t.Errorf("Expected ISO-8859-1 bytes and a character reference, got %q", raw)
+	}
+
+	var res EchoArgs
+	if err := DecodeClientResponse(strings.NewReader(raw), &res); err != nil || res.Text != "Öñä€" {
+		t.Errorf("Expected %q, got %q (%v)", "Öñä€", res.Text, err)
+	}
+
+	// Multicall responses are encoded alike.
+	w = executeRaw(t, s, "<methodCall><methodName>system.multicall</methodName><params><param><value><array><data>"+
+		"<value><struct><member><name>methodName</name><value><string>EchoService.Echo</string></value></member>"+
+		"<member><name>params</name><value><array><data><value><struct><member><name>Text</name><value><string>Öñä</string></value></member></struct></value></data></array></value></member></struct></value>"+
+		"</data></array></value></param></params></methodCall>")
+	if ct := w.Header().Get("Content-Type"); ct != "text/xml; charset=iso-8859-1" {
+		t.Errorf("Expected the iso-8859-1 content type for multicall, got %q", ct)
+	}
+	if raw := w.Body.String(); !strings.Contains(raw, "<string>\xd6\xf1\xe4</string>") {
+		t.Errorf("Expected ISO-8859-1 bytes in the multicall response, got %q", raw)
+	}
+}
+
+type MapService struct {
+	args map[string]interface{}
+}
+
+func (t *MapService) Echo(r *http.Request, req *map[string]interface{}, res *map[string]interface{}) error {
+	t.args = *req
+	*res = *req
+	return nil
+}
+
+func TestMapArgs(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "text/xml")
+	service := new(MapService)
+	if err := s.RegisterService(service, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	body := "<methodCall><methodName>MapService.Echo</methodName><params><param><value><struct>" +
+		"<member><name>msisdn</name><value><string>254700000000</string></value></member>" +
+		"<member><name>amount</name><value><double>12.5</double></value></member>" +
+		"<member><name>count</name><value><int>3</int></value></member>" +
+		"<member><name>session</name><value><struct><member><name>id</name><value><i4>7</i4></value></member></struct></value></member>" +
+		"<member><name>tags</name><value><array><data><value><string>a</string></value><value><int>1</int></value></data></array></value></member>" +
+		"<member><name>empty</name><value><struct></struct></value></member>" +
+		"</struct></value></param></params></methodCall>"
+	w := executeRaw(t, s, body)
+
+	expected := map[string]interface{}{
+		"msisdn":  "254700000000",
+		"amount":  12.5,
+		"count":   3,
+		"session": map[string]interface{}{"id": 7},
+		"tags":    []interface{}{"a", 1},
+		"empty":   map[string]interface{}{},
+	}
+	if !reflect.DeepEqual(service.args, expected) {
+		t.Errorf("Expected args %#v, got %#v", expected, service.args)
+	}
+
+	// Members are encoded sorted by name.
+	reply := "<methodResponse><params><param><value><struct>" +
+		"<member><name>amount</name><value><double>12.500000</double></value></member>" +
+		"<member><name>count</name><value><int>3</int></value></member>" +
+		"<member><name>empty</name><value><struct></struct></value></member>" +
+		"<member><name>msisdn</name><value><string>254700000000</string></value></member>" +
+		"<member><name>session</name><value><struct><member><name>id</name><value><int>7</int></value></member></struct></value></member>" +
+		"<member><name>tags</name><value><array><data><value><string>a</string></value><value><int>1</int></value></data></array></value></member>" +
+		"</struct></value></param></params></methodResponse>"
+	if got := w.Body.String(); got != reply {
+		t.Errorf("Expected %s, got %s", reply, got)
+	}
+}
+
+// EmbeddedArgs embeds an interface, which promotes methods but holds no
+// data to decode.
+type EmbeddedArgs struct {
+	fmt.Stringer
+	Name string
+}
+
+type EmbeddedService struct{}
+
+func (t *EmbeddedService) Echo(r *http.Request, req *EmbeddedArgs, res *EmbeddedArgs) error {
+	res.Name = req.Name
+	return nil
+}
+
+func TestEmbeddedInterface(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "text/xml")
+	if err := s.RegisterService(new(EmbeddedService), ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ValidateTypes(); err != nil {
+		t.Error("Expected err to be nil, but got:", err)
+	}
+
+	body := "<methodCall><methodName>EmbeddedService.Echo</methodName><params><param><value><struct>" +
+		"<member><name>Name</name><value><string>x</string></value></member>" +
+		"<member><name>Stringer</name><value><string>y</string></value></member>" +
+		"</struct></value></param></params></methodCall>"
+	w := executeRaw(t, s, body)
+	expected := "<methodResponse><params><param><value><struct><member><name>Name</name><value><string>x</string></value></member></struct></value></param></params></methodResponse>"
+	if got := w.Body.String(); got != expected {
+		t.Errorf("Expected %s, got %s", expected, got)
+	}
+}
+
+type NamedInterfaceArgs struct {
+	Value fmt.Stringer
+}
+
+func TestXML2RPCInterfaceMismatch(t *testing.T) {
+	xml := "<methodCall><methodName>Some.Method</methodName><params><param><value><struct><member><name>Value</name><value><string>x</string></value></member></struct></value></param></params></methodCall>"
+	err := xml2RPC(xml, new(NamedInterfaceArgs))
+	if fault, ok := err.(Fault); !ok || fault.Code != FaultInvalidParams.Code {
+		t.Errorf("Expected an invalid params fault, got %v", err)
+	}
+}
+
+type WarnService struct{}
+
+func (t *WarnService) Multiply(r *http.Request, req *Service1Request, res *Service1Response) error {
+	rpc.Warn(r.Context(), "B is deprecated")
+	rpc.Warn(r.Context(), "A will be capped")
+	res.Result = req.A * req.B
+	return nil
+}
+
+func (t *WarnService) Name(r *http.Request, req *Service1Request, res *string) error {
+	rpc.Warn(r.Context(), "use Names instead")
+	*res = "name"
+	return nil
+}
+
+type WarnedResponse struct {
+	Result   int
+	Warnings []string `xml:"warnings"`
+}
+
+func TestWarnings(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "text/xml")
+	s.RegisterService(new(WarnService), "")
+
+	body := "<methodCall><methodName>WarnService.Multiply</methodName><params><param><value><struct><member><name>A</name><value><int>4</int></value></member><member><name>B</name><value><int>2</int></value></member></struct></value></param></params></methodCall>"
+	w := executeRaw(t, s, body)
+	expected := "<methodResponse><params><param><value><struct><member><name>Result</name><value><int>8</int></value></member>" +
+		"<member><name>warnings</name><value><array><data><value><string>B is deprecated</string></value><value><string>A will be capped</string></value></data></array></value></member>" +
+		"</struct></value></param></params></methodResponse>"
+	if got := w.Body.String(); got != expected {
+		t.Errorf("Expected %s, got %s", expected, got)
+	}
+	var res WarnedResponse
+	if err := DecodeClientResponse(w.Body, &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Result != 8 || !reflect.DeepEqual(res.Warnings, []string{"B is deprecated", "A will be capped"}) {
+		t.Errorf("Expected the result with its warnings, got %+v", res)
+	}
+
+	// Replies other than structs carry their warnings in a header.
+	w = executeRaw(t, s, "<methodCall><methodName>WarnService.Name</methodName></methodCall>")
+	if warnings := w.Header().Values(WarningsHeader); !reflect.DeepEqual(warnings, []string{"use Names instead"}) {
+		t.Errorf("Expected the warning in the %s header, got %v", WarningsHeader, warnings)
+	}
+	if got := w.Body.String(); strings.Contains(got, "warnings") {
+		t.Errorf("Expected no warnings member, got %s", got)
+	}
+}